@@ -28,6 +28,7 @@ import (
 
 	"github.com/ljanyst/peroxide/pkg/bridge"
 	"github.com/ljanyst/peroxide/pkg/users"
+	"github.com/ljanyst/peroxide/pkg/users/credentials"
 )
 
 func askPass(prompt string) ([]byte, error) {
@@ -183,11 +184,15 @@ func loginAccount(b *bridge.Bridge, accountName string) error {
 	return nil
 }
 
-func addKey(b *bridge.Bridge, accountName, keyName string) error {
+func addKey(b *bridge.Bridge, accountName, keyName, keyScope string) error {
 	if accountName == "" || keyName == "" {
 		return fmt.Errorf("Key name or account name empty")
 	}
 
+	if !credentials.ValidScope(keyScope) {
+		return fmt.Errorf("Unknown key scope: %s", keyScope)
+	}
+
 	user, err := b.Users.GetUser(accountName)
 	if err != nil {
 		return fmt.Errorf("Cannot get user data: %s", err)
@@ -202,7 +207,7 @@ func addKey(b *bridge.Bridge, accountName, keyName string) error {
 		return fmt.Errorf("The main key is required to add a new key")
 	}
 
-	key, err := user.AddKeySlot(keyName, string(mainKey))
+	key, err := user.AddKeySlot(keyName, string(mainKey), keyScope)
 	if err != nil {
 		return fmt.Errorf("Cannot add key slot: %s", err)
 	}
@@ -34,6 +34,7 @@ var x509KeyFile = flag.String("x509-key", "key.pem", "output file for the RSA ke
 var x509CertFile = flag.String("x509-cert", "cert.pem", "output file for the X509 certificate")
 var accountName = flag.String("account-name", "", "account name")
 var keyName = flag.String("key-name", "", "key name")
+var keyScope = flag.String("key-scope", "", "restrict the key to one protocol: imap or smtp (default: all)")
 var logLevel = flag.String("log-level", "Warning", "account name")
 
 func main() {
@@ -60,7 +61,7 @@ func main() {
 	case "login-account":
 		err = loginAccount(b, *accountName)
 	case "add-key":
-		err = addKey(b, *accountName, *keyName)
+		err = addKey(b, *accountName, *keyName, *keyScope)
 	case "remove-key":
 		err = removeKey(b, *accountName, *keyName)
 	default:
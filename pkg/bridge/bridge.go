@@ -63,12 +63,17 @@ func (b *Bridge) Configure(configFile string) error {
 
 	settingsObj := settings.New(configFile)
 
+	if err := logging.SetFormat(settingsObj.Get(settings.LogFormat)); err != nil {
+		return err
+	}
+
 	if err := store.ClearIncompatibleStore(settingsObj.Get(settings.CacheDir)); err != nil {
 		return err
 	}
 
 	listener := listener.New()
 	events.SetupEvents(listener)
+	settingsObj.SetListener(listener)
 
 	cfg := pmapi.NewConfig()
 	cfg.UpgradeApplicationHandler = func() {
@@ -77,6 +82,11 @@ func (b *Bridge) Configure(configFile string) error {
 	cfg.TLSIssueHandler = func() {
 		log.Error("TLS Certificate Issue")
 	}
+	proxyURL, err := pmapi.ParseProxyURL(settingsObj.Get(settings.APIProxyURL))
+	if err != nil {
+		return err
+	}
+	cfg.ProxyURL = proxyURL
 
 	cm := pmapi.New(cfg)
 	jar, err := cookies.NewCookieJar(settingsObj.Get(settings.CookieJar))
@@ -95,16 +105,37 @@ func (b *Bridge) Configure(configFile string) error {
 		log.WithError(err).Error("Cannot load persistent message cache")
 	}
 
-	builder := message.NewBuilder(
-		settingsObj.GetInt(settings.FetchWorkers),
-		settingsObj.GetInt(settings.AttachmentWorkers),
-	)
+	builder, err := message.NewBuilderWithLimit(settingsObj.BuilderWorkers())
+	if err != nil {
+		return err
+	}
+	if settingsObj.GetBool(settings.SafeMode) {
+		log.Warn("Safe mode: messages are built one at a time")
+		store.SetBuildAndCacheJobLimit(1)
+	}
+	builder.SetForceCRLF(settingsObj.GetBool(settings.ForceCRLF))
+
+	if settingsObj.GetBool(settings.CredentialsStrictPermissions) {
+		if err := credentials.CheckFilePermissions(settingsObj.Get(settings.CredentialsStore)); err != nil {
+			return err
+		}
+	}
 
 	credStore, err := credentials.NewStore(settingsObj.Get(settings.CredentialsStore))
 	if err != nil {
 		return err
 	}
 
+	if settingsObj.GetBool(settings.VerifyCredentials) {
+		for _, err := range credStore.Verify() {
+			log.WithError(err).Error("Credentials store entry is broken")
+		}
+	}
+
+	for email, userIDs := range credStore.FindEmailConflicts() {
+		log.WithField("email", email).WithField("userIDs", userIDs).Warn("Address is claimed by several users")
+	}
+
 	u := users.New(
 		listener,
 		cm,
@@ -112,6 +143,10 @@ func (b *Bridge) Configure(configFile string) error {
 		store.NewStoreFactory(settingsObj, listener, cache, builder),
 	)
 
+	if err := u.SetBringOnlineWorkers(settingsObj.GetInt(settings.BringOnlineWorkers)); err != nil {
+		return err
+	}
+
 	b.Users = u
 	b.settings = settingsObj
 	b.listener = listener
@@ -129,8 +164,23 @@ func (b *Bridge) Run() error {
 
 	bccSelf := b.settings.GetBool(settings.BCCSelf)
 	isAllMailVisible := b.settings.GetBool(settings.IsAllMailVisible)
-	imapBackend := imap.NewIMAPBackend(b.listener, b.settings, b.Users, bccSelf, isAllMailVisible)
-	smtpBackend := smtp.NewSMTPBackend(b.listener, b.Users, bccSelf)
+	imapBackend, err := imap.NewIMAPBackendChecked(
+		b.listener, b.settings, b.Users,
+		imap.WithBCCSelf(bccSelf),
+		imap.WithAllMailVisible(isAllMailVisible),
+	)
+	if err != nil {
+		return err
+	}
+	imapTLSConfig, err := imap.NewTLSConfig(tlsConfig, b.settings)
+	if err != nil {
+		return err
+	}
+	imapTLSMode, err := imap.ParseTLSMode(b.settings.Get(settings.IMAPTLSMode))
+	if err != nil {
+		return err
+	}
+	smtpBackend := smtp.NewSMTPBackend(b.listener, b.settings, b.Users, bccSelf)
 	serverAddress := b.settings.Get(settings.ServerAddress)
 
 	go func() {
@@ -138,7 +188,7 @@ func (b *Bridge) Run() error {
 		imap.NewIMAPServer(
 			false, // log client
 			false, // log server
-			serverAddress, imapPort, tlsConfig,
+			serverAddress, imapPort, imapTLSMode.UseSSL(), imapTLSConfig,
 			imapBackend, b.listener).ListenAndServe()
 	}()
 
@@ -155,6 +205,12 @@ func (b *Bridge) Run() error {
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
 	<-done
 
+	imapBackend.Close()
+
+	if err := imapBackend.FlushCache(); err != nil {
+		log.WithError(err).Error("Failed to flush the IMAP cache")
+	}
+
 	return nil
 }
 
@@ -0,0 +1,111 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+// Package clock provides a replaceable source of time so that time-dependent
+// behaviour (backoffs, penalties, timestamps) can be tested deterministically.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// Real is the clock backed by the time package.
+var Real Clock = realClock{} //nolint:gochecknoglobals
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+// Fake is a clock which only moves forward when Advance is called.
+type Fake struct {
+	now     time.Time
+	waiters []fakeWaiter
+	lock    sync.Mutex
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.now
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	ch := make(chan time.Time, 1)
+
+	if d <= 0 {
+		ch <- f.now
+		return ch
+	}
+
+	f.waiters = append(f.waiters, fakeWaiter{deadline: f.now.Add(d), ch: ch})
+
+	return ch
+}
+
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.After(d)
+}
+
+// Advance moves the clock forward by d and fires all waiters which are due.
+func (f *Fake) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.now = f.now.Add(d)
+
+	pending := f.waiters[:0]
+
+	for _, w := range f.waiters {
+		if w.deadline.After(f.now) {
+			pending = append(pending, w)
+		} else {
+			w.ch <- f.now
+		}
+	}
+
+	f.waiters = pending
+}
+
+// Waiters returns the number of pending After or Sleep calls.
+func (f *Fake) Waiters() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.waiters)
+}
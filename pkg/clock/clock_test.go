@@ -0,0 +1,47 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+
+	ch := clk.After(time.Minute)
+	assert.Equal(t, 1, clk.Waiters())
+
+	clk.Advance(30 * time.Second)
+	assert.Equal(t, start.Add(30*time.Second), clk.Now())
+
+	select {
+	case <-ch:
+		t.Fatal("fired too early")
+	default:
+	}
+
+	clk.Advance(30 * time.Second)
+	assert.Equal(t, start.Add(time.Minute), <-ch)
+	assert.Equal(t, 0, clk.Waiters())
+}
@@ -18,11 +18,18 @@
 package settings
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"sync"
 
 	"github.com/ghodss/yaml"
+	"github.com/ljanyst/peroxide/pkg/events"
+	"github.com/ljanyst/peroxide/pkg/listener"
 	"github.com/sirupsen/logrus"
 )
 
@@ -30,6 +37,9 @@ type keyValueStore struct {
 	cache map[string]string
 	path  string
 	lock  *sync.RWMutex
+
+	// listener is notified about changed keys; nil disables notifications.
+	listener listener.Listener
 }
 
 // newKeyValueStore returns loaded preferences.
@@ -79,38 +89,208 @@ func (p *keyValueStore) Get(key string) string {
 	return p.cache[key]
 }
 
+// ErrInvalidValue is returned when a setting cannot be parsed as the
+// requested type.
+var ErrInvalidValue = errors.New("invalid setting value")
+
 func (p *keyValueStore) GetBool(key string) bool {
 	return p.Get(key) == "true"
 }
 
+// GetBoolE is like GetBool but fails when the value is neither "true",
+// "false" nor empty.
+func (p *keyValueStore) GetBoolE(key string) (bool, error) {
+	switch value := p.Get(key); value {
+	case "true":
+		return true, nil
+	case "false", "":
+		return false, nil
+	default:
+		return false, fmt.Errorf("%w: %s is not a bool: %q", ErrInvalidValue, key, value)
+	}
+}
+
 func (p *keyValueStore) GetInt(key string) int {
+	value, err := p.GetIntE(key)
+	if err != nil {
+		logrus.WithError(err).Error("Cannot parse int")
+	}
+
+	return value
+}
+
+// GetIntE is like GetInt but returns the parse error instead of logging it.
+// An empty value is 0.
+func (p *keyValueStore) GetIntE(key string) (int, error) {
 	if p.Get(key) == "" {
-		return 0
+		return 0, nil
 	}
 
 	value, err := strconv.Atoi(p.Get(key))
 	if err != nil {
-		logrus.WithError(err).Error("Cannot parse int")
+		return 0, fmt.Errorf("%w: %s is not an int: %v", ErrInvalidValue, key, err)
 	}
 
-	return value
+	return value, nil
 }
 
 func (p *keyValueStore) GetFloat64(key string) float64 {
+	value, err := p.GetFloat64E(key)
+	if err != nil {
+		logrus.WithError(err).Error("Cannot parse float64")
+	}
+
+	return value
+}
+
+// GetFloat64E is like GetFloat64 but returns the parse error instead of
+// logging it. An empty value is 0.
+func (p *keyValueStore) GetFloat64E(key string) (float64, error) {
 	if p.Get(key) == "" {
-		return 0
+		return 0, nil
 	}
 
 	value, err := strconv.ParseFloat(p.Get(key), 64)
 	if err != nil {
-		logrus.WithError(err).Error("Cannot parse float64")
+		return 0, fmt.Errorf("%w: %s is not a float64: %v", ErrInvalidValue, key, err)
 	}
 
-	return value
+	return value, nil
+}
+
+// SetListener sets the listener to which a SettingsChangedEvent carrying the
+// key is emitted whenever the value of a key changes. nil disables it.
+func (p *keyValueStore) SetListener(l listener.Listener) {
+	p.lock.Lock()
+	p.listener = l
+	p.lock.Unlock()
 }
 
 func (p *keyValueStore) set(key, value string) {
 	p.lock.Lock()
+	old, ok := p.cache[key]
 	p.cache[key] = value
+	l := p.listener
 	p.lock.Unlock()
+
+	if !ok || old != value {
+		notifyChanged(l, key)
+	}
+}
+
+func notifyChanged(l listener.Listener, keys ...string) {
+	if l == nil {
+		return
+	}
+
+	for _, key := range keys {
+		l.Emit(events.SettingsChangedEvent, key)
+	}
+}
+
+// SetMany sets all values and saves them to the settings file at once. The
+// file is replaced atomically so that it never contains only some of them.
+// If the file cannot be written, the previous values are restored.
+// Only keys present in the file and the new values are saved, not defaults.
+// Keys whose value changed are published once the file is saved, see SetListener.
+func (p *keyValueStore) SetMany(values map[string]string) error {
+	p.lock.Lock()
+
+	previous := make(map[string]*string, len(values))
+	changed := make([]string, 0, len(values))
+	for key, value := range values {
+		if old, ok := p.cache[key]; ok {
+			previous[key] = &old
+			if old == value {
+				continue
+			}
+		} else {
+			previous[key] = nil
+		}
+		p.cache[key] = value
+		changed = append(changed, key)
+	}
+
+	if err := p.saveValues(values); err != nil {
+		for key, old := range previous {
+			if old == nil {
+				delete(p.cache, key)
+			} else {
+				p.cache[key] = *old
+			}
+		}
+		p.lock.Unlock()
+		return err
+	}
+
+	l := p.listener
+	p.lock.Unlock()
+
+	sort.Strings(changed)
+	notifyChanged(l, changed...)
+
+	return nil
+}
+
+// saveValues merges values into the settings file.
+func (p *keyValueStore) saveValues(values map[string]string) error {
+	saved := map[string]string{}
+
+	mode := os.FileMode(0o600)
+	if info, err := os.Stat(p.path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if len(data) != 0 {
+		if err := yaml.Unmarshal(data, &saved); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range values {
+		saved[key] = value
+	}
+
+	if data, err = yaml.Marshal(saved); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p.path, data, mode)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it over path once it is synced to disk.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Chmod(mode); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
 }
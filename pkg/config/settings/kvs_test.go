@@ -20,8 +20,12 @@ package settings
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
+	"github.com/ljanyst/peroxide/pkg/events"
+	"github.com/ljanyst/peroxide/pkg/listener"
 	"github.com/stretchr/testify/require"
 )
 
@@ -76,6 +80,36 @@ func TestKeyValueStoreGetBool(t *testing.T) {
 	r.Equal(false, pref.GetBool("falseBool"))
 }
 
+func TestKeyValueStoreGetE(t *testing.T) {
+	r := require.New(t)
+	pref, clean := newTestKeyValueStore(r)
+	defer clean()
+
+	value, err := pref.GetIntE("int")
+	r.NoError(err)
+	r.Equal(42, value)
+
+	_, err = pref.GetIntE("str")
+	r.ErrorIs(err, ErrInvalidValue)
+	r.Equal(0, pref.GetInt("str"))
+
+	value, err = pref.GetIntE("missing")
+	r.NoError(err)
+	r.Equal(0, value)
+
+	_, err = pref.GetFloat64E("str")
+	r.ErrorIs(err, ErrInvalidValue)
+	r.Equal(0.0, pref.GetFloat64("str"))
+
+	b, err := pref.GetBoolE("bool")
+	r.NoError(err)
+	r.True(b)
+
+	_, err = pref.GetBoolE("falseBool")
+	r.ErrorIs(err, ErrInvalidValue)
+	r.False(pref.GetBool("falseBool"))
+}
+
 func TestKeyValueStoreSetDefault(t *testing.T) {
 	r := require.New(t)
 	pref, clean := newTestEmptyKeyValueStore(r)
@@ -112,3 +146,91 @@ func checkSavedKeyValueStore(r *require.Assertions, path, expected string) {
 	r.NoError(err)
 	r.Equal(expected, string(data))
 }
+
+func TestKeyValueStoreSetMany(t *testing.T) {
+	r := require.New(t)
+	pref, clean := newTestKeyValueStore(r)
+	defer clean()
+
+	pref.setDefault("default", "value")
+
+	r.NoError(pref.SetMany(map[string]string{"str": "changed", "new": "added"}))
+	r.Equal("changed", pref.Get("str"))
+	r.Equal("added", pref.Get("new"))
+
+	// Defaults are not saved.
+	checkSavedKeyValueStore(r, pref.path, "bool: \"true\"\nfalseBool: t\nint: \"42\"\nnew: added\nstr: changed\n")
+
+	reloaded := newKeyValueStore(pref.path)
+	r.Equal("changed", reloaded.Get("str"))
+	r.Equal("added", reloaded.Get("new"))
+	r.Equal("42", reloaded.Get("int"))
+}
+
+func TestKeyValueStoreSetManyRollback(t *testing.T) {
+	r := require.New(t)
+
+	// The settings file cannot be written into a regular file.
+	parent, clean := newTmpFile(r)
+	defer clean()
+
+	pref := newKeyValueStore(filepath.Join(parent, "settings.yaml"))
+	pref.set("str", "value")
+
+	r.Error(pref.SetMany(map[string]string{"str": "changed", "new": "added"}))
+	r.Equal("value", pref.Get("str"))
+	r.Equal("", pref.Get("new"))
+	r.NotContains(pref.cache, "new")
+}
+
+// fakeListener records the emitted events; other methods are not implemented.
+type fakeListener struct {
+	listener.Listener
+
+	lock    sync.Mutex
+	emitted []string
+}
+
+func (l *fakeListener) Emit(eventName, data string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.emitted = append(l.emitted, eventName+":"+data)
+}
+
+func TestKeyValueStoreNotifiesChanges(t *testing.T) {
+	r := require.New(t)
+	pref, clean := newTestKeyValueStore(r)
+	defer clean()
+
+	// Without a listener nothing is published.
+	pref.set("str", "first")
+
+	l := &fakeListener{}
+	pref.SetListener(l)
+
+	pref.set("str", "second")
+	pref.set("str", "second")
+	r.NoError(pref.SetMany(map[string]string{"str": "second", "int": "43", "new": "added"}))
+
+	changed := events.SettingsChangedEvent + ":"
+	r.Equal([]string{changed + "str", changed + "int", changed + "new"}, l.emitted)
+
+	pref.SetListener(nil)
+	pref.set("str", "third")
+	r.Len(l.emitted, 3)
+}
+
+func TestKeyValueStoreSetManyRollbackDoesNotNotify(t *testing.T) {
+	r := require.New(t)
+
+	parent, clean := newTmpFile(r)
+	defer clean()
+
+	pref := newKeyValueStore(filepath.Join(parent, "settings.yaml"))
+	l := &fakeListener{}
+	pref.SetListener(l)
+
+	r.Error(pref.SetMany(map[string]string{"str": "changed"}))
+	r.Empty(l.emitted)
+}
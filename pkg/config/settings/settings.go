@@ -20,6 +20,9 @@ package settings
 
 import (
 	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
 )
 
 // Keys of preferences in JSON file.
@@ -37,6 +40,7 @@ const (
 	IMAPWorkers           = "ImapWorkers"
 	FetchWorkers          = "FetchWorkers"
 	AttachmentWorkers     = "AttachmentWorkers"
+	MaxBuildJobs          = "MaxBuildJobs"
 	CacheDir              = "CacheDir"
 	X509Key               = "X509Key"
 	X509Cert              = "X509Cert"
@@ -45,8 +49,46 @@ const (
 	CredentialsStore      = "CredentialsStore"
 	BCCSelf               = "BCCSelf"
 	IsAllMailVisible      = "IsAllMailVisible"
+
+	IMAPMaxConnectionsPerAddress = "ImapMaxConnectionsPerAddress"
+	VerifyCredentials            = "VerifyCredentials"
+	IMAPTLSMinVersion            = "ImapTLSMinVersion"
+	IMAPTLSMode                  = "ImapTLSMode"
+	IMAPCacheFile                = "ImapCacheFile"
+	APIProxyURL                  = "ApiProxyURL"
+	IMAPSlowOpThreshold          = "ImapSlowOpThreshold"
+	IMAPMaxUsernameLength        = "ImapMaxUsernameLength"
+	LogFormat                    = "LogFormat"
+	ForceCRLF                    = "ForceCRLF"
+	IMAPAllowedNetworks          = "ImapAllowedNetworks"
+	IMAPSpecialUse               = "ImapSpecialUse"
+	CredentialsStrictPermissions = "CredentialsStrictPermissions"
+	IMAPCacheWarming             = "ImapCacheWarming"
+	BringOnlineWorkers           = "BringOnlineWorkers"
+	IMAPUpdatesSubscribedOnly    = "ImapUpdatesSubscribedOnly"
+	SafeMode                     = "SafeMode"
+	IMAPStripPlusTag             = "ImapStripPlusTag"
+	IMAPMaxConnections           = "ImapMaxConnections"
+	IMAPCacheReadOnly            = "ImapCacheReadOnly"
 )
 
+// NamespaceSeparator separates a key from its namespace in namespaced keys,
+// e.g. "BCCSelf.user@pm.me".
+const NamespaceSeparator = "."
+
+// NamespacedKey returns the key of the override of `key` for `sub`, usually
+// an address. sub is used as is; an address must be normalized by the caller.
+func NamespacedKey(key, sub string) string {
+	return key + NamespaceSeparator + sub
+}
+
+// BCCSelfAddressKey returns the key of the per-address override of BCCSelf.
+// When the key is not set the address inherits the global BCCSelf value.
+// The address must be normalized, see users.NormalizeAddress.
+func BCCSelfAddressKey(address string) string {
+	return NamespacedKey(BCCSelf, address)
+}
+
 type Settings struct {
 	*keyValueStore
 }
@@ -61,12 +103,130 @@ func New(settingsPath string) *Settings {
 	return s
 }
 
+// GetNamespaced returns the value of `key` overridden for `sub`, see
+// NamespacedKey. Without an override the value of `key` itself is returned.
+func (s *Settings) GetNamespaced(key, sub string) string {
+	if value := s.Get(NamespacedKey(key, sub)); value != "" {
+		return value
+	}
+
+	return s.Get(key)
+}
+
+// SetNamespaced sets and saves the override of `key` for `sub`. An empty
+// value makes `sub` fall back to `key` again.
+func (s *Settings) SetNamespaced(key, sub, value string) error {
+	return s.SetMany(map[string]string{NamespacedKey(key, sub): value})
+}
+
+// BuilderWorkers returns the worker counts to create the message builder
+// with. Unless MaxBuildJobs is set, every fetch worker may build a message at
+// the same time. In safe mode, meant for memory-constrained hosts, the builder works
+// on a single message at a time, trading latency for predictable memory use.
+func (s *Settings) BuilderWorkers() (fetchWorkers, attachmentWorkers, maxBuildJobs int) {
+	if s.GetBool(SafeMode) {
+		return 1, 1, 1
+	}
+
+	fetchWorkers = s.GetInt(FetchWorkers)
+	maxBuildJobs = fetchWorkers
+	if s.Get(MaxBuildJobs) != "" {
+		maxBuildJobs = s.GetInt(MaxBuildJobs)
+	}
+
+	return fetchWorkers, s.GetInt(AttachmentWorkers), maxBuildJobs
+}
+
 const (
 	DefaultIMAPPort = "1143"
 	DefaultSMTPPort = "1025"
 	DefaultAPIPort  = "1042"
 )
 
+// Types of settings values as reported by Keys.
+const (
+	TypeString = "string"
+	TypeBool   = "bool"
+	TypeInt    = "int"
+	TypeFloat  = "float"
+)
+
+// KeyInfo describes a settings key and its default value.
+type KeyInfo struct {
+	Key     string
+	Default string
+	Type    string
+}
+
+// keyTypes are the types which cannot be told from the default value.
+var keyTypes = map[string]string{ //nolint[gochecknoglobals]
+	CacheMinFreeRatKey: TypeFloat,
+	MaxBuildJobs:       TypeInt,
+}
+
+// Keys returns all settings keys with a default value, sorted by key, e.g.
+// to generate a config template. Per-address keys such as BCCSelfAddressKey
+// are not included.
+func Keys() []KeyInfo {
+	defaults := &Settings{keyValueStore: &keyValueStore{cache: map[string]string{}, lock: &sync.RWMutex{}}}
+	defaults.setDefaultValues()
+
+	keys := make([]KeyInfo, 0, len(defaults.cache))
+	for key, value := range defaults.cache {
+		keys = append(keys, KeyInfo{Key: key, Default: value, Type: keyType(key, value)})
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+
+	return keys
+}
+
+// secretKeys may carry credentials, e.g. in the user info of the proxy URL,
+// and are never reported by NonDefault.
+var secretKeys = map[string]bool{ //nolint[gochecknoglobals]
+	APIProxyURL: true,
+}
+
+// NonDefault returns the settings whose value differs from the default, e.g.
+// for a support bundle. Keys without a default, such as BCCSelfAddressKey, are
+// reported whenever they are set. Secret keys are left out.
+func (s *Settings) NonDefault() map[string]string {
+	defaults := map[string]string{}
+	for _, info := range Keys() {
+		defaults[info.Key] = info.Default
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	changed := map[string]string{}
+	for key, value := range s.cache {
+		if secretKeys[key] || value == defaults[key] {
+			continue
+		}
+
+		changed[key] = value
+	}
+
+	return changed
+}
+
+func keyType(key, value string) string {
+	if keyType, ok := keyTypes[key]; ok {
+		return keyType
+	}
+
+	if value == "true" || value == "false" {
+		return TypeBool
+	}
+
+	if _, err := strconv.Atoi(value); err == nil {
+		return TypeInt
+	}
+
+	return TypeString
+}
+
 func (s *Settings) setDefaultValues() {
 	s.setDefault(AllowProxyKey, "false")
 	s.setDefault(CacheEnabledKey, "true")
@@ -76,13 +236,34 @@ func (s *Settings) setDefaultValues() {
 	s.setDefault(CacheConcurrencyRead, "16")
 	s.setDefault(CacheConcurrencyWrite, "16")
 	s.setDefault(IMAPWorkers, "16")
+	s.setDefault(IMAPMaxConnectionsPerAddress, "0")
 	s.setDefault(FetchWorkers, "16")
 	s.setDefault(AttachmentWorkers, "16")
+	s.setDefault(MaxBuildJobs, "")
 	s.setDefault(APIPortKey, DefaultAPIPort)
 	s.setDefault(IMAPPortKey, DefaultIMAPPort)
 	s.setDefault(SMTPPortKey, DefaultSMTPPort)
 	s.setDefault(BCCSelf, "false")
 	s.setDefault(IsAllMailVisible, "true")
+	s.setDefault(VerifyCredentials, "false")
+	s.setDefault(IMAPTLSMinVersion, "")
+	s.setDefault(IMAPTLSMode, "starttls")
+	s.setDefault(IMAPCacheFile, "imap_backend_cache.json")
+	s.setDefault(APIProxyURL, "")
+	s.setDefault(IMAPSlowOpThreshold, "0")
+	s.setDefault(IMAPMaxUsernameLength, "512")
+	s.setDefault(LogFormat, "text")
+	s.setDefault(ForceCRLF, "false")
+	s.setDefault(IMAPAllowedNetworks, "")
+	s.setDefault(IMAPSpecialUse, "")
+	s.setDefault(CredentialsStrictPermissions, "false")
+	s.setDefault(IMAPCacheWarming, "false")
+	s.setDefault(BringOnlineWorkers, "4")
+	s.setDefault(IMAPUpdatesSubscribedOnly, "false")
+	s.setDefault(SafeMode, "false")
+	s.setDefault(IMAPStripPlusTag, "false")
+	s.setDefault(IMAPMaxConnections, "0")
+	s.setDefault(IMAPCacheReadOnly, "false")
 
 	settingsDir := "/etc/peroxide"
 	s.setDefault(CacheDir, "/var/cache/peroxide/cache")
@@ -25,6 +25,16 @@ import (
 // Constants of events used by the event listener in bridge.
 const (
 	CloseConnectionEvent = "closeConnection"
+	CloseSessionEvent    = "closeSession"
+	CacheErrorEvent      = "cacheError"
+	CacheRebuiltEvent    = "cacheRebuilt"
+	SettingsChangedEvent = "settingsChanged"
+	// EventLoopStoppedEvent is emitted with the user ID when the event loop
+	// of the user gives up and stops for good.
+	EventLoopStoppedEvent = "eventLoopStopped"
+	// LoginWarningEvent is emitted with "address: warning" when a login
+	// succeeds with a caveat, see users.User.LoginWarning.
+	LoginWarningEvent = "loginWarning"
 )
 
 // SetupEvents specific to event type and data.
@@ -29,37 +29,123 @@
 //   - within each worker, build jobs are posted to the message builder,
 //   - the message builder handles build jobs using its own, independent worker pool,
 //
-// The builder will handle jobs in parallel up to its own internal limit. This prevents it from overwhelming API.
+// The builder will handle jobs in parallel up to its own internal limit (settings.MaxBuildJobs,
+// or settings.FetchWorkers if unset; a single job in settings.SafeMode).
+// This prevents it from overwhelming API.
 package imap
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-imap"
 	goIMAPBackend "github.com/emersion/go-imap/backend"
+	"github.com/ljanyst/peroxide/pkg/clock"
 	"github.com/ljanyst/peroxide/pkg/config/settings"
 	"github.com/ljanyst/peroxide/pkg/events"
 	"github.com/ljanyst/peroxide/pkg/listener"
 	"github.com/ljanyst/peroxide/pkg/users"
+	"github.com/ljanyst/peroxide/pkg/users/credentials"
+	"github.com/sirupsen/logrus"
 )
 
+var (
+	// ErrNoPrimaryAddress is returned when logging in a user without any address.
+	ErrNoPrimaryAddress = errors.New("user has no primary address")
+
+	// ErrLoginsDisabled is returned by Login while logins are switched off by SetLoginsEnabled.
+	ErrLoginsDisabled = errors.New("logins temporarily disabled")
+
+	// ErrUsernameTooLong is returned by Login for usernames longer than the configured maximum.
+	ErrUsernameTooLong = errors.New("username is too long")
+)
+
+// badLoginDelay is how long Login blocks after a failed credentials check.
+const badLoginDelay = 10 * time.Second
+
 type imapBackend struct {
+	// Accessed atomically; kept first to stay 64-bit aligned on 32-bit platforms.
+	loginsSucceeded int64
+	loginsFailed    int64
+	cacheHits       int64
+	cacheMisses     int64
+	sessionSeq      uint64
+
+	// Accessed atomically; non-zero rejects new logins.
+	loginsDisabled int32
+
+	setting          *settings.Settings
 	usersMgr         *users.Users
 	updates          *imapUpdates
 	eventListener    listener.Listener
 	listWorkers      int
 	bccSelf          bool
 	isAllMailVisible bool
+	noChangeNotifier bool
+	clock            clock.Clock
+
+	// Operations taking longer are logged; 0 disables the logging.
+	slowOpThreshold time.Duration
+
+	// Longer usernames are rejected by Login; 0 means unlimited.
+	maxUsernameLength int
+
+	// Login resolves user+tag@domain as user@domain.
+	stripPlusTag bool
+
+	// Clients outside of these networks are rejected by Login; empty allows all.
+	ipAllowlist    []*net.IPNet
+	ipAllowlistErr error
+
+	// SPECIAL-USE attributes keyed by label ID or mailbox name.
+	specialUse map[string]string
+
+	noDisconnectionMonitor bool
 
 	users       map[string]*imapUser
 	usersLocker sync.Locker
 
+	// userCreations are the createUser calls in flight by address; guarded by usersLocker.
+	userCreations map[string]*userCreation
+
 	imapCache     map[string]map[string]string
 	imapCachePath string
 	imapCacheLock *sync.RWMutex
+
+	// The cache file is loaded but never written, e.g. on a read-only replica.
+	imapCacheReadOnly bool
+
+	maxConnectionsPerAddress int
+	maxConnections           int
+	connections              map[string]int
+	totalConnections         int
+	connectionsLock          sync.Mutex
+
+	// lifetime is done once the backend is closed; see loginContext.
+	lifetime      context.Context
+	closeLifetime context.CancelFunc
+
+	// logins are the cancel functions of the logins in flight by address and ID.
+	logins      map[string]map[uint64]context.CancelFunc
+	nextLoginID uint64
+	loginsLock  sync.Mutex
+
+	notifiers     map[string]*notifierSessions
+	notifiersLock sync.Mutex
+
+	sessions     map[string]*imapSession
+	sessionsLock sync.Mutex
 }
 
 // NewIMAPBackend returns struct implementing go-imap/backend interface.
@@ -70,11 +156,88 @@ func NewIMAPBackend(
 	bccSelf bool,
 	isAllMailVisible bool,
 ) *imapBackend { //nolint[golint]
+	return NewIMAPBackendWithOptions(
+		eventListener,
+		setting,
+		users,
+		WithBCCSelf(bccSelf),
+		WithAllMailVisible(isAllMailVisible),
+	)
+}
+
+// NewIMAPBackendWithOptions returns struct implementing go-imap/backend interface.
+// Anything not overridden by opts is taken from the settings.
+func NewIMAPBackendWithOptions(
+	eventListener listener.Listener,
+	setting *settings.Settings,
+	users *users.Users,
+	opts ...Option,
+) *imapBackend { //nolint[golint]
+	backend := newIMAPBackend(eventListener, setting, users, opts...)
+
+	backend.startDisconnectionMonitor()
+
+	return backend
+}
 
-	imapWorkers := setting.GetInt(settings.IMAPWorkers)
+// NewIMAPBackendChecked is like NewIMAPBackendWithOptions but it also makes sure
+// the cache file name is valid and the cache directory is set, exists and is writable,
+// so that cache failures surface at startup instead of on the first save.
+func NewIMAPBackendChecked(
+	eventListener listener.Listener,
+	setting *settings.Settings,
+	users *users.Users,
+	opts ...Option,
+) (*imapBackend, error) { //nolint[golint]
+	if _, err := imapCacheFilePath(setting.Get(settings.CacheDir), setting.Get(settings.IMAPCacheFile)); err != nil {
+		return nil, err
+	}
+
+	if _, err := ParseSpecialUse(setting.Get(settings.IMAPSpecialUse)); err != nil {
+		return nil, err
+	}
+
+	backend := newIMAPBackend(eventListener, setting, users, opts...)
+
+	if backend.ipAllowlistErr != nil {
+		return nil, backend.ipAllowlistErr
+	}
+
+	if !backend.isCacheInMemory() && !backend.imapCacheReadOnly {
+		if err := ensureWritableDir(filepath.Dir(backend.imapCachePath)); err != nil {
+			return nil, err
+		}
+	}
+
+	backend.startDisconnectionMonitor()
+
+	return backend, nil
+}
+
+func newIMAPBackend(
+	eventListener listener.Listener,
+	setting *settings.Settings,
+	users *users.Users,
+	opts ...Option,
+) *imapBackend {
+	imapWorkers := imapWorkerCount(setting.GetInt(settings.IMAPWorkers))
+	if setting.GetBool(settings.SafeMode) {
+		imapWorkers = 1
+	}
 	cacheDir := setting.Get(settings.CacheDir)
 
+	cachePath, err := imapCacheFilePath(cacheDir, setting.Get(settings.IMAPCacheFile))
+	switch {
+	case errors.Is(err, ErrEmptyCacheDir):
+		log.WithError(err).Error("Keeping the IMAP cache in memory only")
+		cachePath = ""
+	case err != nil:
+		log.WithError(err).Warn("Using the default IMAP cache file")
+		cachePath = filepath.Join(cacheDir, defaultIMAPCacheFile)
+	}
+
 	backend := &imapBackend{
+		setting:       setting,
 		usersMgr:      users,
 		updates:       newIMAPUpdates(),
 		eventListener: eventListener,
@@ -82,67 +245,276 @@ func NewIMAPBackend(
 		users:       map[string]*imapUser{},
 		usersLocker: &sync.Mutex{},
 
-		imapCachePath: filepath.Join(cacheDir, "imap_backend_cache.json"),
-		imapCacheLock: &sync.RWMutex{},
-		listWorkers:   imapWorkers,
+		imapCachePath:     cachePath,
+		imapCacheLock:     &sync.RWMutex{},
+		imapCacheReadOnly: setting.GetBool(settings.IMAPCacheReadOnly),
+		listWorkers:       imapWorkers,
+
+		bccSelf:          setting.GetBool(settings.BCCSelf),
+		isAllMailVisible: setting.GetBool(settings.IsAllMailVisible),
+		clock:            clock.Real,
+		slowOpThreshold:  slowOpThresholdFromMilliseconds(setting.GetInt(settings.IMAPSlowOpThreshold)),
+
+		maxUsernameLength: setting.GetInt(settings.IMAPMaxUsernameLength),
+		stripPlusTag:      setting.GetBool(settings.IMAPStripPlusTag),
+
+		maxConnectionsPerAddress: setting.GetInt(settings.IMAPMaxConnectionsPerAddress),
+		maxConnections:           setting.GetInt(settings.IMAPMaxConnections),
+		connections:              map[string]int{},
+	}
+
+	backend.lifetime, backend.closeLifetime = context.WithCancel(context.Background())
 
-		bccSelf:          bccSelf,
-		isAllMailVisible: isAllMailVisible,
+	if backend.specialUse, err = ParseSpecialUse(setting.Get(settings.IMAPSpecialUse)); err != nil {
+		log.WithError(err).Warn("Using the default special-use mapping")
+		backend.specialUse = defaultSpecialUse()
 	}
 
-	go backend.monitorDisconnectedUsers()
+	backend.updates.setSubscribedOnly(setting.GetBool(settings.IMAPUpdatesSubscribedOnly))
+
+	backend.ipAllowlist, backend.ipAllowlistErr = ParseIPAllowlist(setting.Get(settings.IMAPAllowedNetworks))
+	if backend.ipAllowlistErr != nil {
+		log.WithError(backend.ipAllowlistErr).Error("Rejecting all IMAP logins")
+	}
+
+	for _, opt := range opts {
+		opt(backend)
+	}
 
 	return backend
 }
 
-func (ib *imapBackend) getUser(address, slot, password string) (*imapUser, error) {
-	ib.usersLocker.Lock()
-	defer ib.usersLocker.Unlock()
+// Bounds of the worker count picked when settings.IMAPWorkers is 0 (auto).
+const (
+	minAutoIMAPWorkers = 4
+	maxAutoIMAPWorkers = 32
+)
+
+// imapWorkerCount resolves the configured number of IMAP workers. 0 means
+// auto, i.e. one worker per CPU kept within [minAutoIMAPWorkers,
+// maxAutoIMAPWorkers]. Negative values are invalid and fall back to auto.
+func imapWorkerCount(workers int) int {
+	if workers > 0 {
+		return workers
+	}
+
+	if workers < 0 {
+		log.WithField("workers", workers).Warn("Invalid number of IMAP workers, using auto")
+	}
+
+	workers = runtime.NumCPU()
+	if workers < minAutoIMAPWorkers {
+		workers = minAutoIMAPWorkers
+	}
+	if workers > maxAutoIMAPWorkers {
+		workers = maxAutoIMAPWorkers
+	}
+
+	return workers
+}
+
+// ensureWritableDir creates dir if needed and checks that files can be created in it.
+func ensureWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("cannot create cache directory: %w", err)
+	}
+
+	f, err := ioutil.TempFile(dir, ".write_test")
+	if err != nil {
+		return fmt.Errorf("cache directory is not writable: %w", err)
+	}
+
+	_ = f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// userCreation is a createUser call in flight. Concurrent logins of the same
+// address wait for it instead of creating the user again.
+type userCreation struct {
+	done chan struct{}
+	user *imapUser
+	err  error
+}
+
+func (ib *imapBackend) getUser(ctx context.Context, address, slot, password string) (*imapUser, error) {
+	address = normalizeAddress(address)
+
+	return ib.getOrCreateUser(ctx, address, func() (*imapUser, error) {
+		return ib.createUser(ctx, address, slot, password)
+	})
+}
 
-	address = strings.ToLower(address)
-	imapUser, ok := ib.users[address]
-	if ok {
-		return imapUser, nil
+// getOrCreateUser returns the loaded user of address or calls create.
+// Only one create runs per address at a time and logins of the address which
+// come in meanwhile share its result; creations for different addresses run
+// in parallel. When the shared creation fails, e.g. because of the password
+// of the other login, the waiting login tries to create the user itself.
+func (ib *imapBackend) getOrCreateUser(ctx context.Context, address string, create func() (*imapUser, error)) (*imapUser, error) {
+	for {
+		ib.usersLocker.Lock()
+		if imapUser, ok := ib.users[address]; ok {
+			ib.usersLocker.Unlock()
+			return imapUser, nil
+		}
+
+		creation, inFlight := ib.userCreations[address]
+		if !inFlight {
+			if ib.userCreations == nil {
+				ib.userCreations = map[string]*userCreation{}
+			}
+			creation = &userCreation{done: make(chan struct{})}
+			ib.userCreations[address] = creation
+		}
+		ib.usersLocker.Unlock()
+
+		if !inFlight {
+			creation.user, creation.err = create()
+
+			ib.usersLocker.Lock()
+			delete(ib.userCreations, address)
+			ib.usersLocker.Unlock()
+
+			close(creation.done)
+
+			return creation.user, creation.err
+		}
+
+		select {
+		case <-creation.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if creation.err == nil {
+			return creation.user, nil
+		}
 	}
-	return ib.createUser(address, slot, password)
 }
 
-// createUser require that address MUST be in lowercase.
-func (ib *imapBackend) createUser(address, slot, password string) (*imapUser, error) {
+// createUser require that address MUST be normalized by normalizeAddress.
+// It is called without holding usersLocker, see getOrCreateUser.
+func (ib *imapBackend) createUser(ctx context.Context, address, slot, password string) (*imapUser, error) {
 	log.WithField("address", address).Debug("Creating new IMAP user")
+	defer ib.timeOp("createUser", logrus.Fields{"address": address})()
 
 	user, err := ib.usersMgr.GetUser(address)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := user.BringOnline(slot, password); err != nil {
-		return nil, err
+	var newUser *imapUser
+
+	err = withOnlineUser(ctx, user, slot, password, func() error {
+		// Make sure you return the same user for all valid addresses when in combined mode.
+		// The user is stored under the primary address and under the login
+		// address, so later logins and disconnections of either find it.
+		primaryAddress, err := primaryAddressKey(user)
+		if err != nil {
+			return err
+		}
+		ib.usersLocker.Lock()
+		combinedUser, ok := ib.users[primaryAddress]
+		if ok {
+			ib.users[address] = combinedUser
+		}
+		ib.usersLocker.Unlock()
+		if ok {
+			newUser = combinedUser
+			return nil
+		}
+
+		// Client can log in only using address so we can properly close all IMAP connections.
+		var addressID string
+		if addressID, err = user.GetAddressID(primaryAddress); err != nil {
+			return err
+		}
+
+		if newUser, err = newIMAPUser(ib, user, addressID, primaryAddress); err != nil {
+			return err
+		}
+
+		newUser = ib.addUser(address, newUser)
+
+		return nil
+	})
+
+	return newUser, err
+}
+
+// addUser stores newUser in the users map under its primary address and
+// under loginAddress. Another address of a combined-mode user may have been
+// logged in meanwhile; the already stored user is kept and returned then.
+func (ib *imapBackend) addUser(loginAddress string, newUser *imapUser) *imapUser {
+	ib.usersLocker.Lock()
+	defer ib.usersLocker.Unlock()
+
+	if combinedUser, ok := ib.users[newUser.currentAddressLowercase]; ok {
+		newUser = combinedUser
+	} else {
+		ib.users[newUser.currentAddressLowercase] = newUser
 	}
+	ib.users[loginAddress] = newUser
 
-	// Make sure you return the same user for all valid addresses when in combined mode.
-	address = strings.ToLower(user.GetPrimaryAddress())
-	if combinedUser, ok := ib.users[address]; ok {
-		return combinedUser, nil
+	return newUser
+}
+
+// bccSelfFor returns whether self-BCC is enabled for the address. A per-address
+// override in the settings takes precedence over the backend-wide value.
+func (ib *imapBackend) bccSelfFor(address string) bool {
+	if ib.setting != nil {
+		if value := ib.setting.Get(settings.BCCSelfAddressKey(normalizeAddress(address))); value != "" {
+			return value == "true"
+		}
 	}
+	return ib.bccSelf
+}
 
-	// Client can log in only using address so we can properly close all IMAP connections.
-	var addressID string
-	if addressID, err = user.GetAddressID(address); err != nil {
-		return nil, err
+type onlineUser interface {
+	IsOnline() bool
+	BringOnlineCtx(ctx context.Context, slot, password string) error
+	BringOffline() error
+}
+
+// withOnlineUser brings the user online and runs fn. If fn fails and the user
+// was not online before, the user is brought offline again so that a failed
+// login does not leave a running store behind.
+func withOnlineUser(ctx context.Context, user onlineUser, slot, password string, fn func() error) error {
+	wasOnline := user.IsOnline()
+
+	if err := user.BringOnlineCtx(ctx, slot, password); err != nil {
+		return err
 	}
 
-	newUser, err := newIMAPUser(ib, user, addressID, address)
-	if err != nil {
-		return nil, err
+	if err := fn(); err != nil {
+		if !wasOnline {
+			if offlineErr := user.BringOffline(); offlineErr != nil {
+				log.WithError(offlineErr).Warn("Could not bring user offline")
+			}
+		}
+		return err
 	}
 
-	ib.users[address] = newUser
+	return nil
+}
+
+// primaryAddressKey returns the lowercase primary address under which the user
+// is stored in the users map. A half-initialized user may not have any address;
+// it must not be stored under the empty key where it would collide with others.
+func primaryAddressKey(user interface {
+	ID() string
+	GetPrimaryAddress() string
+}) (string, error) {
+	address := normalizeAddress(user.GetPrimaryAddress())
+	if address == "" {
+		return "", fmt.Errorf("%w: user %s", ErrNoPrimaryAddress, user.ID())
+	}
 
-	return newUser, nil
+	return address, nil
 }
 
-// deleteUser removes a user from the users map.
+// deleteUser removes the user stored under address from the users map,
+// including the entries of all other addresses of the user.
 // This is a safe operation even if the user doesn't exist so it is no problem if it is done twice.
 func (ib *imapBackend) deleteUser(address string) {
 	log.WithField("address", address).Debug("Deleting IMAP user")
@@ -150,40 +522,245 @@ func (ib *imapBackend) deleteUser(address string) {
 	ib.usersLocker.Lock()
 	defer ib.usersLocker.Unlock()
 
-	delete(ib.users, strings.ToLower(address))
+	imapUser, ok := ib.users[normalizeAddress(address)]
+	if !ok {
+		return
+	}
+
+	for key, other := range ib.users {
+		if other == imapUser {
+			delete(ib.users, key)
+		}
+	}
+}
+
+// isPrimaryEntry returns whether address is the key under which imapUser is
+// primarily stored in the users map, as opposed to another login address of
+// the same combined-mode user.
+func isPrimaryEntry(address string, imapUser *imapUser) bool {
+	return address == imapUser.currentAddressLowercase
+}
+
+// ActiveUserInfo describes a loaded IMAP user.
+type ActiveUserInfo struct {
+	Address   string
+	UserID    string
+	CreatedAt time.Time
+
+	// Slot is the key slot used by the most recent login of the user.
+	Slot string
+}
+
+// ActiveUsers returns a snapshot of the currently loaded IMAP users.
+func (ib *imapBackend) ActiveUsers() []ActiveUserInfo {
+	ib.usersLocker.Lock()
+	defer ib.usersLocker.Unlock()
+
+	infos := make([]ActiveUserInfo, 0, len(ib.users))
+	for address, imapUser := range ib.users {
+		if !isPrimaryEntry(address, imapUser) {
+			continue
+		}
+		infos = append(infos, ActiveUserInfo{
+			Address:   address,
+			UserID:    imapUser.userID,
+			CreatedAt: imapUser.createdAt,
+			Slot:      imapUser.slot,
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Address < infos[j].Address })
+
+	return infos
 }
 
 // Login authenticates a user.
-func (ib *imapBackend) Login(_ *imap.ConnInfo, username, password string) (goIMAPBackend.User, error) {
+// The login is split into a lowercase address and a case-preserving slot by
+// normalizeLogin. Surrounding whitespace is stripped from the password; an empty
+// password is rejected before any credentials are checked.
+// Failures caused by a wrong password, a logged out account or an unreachable
+// API are returned as *users.LoginError.
+func (ib *imapBackend) Login(conn *imap.ConnInfo, username, password string) (goIMAPBackend.User, error) {
+	if err := ib.checkClientAllowed(conn); err != nil {
+		log.WithError(err).WithField("remote", remoteIP(conn)).Warn("Invalid login: client not allowed")
+		ib.countLogin(err)
+		return nil, err
+	}
+
+	// Reject oversized input before it is parsed or logged.
+	if ib.maxUsernameLength > 0 && len(username) > ib.maxUsernameLength {
+		log.WithField("length", len(username)).Warn("Invalid login: username is too long")
+		ib.countLogin(ErrUsernameTooLong)
+		return nil, ErrUsernameTooLong
+	}
 
-	username, slot := users.DecodeLogin(username)
+	defer ib.timeOp("login", logrus.Fields{"username": username})()
+
+	// go-imap does not give us a context tied to the connection; the login
+	// is canceled when the backend is closed or the address disconnected.
+	user, err := ib.login(ib.lifetimeContext(), conn, username, password)
+	ib.countLogin(err)
+
+	return user, err
+}
+
+// SetLoginsEnabled switches new logins on or off, e.g. for a maintenance window.
+// Sessions which are already logged in are not affected. Logins are enabled by default.
+func (ib *imapBackend) SetLoginsEnabled(enabled bool) {
+	var disabled int32
+	if !enabled {
+		disabled = 1
+	}
+
+	atomic.StoreInt32(&ib.loginsDisabled, disabled)
+}
 
-	imapUser, err := ib.getUser(username, slot, password)
+func (ib *imapBackend) login(ctx context.Context, conn *imap.ConnInfo, username, password string) (goIMAPBackend.User, error) {
+	if atomic.LoadInt32(&ib.loginsDisabled) != 0 {
+		return nil, ErrLoginsDisabled
+	}
+
+	username, slot, password, err := normalizeLogin(username, password)
 	if err != nil {
-		log.WithError(err).Warn("Cannot get user")
+		log.WithError(err).Warn("Invalid login")
+		return nil, err
+	}
+
+	username = ib.resolveLoginAddress(username)
+
+	ctx, done := ib.loginContext(ctx, username)
+	defer done()
+
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	if err := imapUser.user.CheckCredentials(slot, password); err != nil {
+	imapUser, err := ib.getUser(ctx, username, slot, password)
+	if err != nil {
+		log.WithError(err).Warn("Cannot get user")
+		return nil, users.ClassifyLoginError(err)
+	}
+
+	if err := imapUser.user.CheckCredentials(slot, password, credentials.ScopeIMAP); err != nil {
 		log.WithError(err).Errorf("Could not check bridge password: %s %s", username, slot)
-		if err := imapUser.Logout(); err != nil {
-			log.WithError(err).Warn("Could not logout user after unsuccessful login check")
-		}
+		// Not imapUser.Logout: this login never acquired a connection to release.
+		ib.deleteUser(imapUser.currentAddressLowercase)
 		// Apple Mail sometimes generates a lot of requests very quickly.
 		// It's therefore good to have a timeout after a bad login so that we can slow
 		// those requests down a little bit.
-		time.Sleep(10 * time.Second)
+		ib.clock.Sleep(badLoginDelay)
+		return nil, users.ClassifyLoginError(err)
+	}
+
+	if err := ib.acquireConnection(imapUser.currentAddressLowercase); err != nil {
 		return nil, err
 	}
 
+	ib.setLoginSlot(imapUser, slot)
+
 	// The update channel should be nil until we try to login to IMAP for the first time
 	// so that it doesn't make bridge slow for users who are only using bridge for SMTP
 	// (otherwise the store will be locked for 1 sec per email during synchronization).
 	if store := imapUser.user.GetStore(); store != nil {
-		store.SetChangeNotifier(ib.updates)
+		ib.attachChangeNotifier(imapUser.userID, imapUser.currentAddressLowercase, store)
+	}
+
+	imapUser.trackSubscriptions()
+
+	session := ib.newSession(imapUser, slot, conn)
+
+	ib.reportLoginWarning(imapUser.currentAddressLowercase, imapUser.user.LoginWarning(ib.clock.Now()))
+
+	return session, nil
+}
+
+// reportLoginWarning logs and emits the caveat of a successful login, if any.
+func (ib *imapBackend) reportLoginWarning(address, warning string) {
+	if warning == "" {
+		return
+	}
+
+	log.WithField("address", address).WithField("warning", warning).Warn("Login succeeded with a warning")
+
+	ib.eventListener.Emit(events.LoginWarningEvent, address+": "+warning)
+}
+
+// setLoginSlot records the key slot used to log in as imapUser.
+func (ib *imapBackend) setLoginSlot(imapUser *imapUser, slot string) {
+	ib.usersLocker.Lock()
+	defer ib.usersLocker.Unlock()
+
+	imapUser.slot = slot
+}
+
+// normalizeAddress returns the form of address used to key users and
+// connections, see users.NormalizeAddress. Non-ASCII characters of the local
+// part or the domain are lowercased as well and punycode domains are decoded.
+func normalizeAddress(address string) string {
+	return users.NormalizeAddress(address)
+}
+
+// VerifyCredentials checks the slot password of the address the same way
+// Login does, but without creating an IMAP user, bringing the user online or
+// taking a connection, e.g. to test a login from the command line.
+func (ib *imapBackend) VerifyCredentials(address, slot, password string) error {
+	if password = strings.TrimSpace(password); password == "" {
+		return users.ErrEmptyPassword
+	}
+
+	user, err := ib.usersMgr.GetUser(ib.resolveLoginAddress(normalizeAddress(address)))
+	if err != nil {
+		return users.ClassifyLoginError(err)
+	}
+
+	return users.ClassifyLoginError(user.CheckCredentials(slot, password, credentials.ScopeIMAP))
+}
+
+// resolveLoginAddress returns the address a normalized login address is
+// resolved as. With plus tag stripping enabled the tag is dropped, so that
+// user+tag@domain logs in as user@domain; the original address is logged.
+func (ib *imapBackend) resolveLoginAddress(address string) string {
+	if !ib.stripPlusTag {
+		return address
+	}
+
+	stripped := stripPlusTag(address)
+	if stripped != address {
+		log.WithField("login", address).WithField("address", stripped).Debug("Stripped plus tag from login")
+	}
+
+	return stripped
+}
+
+// stripPlusTag removes the "+tag" suffix of the local part of address.
+// Addresses without a tag or with nothing before the "+" are returned as they are.
+func stripPlusTag(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return address
+	}
+
+	plus := strings.Index(address[:at], "+")
+	if plus <= 0 {
+		return address
 	}
 
-	return imapUser, nil
+	return address[:plus] + address[at:]
+}
+
+// normalizeLogin splits the login into username and slot and validates the password.
+// The username is an address and is lowercased; the slot is case-sensitive and
+// keeps its casing. Key slot passwords are base64 encoded so surrounding
+// whitespace is never part of them.
+func normalizeLogin(login, password string) (username, slot, pass string, err error) {
+	username, slot = users.DecodeLogin(login)
+	username = normalizeAddress(username)
+
+	if pass = strings.TrimSpace(password); pass == "" {
+		return "", "", "", users.ErrEmptyPassword
+	}
+
+	return username, slot, pass, nil
 }
 
 // Updates returns a channel of updates for IMAP IDLE extension.
@@ -200,9 +777,54 @@ func (ib *imapBackend) monitorDisconnectedUsers() {
 	ch := make(chan string)
 	ib.eventListener.Add(events.CloseConnectionEvent, ch)
 
+	ib.processDisconnections(ch)
+}
+
+// processDisconnections handles the disconnected addresses received from ch until it is closed.
+func (ib *imapBackend) processDisconnections(ch <-chan string) {
 	for address := range ch {
+		ib.cancelLogins(address)
+		ib.pruneCacheIfRemoved(address)
+
 		// delete the user to ensure future imap login attempts use the latest bridge user
 		// (bridge user might be removed-readded so we want to use the new bridge user object).
 		ib.deleteUser(address)
+		ib.resetConnections(address)
+		ib.resetChangeNotifier(address)
+		ib.resetSessions(address)
 	}
 }
+
+// pruneCacheIfRemoved drops the cached items of the user logged in as `address`
+// once the user has been removed from the users manager. A plain logout keeps them.
+func (ib *imapBackend) pruneCacheIfRemoved(address string) {
+	if ib.usersMgr == nil {
+		return
+	}
+
+	ib.usersLocker.Lock()
+	imapUser, ok := ib.users[normalizeAddress(address)]
+	ib.usersLocker.Unlock()
+
+	if !ok {
+		return
+	}
+
+	// Users.DeleteUser emits the close connection event while holding its lock,
+	// so this lookup sees the user only after it is gone.
+	if _, err := ib.usersMgr.GetUser(imapUser.userID); err == nil {
+		return
+	}
+
+	ib.PruneCacheForUser(imapUser.userID)
+}
+
+// startDisconnectionMonitor runs monitorDisconnectedUsers in the background
+// unless the backend was configured with WithoutDisconnectionMonitor.
+func (ib *imapBackend) startDisconnectionMonitor() {
+	if ib.noDisconnectionMonitor {
+		return
+	}
+
+	go ib.monitorDisconnectedUsers()
+}
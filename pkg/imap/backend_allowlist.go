@@ -0,0 +1,100 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+var (
+	// ErrClientNotAllowed is returned by Login for clients outside of the IP allowlist.
+	ErrClientNotAllowed = errors.New("client address is not allowed")
+
+	// ErrInvalidIPAllowlist is returned for allowlist entries which are not valid CIDRs.
+	ErrInvalidIPAllowlist = errors.New("invalid IP allowlist")
+)
+
+// ParseIPAllowlist parses a comma-separated list of CIDRs, e.g. "10.0.0.0/8, ::1/128".
+// An empty value gives an empty allowlist, which allows all clients.
+func ParseIPAllowlist(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q is not a CIDR", ErrInvalidIPAllowlist, entry)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// checkClientAllowed returns ErrClientNotAllowed unless the remote address of
+// the connection is within the allowlist. A broken allowlist rejects everyone
+// so that a typo in the config does not open up a locked-down deployment.
+func (ib *imapBackend) checkClientAllowed(conn *imap.ConnInfo) error {
+	if ib.ipAllowlistErr != nil {
+		return ib.ipAllowlistErr
+	}
+
+	if len(ib.ipAllowlist) == 0 {
+		return nil
+	}
+
+	ip := remoteIP(conn)
+	if ip == nil {
+		return ErrClientNotAllowed
+	}
+
+	for _, network := range ib.ipAllowlist {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+
+	return ErrClientNotAllowed
+}
+
+func remoteIP(conn *imap.ConnInfo) net.IP {
+	if conn == nil || conn.RemoteAddr == nil {
+		return nil
+	}
+
+	if addr, ok := conn.RemoteAddr.(*net.TCPAddr); ok {
+		return addr.IP
+	}
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr.String())
+	if err != nil {
+		host = conn.RemoteAddr.String()
+	}
+
+	return net.ParseIP(host)
+}
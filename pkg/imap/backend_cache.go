@@ -20,8 +20,14 @@ package imap
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+
+	"github.com/ljanyst/peroxide/pkg/events"
 )
 
 // Cache keys.
@@ -29,6 +35,42 @@ const (
 	SubscriptionException = "subscription_exceptions"
 )
 
+// imapCacheVersion is the version of the on-disk cache format written by saveIMAPCache.
+// Version 0 is the original format: the bare map of users without any envelope.
+const imapCacheVersion = 1
+
+// imapCacheFile is the on-disk format of the IMAP backend cache.
+type imapCacheFile struct {
+	Version int                          `json:"version"`
+	Users   map[string]map[string]string `json:"users"`
+}
+
+// defaultIMAPCacheFile is used when settings.IMAPCacheFile is not a valid file name.
+const defaultIMAPCacheFile = "imap_backend_cache.json"
+
+var (
+	// ErrInvalidCacheFile is returned when the configured cache file name is a path.
+	ErrInvalidCacheFile = errors.New("invalid IMAP cache file name")
+
+	// ErrEmptyCacheDir is returned when no cache directory is configured.
+	ErrEmptyCacheDir = errors.New("cache directory is not set")
+)
+
+// imapCacheFilePath joins the cache directory with the configured cache file name.
+// The name must be a plain file name so that it cannot point outside cacheDir.
+// An empty cacheDir is rejected rather than resolved against the working directory.
+func imapCacheFilePath(cacheDir, name string) (string, error) {
+	if cacheDir == "" {
+		return "", ErrEmptyCacheDir
+	}
+
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidCacheFile, name)
+	}
+
+	return filepath.Join(cacheDir, name), nil
+}
+
 // addToCache adds item to existing item list.
 // Starting from following structure:
 //   {
@@ -88,13 +130,14 @@ func (ib *imapBackend) getCacheList(userID, label string) (list string) {
 		ib.imapCache = map[string]map[string]string{}
 	}
 
+	list, hit := ib.imapCache[userID][label]
+	ib.countCacheLookup(hit)
+
 	if ib.imapCache[userID] == nil {
 		ib.imapCache[userID] = map[string]string{}
 		ib.imapCache[userID][SubscriptionException] = ""
 	}
 
-	list = ib.imapCache[userID][label]
-
 	ib.imapCacheLock.Unlock()
 
 	if err := ib.saveIMAPCache(); err != nil {
@@ -103,21 +146,132 @@ func (ib *imapBackend) getCacheList(userID, label string) (list string) {
 	return
 }
 
+// PruneCacheForUser removes all cached items of the user with `userID`.
+func (ib *imapBackend) PruneCacheForUser(userID string) {
+	if err := ib.loadIMAPCache(); err != nil {
+		log.WithError(err).Warn("Could not load cache")
+	}
+
+	ib.imapCacheLock.Lock()
+	_, ok := ib.imapCache[userID]
+	delete(ib.imapCache, userID)
+	ib.imapCacheLock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if err := ib.saveIMAPCache(); err != nil {
+		log.WithError(err).Warn("Could not save cache")
+	}
+}
+
+// RebuildCache drops all cached items and removes the cache file, e.g. when
+// the file is suspected to be stale or corrupt. The items of the users are
+// created again from scratch as they are used. A CacheRebuiltEvent carrying
+// the cache path is emitted once done. A read-only cache keeps the file.
+func (ib *imapBackend) RebuildCache() error {
+	ib.imapCacheLock.Lock()
+	defer ib.imapCacheLock.Unlock()
+
+	ib.imapCache = map[string]map[string]string{}
+
+	if !ib.isCacheInMemory() && !ib.imapCacheReadOnly {
+		if err := os.Remove(ib.imapCachePath); err != nil && !os.IsNotExist(err) {
+			ib.emitCacheError(err)
+			return err
+		}
+	}
+
+	log.WithField("path", ib.imapCachePath).Info("IMAP cache rebuilt")
+
+	if ib.eventListener != nil {
+		ib.eventListener.Emit(events.CacheRebuiltEvent, ib.imapCachePath)
+	}
+
+	return nil
+}
+
+// CacheKeys returns the sorted IDs of the users having cached items.
+func (ib *imapBackend) CacheKeys() []string {
+	if err := ib.loadIMAPCache(); err != nil {
+		log.WithError(err).Warn("Could not load cache")
+	}
+
+	ib.imapCacheLock.RLock()
+	defer ib.imapCacheLock.RUnlock()
+
+	keys := make([]string, 0, len(ib.imapCache))
+	for userID := range ib.imapCache {
+		keys = append(keys, userID)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
 func (ib *imapBackend) loadIMAPCache() error {
-	if ib.imapCache != nil {
+	if ib.imapCache != nil || ib.isCacheInMemory() {
 		return nil
 	}
 
 	ib.imapCacheLock.Lock()
 	defer ib.imapCacheLock.Unlock()
 
-	f, err := os.Open(ib.imapCachePath)
+	data, err := ioutil.ReadFile(ib.imapCachePath)
 	if err != nil {
+		// A missing cache file is expected on the first run.
+		if !os.IsNotExist(err) {
+			ib.emitCacheError(err)
+		}
+		return err
+	}
+
+	cache, err := decodeIMAPCache(data)
+	if err != nil {
+		// The cache only holds subscription exceptions; starting over beats
+		// failing on every access.
+		log.WithError(err).Warn("Could not decode IMAP cache, rebuilding it")
+		ib.emitCacheError(err)
+		ib.imapCache = map[string]map[string]string{}
 		return err
 	}
-	defer f.Close() //nolint:errcheck,gosec
 
-	return json.NewDecoder(f).Decode(&ib.imapCache)
+	ib.imapCache = cache
+
+	return nil
+}
+
+// decodeIMAPCache decodes any known version of the cache file. Files written by
+// an unknown, presumably newer, version yield an empty cache.
+func decodeIMAPCache(data []byte) (map[string]map[string]string, error) {
+	var file imapCacheFile
+	if err := json.Unmarshal(data, &file); err == nil {
+		switch {
+		case file.Version == imapCacheVersion:
+			if file.Users == nil {
+				file.Users = map[string]map[string]string{}
+			}
+			return file.Users, nil
+
+		case file.Version != 0:
+			log.WithField("version", file.Version).Warn("Unknown IMAP cache version, rebuilding it")
+			return map[string]map[string]string{}, nil
+		}
+	}
+
+	var users map[string]map[string]string
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, err
+	}
+
+	log.Info("Migrating IMAP cache to version ", imapCacheVersion)
+
+	if users == nil {
+		users = map[string]map[string]string{}
+	}
+
+	return users, nil
 }
 
 func (ib *imapBackend) saveIMAPCache() error {
@@ -125,14 +279,72 @@ func (ib *imapBackend) saveIMAPCache() error {
 		return errors.New("cannot save cache: cache is nil")
 	}
 
+	if ib.isCacheInMemory() || ib.imapCacheReadOnly {
+		return nil
+	}
+
+	ib.imapCacheLock.Lock()
+	defer ib.imapCacheLock.Unlock()
+
+	return ib.writeIMAPCache(false)
+}
+
+// FlushCache synchronously writes the cache to disk and syncs the file, so
+// that nothing is lost when the process exits right afterwards. It is meant
+// to be called from a signal handler before exiting.
+func (ib *imapBackend) FlushCache() error {
+	if ib.isCacheInMemory() || ib.imapCacheReadOnly {
+		return nil
+	}
+
 	ib.imapCacheLock.Lock()
 	defer ib.imapCacheLock.Unlock()
 
+	if ib.imapCache == nil {
+		return nil
+	}
+
+	return ib.writeIMAPCache(true)
+}
+
+// writeIMAPCache writes the cache file; imapCacheLock must be held.
+// encoding/json writes map keys sorted, so the same cache always produces
+// the same file.
+func (ib *imapBackend) writeIMAPCache(sync bool) error {
 	f, err := os.Create(ib.imapCachePath)
 	if err != nil {
+		ib.emitCacheError(err)
 		return err
 	}
-	defer f.Close() //nolint:errcheck,gosec
 
-	return json.NewEncoder(f).Encode(ib.imapCache)
+	err = json.NewEncoder(f).Encode(imapCacheFile{Version: imapCacheVersion, Users: ib.imapCache})
+	if err == nil && sync {
+		err = f.Sync()
+	}
+
+	// Close may report a failed write, so its error counts as well.
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		ib.emitCacheError(err)
+		return err
+	}
+
+	return nil
+}
+
+// isCacheInMemory returns whether the cache is never persisted to disk.
+func (ib *imapBackend) isCacheInMemory() bool {
+	return ib.imapCachePath == ""
+}
+
+// emitCacheError publishes a CacheErrorEvent carrying the cache path and the error.
+func (ib *imapBackend) emitCacheError(err error) {
+	if ib.eventListener == nil {
+		return
+	}
+
+	ib.eventListener.Emit(events.CacheErrorEvent, ib.imapCachePath+": "+err.Error())
 }
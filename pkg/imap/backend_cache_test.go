@@ -0,0 +1,276 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/events"
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheSaveFailureEmitsEvent(t *testing.T) {
+	// A regular file used as the parent directory makes the save fail even
+	// when the tests run as root.
+	parent := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, ioutil.WriteFile(parent, []byte{}, 0o600))
+
+	ib, ch := newTestCacheBackend(filepath.Join(parent, "imap_backend_cache.json"))
+	ib.imapCache = map[string]map[string]string{}
+
+	require.Error(t, ib.saveIMAPCache())
+
+	select {
+	case data := <-ch:
+		require.True(t, strings.HasPrefix(data, ib.imapCachePath+": "))
+	case <-time.After(time.Second):
+		require.Fail(t, "cache error event was not emitted")
+	}
+}
+
+func TestCacheLoadFailureEmitsEvent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "imap_backend_cache.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte("{\"user\": MISSING_QUOTES"), 0o600))
+
+	ib, ch := newTestCacheBackend(path)
+
+	require.Error(t, ib.loadIMAPCache())
+
+	select {
+	case data := <-ch:
+		require.True(t, strings.HasPrefix(data, path+": "))
+	case <-time.After(time.Second):
+		require.Fail(t, "cache error event was not emitted")
+	}
+}
+
+func TestCacheLoadMissingFileDoesNotEmitEvent(t *testing.T) {
+	ib, ch := newTestCacheBackend(filepath.Join(t.TempDir(), "imap_backend_cache.json"))
+
+	require.Error(t, ib.loadIMAPCache())
+
+	select {
+	case data := <-ch:
+		require.Fail(t, "unexpected cache error event", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCacheLoadCurrentVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "imap_backend_cache.json")
+	content := `{"version": 1, "users": {"user": {"subscription_exceptions": "Folder"}}}`
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0o600))
+
+	ib, _ := newTestCacheBackend(path)
+
+	require.NoError(t, ib.loadIMAPCache())
+	require.Equal(t, map[string]map[string]string{"user": {SubscriptionException: "Folder"}}, ib.imapCache)
+}
+
+func TestCacheLoadMigratesUnversionedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "imap_backend_cache.json")
+	content := `{"user": {"subscription_exceptions": "Folder"}}`
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0o600))
+
+	ib, _ := newTestCacheBackend(path)
+
+	require.NoError(t, ib.loadIMAPCache())
+	require.Equal(t, map[string]map[string]string{"user": {SubscriptionException: "Folder"}}, ib.imapCache)
+
+	// The next save writes the current version.
+	require.NoError(t, ib.saveIMAPCache())
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"version": 1, "users": {"user": {"subscription_exceptions": "Folder"}}}`, string(data))
+}
+
+func TestCacheLoadRebuildsUnknownVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "imap_backend_cache.json")
+	content := `{"version": 99, "users": {"user": {"subscription_exceptions": "Folder"}}}`
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0o600))
+
+	ib, _ := newTestCacheBackend(path)
+
+	require.NoError(t, ib.loadIMAPCache())
+	require.Empty(t, ib.imapCache)
+	require.NotNil(t, ib.imapCache)
+}
+
+func TestCacheLoadRebuildsGarbage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "imap_backend_cache.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte("\x00garbage"), 0o600))
+
+	ib, ch := newTestCacheBackend(path)
+	go func() { <-ch }()
+
+	require.Error(t, ib.loadIMAPCache())
+	require.Empty(t, ib.imapCache)
+	require.NotNil(t, ib.imapCache)
+}
+
+func newTestCacheBackend(path string) (*imapBackend, chan string) {
+	eventListener := listener.New()
+	ch := make(chan string)
+	eventListener.Add(events.CacheErrorEvent, ch)
+
+	return &imapBackend{
+		eventListener: eventListener,
+		imapCachePath: path,
+		imapCacheLock: &sync.RWMutex{},
+		usersLocker:   &sync.Mutex{},
+	}, ch
+}
+
+func TestPruneCacheForUser(t *testing.T) {
+	ib, _ := newTestCacheBackend(filepath.Join(t.TempDir(), "imap_backend_cache.json"))
+
+	ib.addToCache("user1", SubscriptionException, "Folder")
+	ib.addToCache("user2", SubscriptionException, "Folder")
+	require.Equal(t, []string{"user1", "user2"}, ib.CacheKeys())
+
+	ib.PruneCacheForUser("user1")
+	require.Equal(t, []string{"user2"}, ib.CacheKeys())
+
+	// The pruned cache is persisted.
+	reloaded, _ := newTestCacheBackend(ib.imapCachePath)
+	require.Equal(t, []string{"user2"}, reloaded.CacheKeys())
+
+	// Pruning an unknown user is a no-op.
+	ib.PruneCacheForUser("unknown")
+	require.Equal(t, []string{"user2"}, ib.CacheKeys())
+}
+
+func TestRebuildCache(t *testing.T) {
+	ib, _ := newTestCacheBackend(filepath.Join(t.TempDir(), "imap_backend_cache.json"))
+
+	rebuilt := make(chan string, 1)
+	ib.eventListener.Add(events.CacheRebuiltEvent, rebuilt)
+
+	ib.addToCache("user1", SubscriptionException, "Folder")
+	require.FileExists(t, ib.imapCachePath)
+
+	require.NoError(t, ib.RebuildCache())
+	require.Empty(t, ib.CacheKeys())
+	require.NoFileExists(t, ib.imapCachePath)
+
+	select {
+	case path := <-rebuilt:
+		require.Equal(t, ib.imapCachePath, path)
+	case <-time.After(time.Second):
+		require.Fail(t, "cache rebuilt event was not emitted")
+	}
+
+	// Rebuilding without a cache file is fine.
+	require.NoError(t, ib.RebuildCache())
+}
+
+func TestFlushCache(t *testing.T) {
+	ib, _ := newTestCacheBackend(filepath.Join(t.TempDir(), "imap_backend_cache.json"))
+	ib.imapCache = map[string]map[string]string{
+		"user1": {SubscriptionException: "Folder;Other"},
+		"user2": {SubscriptionException: ""},
+	}
+
+	require.NoError(t, ib.FlushCache())
+
+	reloaded, _ := newTestCacheBackend(ib.imapCachePath)
+	require.NoError(t, reloaded.loadIMAPCache())
+	require.Equal(t, ib.imapCache, reloaded.imapCache)
+}
+
+func TestFlushCacheWhileUpdating(t *testing.T) {
+	ib, _ := newTestCacheBackend(filepath.Join(t.TempDir(), "imap_backend_cache.json"))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ib.addToCache("user1", SubscriptionException, "Folder")
+	}()
+
+	require.NoError(t, ib.FlushCache())
+	wg.Wait()
+
+	require.NoError(t, ib.FlushCache())
+	reloaded, _ := newTestCacheBackend(ib.imapCachePath)
+	require.Equal(t, "Folder", reloaded.getCacheList("user1", SubscriptionException))
+}
+
+func TestReadOnlyCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "imap_backend_cache.json")
+	content := `{"version": 1, "users": {"user1": {"subscription_exceptions": "Folder"}}}`
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0o600))
+
+	ib, _ := newTestCacheBackend(path)
+	WithReadOnlyCache()(ib)
+
+	// The existing file is still loaded.
+	require.Equal(t, "Folder", ib.getCacheList("user1", SubscriptionException))
+
+	ib.addToCache("user1", SubscriptionException, "Other")
+	ib.removeFromCache("user1", SubscriptionException, "Folder")
+	ib.addToCache("user2", SubscriptionException, "Folder")
+	ib.PruneCacheForUser("user2")
+	require.Equal(t, "Other", ib.getCacheList("user1", SubscriptionException))
+	require.NoError(t, ib.FlushCache())
+	require.NoError(t, ib.RebuildCache())
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, content, string(data))
+}
+
+func TestCacheHitsAndMisses(t *testing.T) {
+	ib, _ := newTestCacheBackend(filepath.Join(t.TempDir(), "imap_backend_cache.json"))
+
+	require.Equal(t, "", ib.getCacheList("user1", SubscriptionException))
+	require.Equal(t, "", ib.getCacheList("user1", SubscriptionException))
+
+	stats := ib.Stats()
+	require.Equal(t, int64(1), stats.CacheMisses)
+	require.Equal(t, int64(1), stats.CacheHits)
+}
+
+func TestSaveIMAPCacheIsStable(t *testing.T) {
+	ib, _ := newTestCacheBackend(filepath.Join(t.TempDir(), "imap_backend_cache.json"))
+	ib.imapCache = map[string]map[string]string{
+		"user3": {SubscriptionException: "c", "b": "2", "a": "1"},
+		"user1": {SubscriptionException: "a"},
+		"user2": {"z": "", "y": ""},
+	}
+
+	require.NoError(t, ib.saveIMAPCache())
+	first, err := ioutil.ReadFile(ib.imapCachePath)
+	require.NoError(t, err)
+
+	require.NoError(t, ib.saveIMAPCache())
+	second, err := ioutil.ReadFile(ib.imapCachePath)
+	require.NoError(t, err)
+
+	require.Equal(t, first, second)
+	require.Equal(t,
+		`{"version":1,"users":{"user1":{"subscription_exceptions":"a"},"user2":{"y":"","z":""},"user3":{"a":"1","b":"2","subscription_exceptions":"c"}}}`+"\n",
+		string(first),
+	)
+}
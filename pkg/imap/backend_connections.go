@@ -0,0 +1,96 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import "errors"
+
+var (
+	// ErrTooManyConnections is returned when an address already has the maximum
+	// number of IMAP connections open.
+	ErrTooManyConnections = errors.New("too many IMAP connections for this address")
+
+	// ErrTooManyServerConnections is returned when the server already has the
+	// maximum number of IMAP connections open across all addresses.
+	ErrTooManyServerConnections = errors.New("too many IMAP connections on this server")
+)
+
+// acquireConnection registers a new connection for address unless the
+// per-address or the server-wide limit is reached. A limit of 0 means unlimited.
+func (ib *imapBackend) acquireConnection(address string) error {
+	address = normalizeAddress(address)
+
+	ib.connectionsLock.Lock()
+	defer ib.connectionsLock.Unlock()
+
+	if ib.maxConnections > 0 && ib.totalConnections >= ib.maxConnections {
+		log.WithField("address", address).
+			WithField("limit", ib.maxConnections).
+			Warn("Refusing IMAP login: too many connections on the server")
+		return ErrTooManyServerConnections
+	}
+
+	if ib.maxConnectionsPerAddress > 0 && ib.connections[address] >= ib.maxConnectionsPerAddress {
+		log.WithField("address", address).
+			WithField("limit", ib.maxConnectionsPerAddress).
+			Warn("Refusing IMAP login: too many connections")
+		return ErrTooManyConnections
+	}
+
+	if ib.connections == nil {
+		ib.connections = map[string]int{}
+	}
+
+	ib.connections[address]++
+	ib.totalConnections++
+
+	return nil
+}
+
+// releaseConnection unregisters one connection for address.
+func (ib *imapBackend) releaseConnection(address string) {
+	address = normalizeAddress(address)
+
+	ib.connectionsLock.Lock()
+	defer ib.connectionsLock.Unlock()
+
+	count, ok := ib.connections[address]
+	if !ok {
+		return
+	}
+
+	ib.totalConnections--
+
+	if count <= 1 {
+		delete(ib.connections, address)
+		return
+	}
+
+	ib.connections[address]--
+}
+
+// resetConnections forgets all connections for address, e.g. after they were
+// closed by a CloseConnectionEvent.
+func (ib *imapBackend) resetConnections(address string) {
+	ib.connectionsLock.Lock()
+	defer ib.connectionsLock.Unlock()
+
+	address = normalizeAddress(address)
+
+	ib.totalConnections -= ib.connections[address]
+	delete(ib.connections, address)
+}
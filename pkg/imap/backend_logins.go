@@ -0,0 +1,85 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import "context"
+
+// loginContext returns the context of a login of address derived from ctx.
+// It is done once the backend is closed or the connections of address are
+// closed by a CloseConnectionEvent, so that the login does not bring a user
+// online for nothing. The returned function releases the context.
+func (ib *imapBackend) loginContext(ctx context.Context, address string) (context.Context, func()) {
+	address = normalizeAddress(address)
+	ctx, cancel := context.WithCancel(ctx)
+
+	ib.loginsLock.Lock()
+	defer ib.loginsLock.Unlock()
+
+	if ib.logins == nil {
+		ib.logins = map[string]map[uint64]context.CancelFunc{}
+	}
+	if ib.logins[address] == nil {
+		ib.logins[address] = map[uint64]context.CancelFunc{}
+	}
+
+	id := ib.nextLoginID
+	ib.nextLoginID++
+	ib.logins[address][id] = cancel
+
+	return ctx, func() {
+		ib.loginsLock.Lock()
+		defer ib.loginsLock.Unlock()
+
+		delete(ib.logins[address], id)
+		if len(ib.logins[address]) == 0 {
+			delete(ib.logins, address)
+		}
+
+		cancel()
+	}
+}
+
+// cancelLogins cancels the logins of address which are in flight.
+func (ib *imapBackend) cancelLogins(address string) {
+	address = normalizeAddress(address)
+
+	ib.loginsLock.Lock()
+	defer ib.loginsLock.Unlock()
+
+	for _, cancel := range ib.logins[address] {
+		cancel()
+	}
+}
+
+// lifetimeContext returns the context which is done once the backend is closed.
+// Backends not created by newIMAPBackend, e.g. in tests, are never closed.
+func (ib *imapBackend) lifetimeContext() context.Context {
+	if ib.lifetime == nil {
+		return context.Background()
+	}
+
+	return ib.lifetime
+}
+
+// Close cancels the logins in flight and makes new logins fail.
+// It is called when the IMAP server is closed.
+func (ib *imapBackend) Close() {
+	if ib.closeLifetime != nil {
+		ib.closeLifetime()
+	}
+}
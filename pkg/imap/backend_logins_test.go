@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginContextCanceledOnDisconnection(t *testing.T) {
+	ib := newIMAPBackend(listener.New(), newTestSettings(t, t.TempDir()), nil, WithoutDisconnectionMonitor())
+
+	ctx, done := ib.loginContext(ib.lifetimeContext(), "user@pm.me")
+	defer done()
+	otherCtx, otherDone := ib.loginContext(ib.lifetimeContext(), "other@pm.me")
+	defer otherDone()
+
+	ch := make(chan string, 1)
+	ch <- "User@PM.me"
+	close(ch)
+	ib.processDisconnections(ch)
+
+	require.ErrorIs(t, ctx.Err(), context.Canceled)
+	require.NoError(t, otherCtx.Err())
+
+	// Released logins are forgotten.
+	done()
+	require.NotContains(t, ib.logins, "user@pm.me")
+}
+
+func TestLoginContextCanceledOnClose(t *testing.T) {
+	ib := newIMAPBackend(listener.New(), newTestSettings(t, t.TempDir()), nil, WithoutDisconnectionMonitor())
+
+	ctx, done := ib.loginContext(ib.lifetimeContext(), "user@pm.me")
+	defer done()
+
+	ib.Close()
+
+	require.ErrorIs(t, ctx.Err(), context.Canceled)
+
+	// Logins started after closing fail right away.
+	_, err := ib.Login(nil, "user@pm.me", "password")
+	require.ErrorIs(t, err, context.Canceled)
+}
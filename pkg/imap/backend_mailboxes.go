@@ -0,0 +1,156 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/store"
+	"github.com/ljanyst/peroxide/pkg/users"
+	"github.com/ljanyst/peroxide/pkg/users/credentials"
+)
+
+// MailboxInfo describes a mailbox as listed to IMAP clients.
+type MailboxInfo struct {
+	Name       string
+	Delimiter  string
+	Attributes []string
+}
+
+// listedMailbox is the part of store.Mailbox needed to describe it.
+type listedMailbox interface {
+	LabelID() string
+	Name() string
+	IsFolder() bool
+	IsSystem() bool
+	GetDelimiter() string
+}
+
+// ListMailboxes returns the mailboxes an IMAP client of the address would
+// list, e.g. for provisioning or diagnostics. The slot password is checked the
+// same way Login does, so disabled users are rejected. The user is loaded by
+// the backend like on a login; if it was not loaded before, it is unloaded
+// again afterwards.
+func (ib *imapBackend) ListMailboxes(address, slot, password string) ([]MailboxInfo, error) {
+	var infos []MailboxInfo
+	err := ib.withLoadedUser(address, slot, password, func(imapUser *imapUser) {
+		mailboxes := []listedMailbox{}
+		for _, storeMailbox := range imapUser.storeAddress.ListMailboxes() {
+			mailboxes = append(mailboxes, storeMailbox)
+		}
+
+		infos = ib.mailboxInfos(mailboxes)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return infos, nil
+}
+
+// withLoadedUser checks the credentials of the address the same way Login
+// does and calls fn with its IMAP user. A user loaded only for fn is removed
+// from the users again, unless an IMAP client connected as the address
+// meanwhile.
+func (ib *imapBackend) withLoadedUser(address, slot, password string, fn func(*imapUser)) error {
+	address = ib.resolveLoginAddress(normalizeAddress(address))
+
+	user, err := ib.usersMgr.GetUser(address)
+	if err != nil {
+		return users.ClassifyLoginError(err)
+	}
+
+	if err := user.CheckCredentials(slot, password, credentials.ScopeIMAP); err != nil {
+		return users.ClassifyLoginError(err)
+	}
+
+	ib.usersLocker.Lock()
+	_, wasLoaded := ib.users[address]
+	ib.usersLocker.Unlock()
+
+	ctx, done := ib.loginContext(ib.lifetimeContext(), address)
+	defer done()
+
+	imapUser, err := ib.getUser(ctx, address, slot, password)
+	if err != nil {
+		return users.ClassifyLoginError(err)
+	}
+
+	if !wasLoaded {
+		defer ib.unloadUnusedUser(address)
+	}
+
+	fn(imapUser)
+
+	return nil
+}
+
+// unloadUnusedUser removes the user of address from the users unless an IMAP
+// client is connected as the address.
+func (ib *imapBackend) unloadUnusedUser(address string) {
+	ib.connectionsLock.Lock()
+	inUse := ib.connections[address] > 0
+	ib.connectionsLock.Unlock()
+
+	if inUse {
+		return
+	}
+
+	ib.deleteUser(address)
+	ib.resetChangeNotifier(address)
+}
+
+// mailboxInfos describes the mailboxes the same way as imapUser.ListMailboxes
+// lists them, including the roots of folders and labels.
+func (ib *imapBackend) mailboxInfos(mailboxes []listedMailbox) []MailboxInfo {
+	infos := []MailboxInfo{}
+	for _, mailbox := range mailboxes {
+		if mailbox.LabelID() == pmapi.AllMailLabel && !ib.isAllMailVisible {
+			continue
+		}
+
+		infos = append(infos, MailboxInfo{
+			Name:       mailbox.Name(),
+			Delimiter:  mailbox.GetDelimiter(),
+			Attributes: ib.mailboxAttributes(mailbox, mailbox.Name()),
+		})
+	}
+
+	for _, root := range []string{store.UserLabelsMailboxName, store.UserFoldersMailboxName} {
+		infos = append(infos, MailboxInfo{
+			Name:       root,
+			Delimiter:  store.PathDelimiter,
+			Attributes: []string{imap.NoSelectAttr},
+		})
+	}
+
+	return infos
+}
+
+// mailboxAttributes returns the IMAP attributes of the mailbox listed as name.
+func (ib *imapBackend) mailboxAttributes(mailbox listedMailbox, name string) []string {
+	attributes := []string{}
+	if !mailbox.IsFolder() || mailbox.IsSystem() {
+		attributes = append(attributes, imap.NoInferiorsAttr) // Subfolders are not supported for System or Label
+	}
+	if attr := ib.specialUseAttr(mailbox.LabelID(), name); attr != "" {
+		attributes = append(attributes, attr)
+	}
+
+	return attributes
+}
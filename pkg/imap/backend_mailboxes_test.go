@@ -0,0 +1,163 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/golang/mock/gomock"
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/store"
+	"github.com/ljanyst/peroxide/pkg/users"
+	"github.com/ljanyst/peroxide/pkg/users/credentials"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeMailbox struct {
+	labelID, name      string
+	isFolder, isSystem bool
+}
+
+func (m fakeMailbox) LabelID() string      { return m.labelID }
+func (m fakeMailbox) Name() string         { return m.name }
+func (m fakeMailbox) IsFolder() bool       { return m.isFolder }
+func (m fakeMailbox) IsSystem() bool       { return m.isSystem }
+func (m fakeMailbox) GetDelimiter() string { return store.PathDelimiter }
+
+func TestMailboxInfos(t *testing.T) {
+	setting := newTestSettings(t, t.TempDir(), settings.IMAPSpecialUse+": Folders/Receipts=Archive")
+	ib := newIMAPBackend(listener.New(), setting, nil, WithAllMailVisible(false))
+
+	mailboxes := []listedMailbox{
+		fakeMailbox{labelID: pmapi.SentLabel, name: "Sent", isFolder: true, isSystem: true},
+		fakeMailbox{labelID: "receipts", name: "Folders/Receipts", isFolder: true},
+		fakeMailbox{labelID: pmapi.AllMailLabel, name: "All Mail", isFolder: true, isSystem: true},
+	}
+
+	require.Equal(t, []MailboxInfo{
+		{Name: "Sent", Delimiter: store.PathDelimiter, Attributes: []string{imap.NoInferiorsAttr, imap.SentAttr}},
+		{Name: "Folders/Receipts", Delimiter: store.PathDelimiter, Attributes: []string{imap.ArchiveAttr}},
+		{Name: store.UserLabelsMailboxName, Delimiter: store.PathDelimiter, Attributes: []string{imap.NoSelectAttr}},
+		{Name: store.UserFoldersMailboxName, Delimiter: store.PathDelimiter, Attributes: []string{imap.NoSelectAttr}},
+	}, ib.mailboxInfos(mailboxes))
+
+	// All Mail is listed once made visible.
+	WithAllMailVisible(true)(ib)
+	require.Len(t, ib.mailboxInfos(mailboxes), 5)
+}
+
+func TestListMailboxesChecksCredentials(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ib, credStorer, creds, password := newCredentialsTestBackend(t, ctrl)
+	credStorer.EXPECT().SetEnabled("user", false).DoAndReturn(func(_ string, enabled bool) (*credentials.Credentials, error) {
+		creds.Disabled = !enabled
+		return creds, nil
+	})
+
+	_, err := ib.ListMailboxes("user@pm.me", "main", "bad")
+	require.ErrorIs(t, err, users.ErrBadSlotPassword)
+
+	var loginErr *users.LoginError
+	require.ErrorAs(t, err, &loginErr)
+
+	_, err = ib.ListMailboxes("user@pm.me", "other", password)
+	require.ErrorIs(t, err, users.ErrBadSlotPassword)
+
+	_, err = ib.ListMailboxes("nobody@pm.me", "main", password)
+	require.Error(t, err)
+
+	require.NoError(t, ib.usersMgr.SetUserEnabled("user", false))
+	_, err = ib.ListMailboxes(" User@PM.me", "main", password)
+	require.ErrorIs(t, err, users.ErrUserDisabled)
+	require.ErrorAs(t, err, &loginErr)
+	require.Equal(t, users.ErrUserDisabled, loginErr.Reason)
+
+	// Rejected calls neither load an IMAP user nor bring the user online.
+	require.Empty(t, ib.users)
+	user, err := ib.usersMgr.GetUser("user@pm.me")
+	require.NoError(t, err)
+	require.False(t, user.IsOnline())
+}
+
+func TestWithLoadedUserKeepsLoadedUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ib, _, _, password := newCredentialsTestBackend(t, ctrl)
+	loaded := &imapUser{backend: ib, userID: "user", currentAddressLowercase: "user@pm.me"}
+	ib.users["user@pm.me"] = loaded
+
+	var got *imapUser
+	require.NoError(t, ib.withLoadedUser("user@pm.me", "main", password, func(imapUser *imapUser) { got = imapUser }))
+	require.Equal(t, loaded, got)
+	require.Equal(t, map[string]*imapUser{"user@pm.me": loaded}, ib.users)
+}
+
+func TestWithLoadedUserUnloadsUser(t *testing.T) {
+	for _, connected := range []bool{false, true} {
+		ctrl := gomock.NewController(t)
+
+		ib, _, _, password := newCredentialsTestBackend(t, ctrl)
+		loaded := &imapUser{backend: ib, userID: "user", currentAddressLowercase: "user@pm.me"}
+
+		// The user is created by a login in flight which finishes only after
+		// withLoadedUser found it not loaded.
+		creation := &userCreation{done: make(chan struct{})}
+		ib.userCreations = map[string]*userCreation{"user@pm.me": creation}
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- ib.withLoadedUser("user@pm.me", "main", password, func(imapUser *imapUser) {
+				require.Equal(t, loaded, imapUser)
+			})
+		}()
+
+		require.Eventually(t, func() bool {
+			ib.loginsLock.Lock()
+			defer ib.loginsLock.Unlock()
+			return len(ib.logins["user@pm.me"]) > 0
+		}, time.Second, time.Millisecond)
+
+		ib.usersLocker.Lock()
+		ib.users["user@pm.me"] = loaded
+		delete(ib.userCreations, "user@pm.me")
+		ib.usersLocker.Unlock()
+		if connected {
+			require.NoError(t, ib.acquireConnection("user@pm.me"))
+		}
+		creation.user = loaded
+		close(creation.done)
+
+		require.NoError(t, <-errs)
+
+		// The user stays loaded only for the connected IMAP client.
+		if connected {
+			require.Equal(t, map[string]*imapUser{"user@pm.me": loaded}, ib.users)
+		} else {
+			require.Empty(t, ib.users)
+		}
+
+		ctrl.Finish()
+	}
+}
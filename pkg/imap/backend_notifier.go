@@ -0,0 +1,95 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import "github.com/ljanyst/peroxide/pkg/store"
+
+type changeNotifierSetter interface {
+	SetChangeNotifier(store.ChangeNotifier)
+}
+
+// notifierSessions is a store forwarding changes to IMAP clients together
+// with the number of IMAP sessions per address which keep it attached.
+type notifierSessions struct {
+	store    changeNotifierSetter
+	sessions map[string]int
+}
+
+// attachChangeNotifier starts forwarding store changes to IMAP clients
+// unless the backend was configured with WithoutChangeNotifier. The notifier
+// stays attached until the last session of the user logs out or is closed,
+// see releaseChangeNotifier and resetChangeNotifier.
+func (ib *imapBackend) attachChangeNotifier(userID, address string, s changeNotifierSetter) {
+	if ib.noChangeNotifier {
+		return
+	}
+
+	ib.notifiersLock.Lock()
+	defer ib.notifiersLock.Unlock()
+
+	if ib.notifiers == nil {
+		ib.notifiers = map[string]*notifierSessions{}
+	}
+
+	// A user brought online again has a new store.
+	attached, ok := ib.notifiers[userID]
+	if !ok || attached.store != s {
+		attached = &notifierSessions{store: s, sessions: map[string]int{}}
+		ib.notifiers[userID] = attached
+		s.SetChangeNotifier(ib.updates)
+	}
+
+	attached.sessions[normalizeAddress(address)]++
+}
+
+// releaseChangeNotifier unregisters one session of address.
+func (ib *imapBackend) releaseChangeNotifier(address string) {
+	ib.detachChangeNotifier(normalizeAddress(address), 1)
+}
+
+// resetChangeNotifier unregisters all sessions of address, e.g. after they
+// were closed by a CloseConnectionEvent.
+func (ib *imapBackend) resetChangeNotifier(address string) {
+	ib.detachChangeNotifier(normalizeAddress(address), -1)
+}
+
+// detachChangeNotifier unregisters count sessions of address, or all of them
+// if count is negative, and detaches the notifier of stores left without any.
+// Addresses of a user in split mode share the user's store.
+func (ib *imapBackend) detachChangeNotifier(address string, count int) {
+	ib.notifiersLock.Lock()
+	defer ib.notifiersLock.Unlock()
+
+	for userID, attached := range ib.notifiers {
+		sessions, ok := attached.sessions[address]
+		if !ok {
+			continue
+		}
+
+		if count < 0 || sessions <= count {
+			delete(attached.sessions, address)
+		} else {
+			attached.sessions[address] = sessions - count
+		}
+
+		if len(attached.sessions) == 0 {
+			attached.store.SetChangeNotifier(nil)
+			delete(ib.notifiers, userID)
+		}
+	}
+}
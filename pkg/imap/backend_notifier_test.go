@@ -0,0 +1,72 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeNotifierDetachedOnCloseConnection(t *testing.T) {
+	setting := settings.New(filepath.Join(t.TempDir(), "settings.yaml"))
+	ib := NewIMAPBackendWithOptions(listener.New(), setting, nil, WithInMemoryCache(), WithoutDisconnectionMonitor())
+
+	// Two sessions of the primary address and one of another address of the same user.
+	s := &fakeNotifierStore{}
+	ib.attachChangeNotifier("userID", "user@pm.me", s)
+	ib.attachChangeNotifier("userID", "user@pm.me", s)
+	ib.attachChangeNotifier("userID", "alias@pm.me", s)
+	require.Equal(t, []store.ChangeNotifier{ib.updates}, s.notifiers)
+
+	ch := make(chan string, 1)
+	ch <- "User@PM.me"
+	close(ch)
+	ib.processDisconnections(ch)
+
+	// The alias session still needs the notifier.
+	require.Equal(t, []store.ChangeNotifier{ib.updates}, s.notifiers)
+
+	ib.releaseChangeNotifier("alias@pm.me")
+	require.Equal(t, []store.ChangeNotifier{ib.updates, nil}, s.notifiers)
+	require.Empty(t, ib.notifiers)
+}
+
+func TestChangeNotifierDetachedOnLogout(t *testing.T) {
+	setting := settings.New(filepath.Join(t.TempDir(), "settings.yaml"))
+	ib := NewIMAPBackendWithOptions(listener.New(), setting, nil, WithInMemoryCache(), WithoutDisconnectionMonitor())
+
+	s := &fakeNotifierStore{}
+	ib.attachChangeNotifier("userID", "user@pm.me", s)
+	ib.attachChangeNotifier("userID", "user@pm.me", s)
+
+	ib.releaseChangeNotifier("user@pm.me")
+	require.Equal(t, []store.ChangeNotifier{ib.updates}, s.notifiers)
+
+	ib.releaseChangeNotifier("user@pm.me")
+	require.Equal(t, []store.ChangeNotifier{ib.updates, nil}, s.notifiers)
+
+	// A new store of the same user gets the notifier attached again.
+	other := &fakeNotifierStore{}
+	ib.attachChangeNotifier("userID", "user@pm.me", other)
+	require.Equal(t, []store.ChangeNotifier{ib.updates}, other.notifiers)
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/clock"
+)
+
+// Option configures the backend created by NewIMAPBackendWithOptions.
+type Option func(*imapBackend)
+
+// WithBCCSelf sets whether sent messages are also delivered to the sender.
+func WithBCCSelf(bccSelf bool) Option {
+	return func(ib *imapBackend) {
+		ib.bccSelf = bccSelf
+	}
+}
+
+// WithPlusTagStripping sets whether Login resolves user+tag@domain as user@domain.
+func WithPlusTagStripping(stripPlusTag bool) Option {
+	return func(ib *imapBackend) {
+		ib.stripPlusTag = stripPlusTag
+	}
+}
+
+// WithAllMailVisible sets whether the All Mail mailbox is listed.
+func WithAllMailVisible(isAllMailVisible bool) Option {
+	return func(ib *imapBackend) {
+		ib.isAllMailVisible = isAllMailVisible
+	}
+}
+
+// WithInMemoryCache keeps the IMAP backend cache in memory only; nothing is
+// read from or written to the cache directory.
+func WithInMemoryCache() Option {
+	return func(ib *imapBackend) {
+		ib.imapCachePath = ""
+	}
+}
+
+// WithReadOnlyCache loads the IMAP backend cache from the cache directory but
+// never writes it back; changes are kept in memory only.
+func WithReadOnlyCache() Option {
+	return func(ib *imapBackend) {
+		ib.imapCacheReadOnly = true
+	}
+}
+
+// WithWorkers sets the number of workers used to resolve items of a single request.
+func WithWorkers(workers int) Option {
+	return func(ib *imapBackend) {
+		ib.listWorkers = workers
+	}
+}
+
+// WithMaxConnectionsPerAddress limits the number of concurrent IMAP
+// connections of a single address. 0 means unlimited.
+func WithMaxConnectionsPerAddress(limit int) Option {
+	return func(ib *imapBackend) {
+		ib.maxConnectionsPerAddress = limit
+	}
+}
+
+// WithMaxConnections limits the number of concurrent IMAP connections of all
+// addresses together. 0 means unlimited.
+func WithMaxConnections(limit int) Option {
+	return func(ib *imapBackend) {
+		ib.maxConnections = limit
+	}
+}
+
+// WithoutChangeNotifier never attaches the IMAP update notifier to the user
+// store. Meant for SMTP-only deployments which have no IMAP IDLE clients and
+// would otherwise pay for the notifications during synchronization.
+func WithoutChangeNotifier() Option {
+	return func(ib *imapBackend) {
+		ib.noChangeNotifier = true
+	}
+}
+
+// WithoutDisconnectionMonitor does not start the goroutine which forgets users
+// on close connection events. Meant for tests, which call processDisconnections.
+func WithoutDisconnectionMonitor() Option {
+	return func(ib *imapBackend) {
+		ib.noDisconnectionMonitor = true
+	}
+}
+
+// WithMaxUsernameLength rejects logins with usernames longer than length
+// bytes. 0 means unlimited.
+func WithMaxUsernameLength(length int) Option {
+	return func(ib *imapBackend) {
+		ib.maxUsernameLength = length
+	}
+}
+
+// WithSlowOpThreshold logs a warning for IMAP operations taking longer than
+// threshold. 0 disables the logging.
+func WithSlowOpThreshold(threshold time.Duration) Option {
+	return func(ib *imapBackend) {
+		ib.slowOpThreshold = threshold
+	}
+}
+
+// WithClock replaces the clock used for time-dependent behaviour such as the bad login delay.
+func WithClock(clk clock.Clock) Option {
+	return func(ib *imapBackend) {
+		ib.clock = clk
+	}
+}
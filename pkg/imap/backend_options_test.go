@@ -0,0 +1,216 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/clock"
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewIMAPBackendWithOptions(t *testing.T) {
+	setting := settings.New(filepath.Join(t.TempDir(), "settings.yaml"))
+	clk := clock.NewFake(time.Now())
+
+	ib := NewIMAPBackendWithOptions(listener.New(), setting, nil,
+		WithBCCSelf(true),
+		WithWorkers(3),
+		WithInMemoryCache(),
+		WithClock(clk),
+		WithMaxConnectionsPerAddress(2),
+	)
+
+	require.True(t, ib.bccSelf)
+	require.True(t, ib.isAllMailVisible, "unset options must fall back to settings")
+	require.Equal(t, 3, ib.listWorkers)
+	require.Equal(t, clk, ib.clock)
+	require.Equal(t, 2, ib.maxConnectionsPerAddress)
+
+	// The in-memory cache works without touching the cache directory.
+	ib.addToCache("user", SubscriptionException, "Folder")
+	require.Equal(t, "Folder", ib.getCacheList("user", SubscriptionException))
+	require.Equal(t, "", ib.imapCachePath)
+}
+
+func TestNewIMAPBackendDefaults(t *testing.T) {
+	setting := settings.New(filepath.Join(t.TempDir(), "settings.yaml"))
+
+	ib := NewIMAPBackend(listener.New(), setting, nil, false, false)
+
+	require.False(t, ib.bccSelf)
+	require.False(t, ib.isAllMailVisible)
+	require.Equal(t, setting.GetInt(settings.IMAPWorkers), ib.listWorkers)
+	require.Equal(t, clock.Real, ib.clock)
+}
+
+func TestNewIMAPBackendCheckedCreatesCacheDir(t *testing.T) {
+	cacheDir := filepath.Join(t.TempDir(), "nested", "cache")
+
+	_, err := NewIMAPBackendChecked(listener.New(), newTestSettings(t, cacheDir), nil)
+	require.NoError(t, err)
+	require.DirExists(t, cacheDir)
+}
+
+func TestNewIMAPBackendCheckedFailsOnUnusableCacheDir(t *testing.T) {
+	// A regular file in place of a parent directory cannot be fixed by MkdirAll.
+	parent := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, ioutil.WriteFile(parent, []byte{}, 0o600))
+
+	_, err := NewIMAPBackendChecked(listener.New(), newTestSettings(t, filepath.Join(parent, "cache")), nil)
+	require.Error(t, err)
+}
+
+// newTestSettings returns settings with the given cache directory and any
+// further settings given as "Key: value" YAML lines.
+func newTestSettings(t *testing.T, cacheDir string, lines ...string) *settings.Settings {
+	content := settings.CacheDir + ": " + cacheDir + "\n"
+	for _, line := range lines {
+		content += line + "\n"
+	}
+
+	path := filepath.Join(t.TempDir(), "settings.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0o600))
+
+	return settings.New(path)
+}
+
+func TestIMAPCacheFileFromSettings(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	ib := newIMAPBackend(listener.New(), newTestSettings(t, cacheDir), nil)
+	require.Equal(t, filepath.Join(cacheDir, "imap_backend_cache.json"), ib.imapCachePath)
+
+	ib = newIMAPBackend(listener.New(), newTestSettings(t, cacheDir, settings.IMAPCacheFile+": second.json"), nil)
+	require.Equal(t, filepath.Join(cacheDir, "second.json"), ib.imapCachePath)
+}
+
+func TestIMAPWorkersFromSettings(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	auto := runtime.NumCPU()
+	if auto < minAutoIMAPWorkers {
+		auto = minAutoIMAPWorkers
+	}
+	if auto > maxAutoIMAPWorkers {
+		auto = maxAutoIMAPWorkers
+	}
+
+	ib := newIMAPBackend(listener.New(), newTestSettings(t, cacheDir, settings.IMAPWorkers+": 0"), nil)
+	require.Equal(t, auto, ib.listWorkers)
+
+	ib = newIMAPBackend(listener.New(), newTestSettings(t, cacheDir, settings.IMAPWorkers+": -3"), nil)
+	require.Equal(t, auto, ib.listWorkers)
+
+	ib = newIMAPBackend(listener.New(), newTestSettings(t, cacheDir, settings.IMAPWorkers+": 7"), nil)
+	require.Equal(t, 7, ib.listWorkers)
+
+	ib = newIMAPBackend(listener.New(), newTestSettings(t, cacheDir, settings.IMAPWorkers+": 7", settings.SafeMode+": true"), nil)
+	require.Equal(t, 1, ib.listWorkers)
+}
+
+func TestIMAPCacheFileRejectsPaths(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	for _, name := range []string{"../escape.json", "sub/cache.json", `sub\cache.json`, ".."} {
+		_, err := NewIMAPBackendChecked(listener.New(), newTestSettings(t, cacheDir, settings.IMAPCacheFile+": '"+name+"'"), nil)
+		require.ErrorIs(t, err, ErrInvalidCacheFile, name)
+	}
+}
+
+func TestEmptyCacheDir(t *testing.T) {
+	setting := newTestSettings(t, t.TempDir())
+	require.NoError(t, setting.SetMany(map[string]string{settings.CacheDir: ""}))
+
+	_, err := NewIMAPBackendChecked(listener.New(), setting, nil)
+	require.ErrorIs(t, err, ErrEmptyCacheDir)
+
+	ib := newIMAPBackend(listener.New(), setting, nil)
+	require.True(t, ib.isCacheInMemory())
+
+	ib.addToCache("userID", "label", "value")
+	_, err = os.Stat(defaultIMAPCacheFile)
+	require.True(t, os.IsNotExist(err))
+}
+
+type fakeNotifierStore struct {
+	notifiers []store.ChangeNotifier
+}
+
+func (s *fakeNotifierStore) SetChangeNotifier(notifier store.ChangeNotifier) {
+	s.notifiers = append(s.notifiers, notifier)
+}
+
+func TestWithoutChangeNotifier(t *testing.T) {
+	setting := settings.New(filepath.Join(t.TempDir(), "settings.yaml"))
+
+	s := &fakeNotifierStore{}
+	ib := NewIMAPBackendWithOptions(listener.New(), setting, nil, WithInMemoryCache(), WithoutChangeNotifier())
+	ib.attachChangeNotifier("userID", "user@pm.me", s)
+	require.Empty(t, s.notifiers)
+
+	s = &fakeNotifierStore{}
+	ib = NewIMAPBackendWithOptions(listener.New(), setting, nil, WithInMemoryCache())
+	ib.attachChangeNotifier("userID", "user@pm.me", s)
+	require.Equal(t, []store.ChangeNotifier{ib.updates}, s.notifiers)
+}
+
+func TestWithoutDisconnectionMonitor(t *testing.T) {
+	setting := settings.New(filepath.Join(t.TempDir(), "settings.yaml"))
+
+	ib := NewIMAPBackendWithOptions(listener.New(), setting, nil, WithInMemoryCache(), WithoutDisconnectionMonitor())
+	require.True(t, ib.noDisconnectionMonitor)
+
+	ib.users["user@pm.me"] = &imapUser{backend: ib, currentAddressLowercase: "user@pm.me"}
+	ib.connections["user@pm.me"] = 1
+
+	ch := make(chan string, 1)
+	ch <- "User@PM.me"
+	close(ch)
+
+	ib.processDisconnections(ch)
+
+	require.Empty(t, ib.ActiveUsers())
+	require.Empty(t, ib.connections)
+}
+
+func TestBCCSelfPerAddressOverride(t *testing.T) {
+	setting := newTestSettings(t, t.TempDir(),
+		settings.BCCSelfAddressKey("override@pm.me")+": true",
+		settings.BCCSelfAddressKey("disabled@pm.me")+": false",
+		settings.BCCSelfAddressKey("user@bücher.example")+": true",
+	)
+
+	ib := newIMAPBackend(listener.New(), setting, nil, WithBCCSelf(false))
+	require.True(t, ib.bccSelfFor("override@pm.me"))
+	require.True(t, ib.bccSelfFor("Override@PM.me"))
+	require.True(t, ib.bccSelfFor("User@XN--BCHER-KVA.example"))
+	require.False(t, ib.bccSelfFor("default@pm.me"))
+
+	ib = newIMAPBackend(listener.New(), setting, nil, WithBCCSelf(true))
+	require.True(t, ib.bccSelfFor("default@pm.me"))
+	require.False(t, ib.bccSelfFor("disabled@pm.me"))
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/events"
+)
+
+// ErrSessionNotFound is returned by RevokeSession for unknown session IDs.
+var ErrSessionNotFound = errors.New("no such IMAP session")
+
+// SessionInfo describes a logged in IMAP session.
+type SessionInfo struct {
+	ID         string
+	Address    string
+	UserID     string
+	Slot       string
+	RemoteAddr string
+	CreatedAt  time.Time
+}
+
+// imapSession is the go-imap user of a single logged in connection.
+// The sessions of an address share its imapUser.
+type imapSession struct {
+	*imapUser
+
+	seq        uint64
+	id         string
+	slot       string
+	remoteAddr string
+	createdAt  time.Time
+}
+
+func (ib *imapBackend) newSession(imapUser *imapUser, slot string, conn *imap.ConnInfo) *imapSession {
+	seq := atomic.AddUint64(&ib.sessionSeq, 1)
+
+	session := &imapSession{
+		imapUser:  imapUser,
+		seq:       seq,
+		id:        strconv.FormatUint(seq, 10),
+		slot:      slot,
+		createdAt: ib.clock.Now(),
+	}
+
+	if conn != nil && conn.RemoteAddr != nil {
+		session.remoteAddr = conn.RemoteAddr.String()
+	}
+
+	ib.sessionsLock.Lock()
+	defer ib.sessionsLock.Unlock()
+
+	if ib.sessions == nil {
+		ib.sessions = map[string]*imapSession{}
+	}
+
+	ib.sessions[session.id] = session
+
+	return session
+}
+
+// Logout is called when the connection of the session is closed. It releases
+// the session only once, also when it was revoked before.
+func (s *imapSession) Logout() error {
+	if !s.backend.removeSession(s.id) {
+		return nil
+	}
+
+	return s.imapUser.Logout()
+}
+
+// removeSession forgets the session and returns whether it was known.
+func (ib *imapBackend) removeSession(id string) bool {
+	ib.sessionsLock.Lock()
+	defer ib.sessionsLock.Unlock()
+
+	if _, ok := ib.sessions[id]; !ok {
+		return false
+	}
+
+	delete(ib.sessions, id)
+
+	return true
+}
+
+// resetSessions forgets all sessions of address, e.g. after they were closed
+// by a CloseConnectionEvent.
+func (ib *imapBackend) resetSessions(address string) {
+	address = normalizeAddress(address)
+
+	ib.sessionsLock.Lock()
+	defer ib.sessionsLock.Unlock()
+
+	for id, session := range ib.sessions {
+		if session.currentAddressLowercase == address {
+			delete(ib.sessions, id)
+		}
+	}
+}
+
+// Sessions returns a snapshot of the logged in IMAP sessions, oldest first.
+func (ib *imapBackend) Sessions() []SessionInfo {
+	ib.sessionsLock.Lock()
+	sessions := make([]*imapSession, 0, len(ib.sessions))
+	for _, session := range ib.sessions {
+		sessions = append(sessions, session)
+	}
+	ib.sessionsLock.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].seq < sessions[j].seq })
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, SessionInfo{
+			ID:         session.id,
+			Address:    session.currentAddressLowercase,
+			UserID:     session.userID,
+			Slot:       session.slot,
+			RemoteAddr: session.remoteAddr,
+			CreatedAt:  session.createdAt,
+		})
+	}
+
+	return infos
+}
+
+// RevokeSession logs out the session with the given ID and asks the server to
+// close its connection. Other sessions of the same user are not affected.
+func (ib *imapBackend) RevokeSession(id string) error {
+	ib.sessionsLock.Lock()
+	session, ok := ib.sessions[id]
+	ib.sessionsLock.Unlock()
+
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	log.WithField("address", session.currentAddressLowercase).WithField("session", id).Info("Revoking IMAP session")
+
+	if err := session.Logout(); err != nil {
+		return err
+	}
+
+	if ib.eventListener != nil {
+		ib.eventListener.Emit(events.CloseSessionEvent, id)
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+	"github.com/ljanyst/peroxide/pkg/events"
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevokeSession(t *testing.T) {
+	setting := settings.New(filepath.Join(t.TempDir(), "settings.yaml"))
+	eventListener := listener.New()
+	ib := NewIMAPBackendWithOptions(eventListener, setting, nil, WithInMemoryCache(), WithoutDisconnectionMonitor())
+
+	revoked := make(chan string, 1)
+	eventListener.Add(events.CloseSessionEvent, revoked)
+
+	user := &imapUser{backend: ib, userID: "userID", currentAddressLowercase: "user@pm.me", storeAddress: &store.Address{}}
+	ib.users["user@pm.me"] = user
+	ib.connections["user@pm.me"] = 2
+
+	phone := ib.newSession(user, "phone", &imap.ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}})
+	laptop := ib.newSession(user, "laptop", &imap.ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2}})
+	require.NotEqual(t, phone.id, laptop.id)
+
+	sessions := ib.Sessions()
+	require.Len(t, sessions, 2)
+	require.Equal(t, SessionInfo{
+		ID:         phone.id,
+		Address:    "user@pm.me",
+		UserID:     "userID",
+		Slot:       "phone",
+		RemoteAddr: "10.0.0.1:1",
+		CreatedAt:  phone.createdAt,
+	}, sessions[0])
+
+	require.NoError(t, ib.RevokeSession(phone.id))
+	select {
+	case id := <-revoked:
+		require.Equal(t, phone.id, id)
+	case <-time.After(time.Second):
+		require.Fail(t, "no close session event")
+	}
+
+	// The laptop session keeps its connection.
+	sessions = ib.Sessions()
+	require.Len(t, sessions, 1)
+	require.Equal(t, laptop.id, sessions[0].ID)
+	require.Equal(t, 1, ib.connections["user@pm.me"])
+
+	require.ErrorIs(t, ib.RevokeSession(phone.id), ErrSessionNotFound)
+
+	// Closing the revoked connection does not release the connection twice.
+	require.NoError(t, phone.Logout())
+	require.Equal(t, 1, ib.connections["user@pm.me"])
+
+	require.NoError(t, laptop.Logout())
+	require.Empty(t, ib.connections)
+	require.Empty(t, ib.Sessions())
+}
+
+func TestSessionsResetOnCloseConnection(t *testing.T) {
+	setting := settings.New(filepath.Join(t.TempDir(), "settings.yaml"))
+	ib := NewIMAPBackendWithOptions(listener.New(), setting, nil, WithInMemoryCache(), WithoutDisconnectionMonitor())
+
+	user := &imapUser{backend: ib, currentAddressLowercase: "user@pm.me"}
+	other := &imapUser{backend: ib, currentAddressLowercase: "other@pm.me"}
+	ib.newSession(user, "main", nil)
+	ib.newSession(other, "main", nil)
+
+	ch := make(chan string, 1)
+	ch <- "User@PM.me"
+	close(ch)
+	ib.processDisconnections(ch)
+
+	sessions := ib.Sessions()
+	require.Len(t, sessions, 1)
+	require.Equal(t, "other@pm.me", sessions[0].Address)
+}
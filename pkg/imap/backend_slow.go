@@ -0,0 +1,54 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// timeOp starts timing the operation `op` and returns a function to be called
+// once the operation is done. When the operation took longer than the slow
+// operation threshold, a warning with the elapsed time and `fields` is logged.
+// Nothing is measured when the threshold is not set.
+func (ib *imapBackend) timeOp(op string, fields logrus.Fields) func() {
+	if ib.slowOpThreshold <= 0 {
+		return func() {}
+	}
+
+	start := ib.clock.Now()
+
+	return func() {
+		elapsed := ib.clock.Now().Sub(start)
+		if elapsed < ib.slowOpThreshold {
+			return
+		}
+
+		log.WithFields(fields).
+			WithField("op", op).
+			WithField("elapsed", elapsed).
+			WithField("threshold", ib.slowOpThreshold).
+			Warn("Slow IMAP operation")
+	}
+}
+
+// slowOpThresholdFromMilliseconds converts the setting value; 0 disables the logging.
+func slowOpThresholdFromMilliseconds(ms int) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import "sync/atomic"
+
+// BackendStats is a snapshot of the IMAP backend state.
+type BackendStats struct {
+	Users           int   `json:"users"`            // IMAP users currently loaded.
+	CacheEntries    int   `json:"cache_entries"`    // Users with an entry in the backend cache.
+	LoginsSucceeded int64 `json:"logins_succeeded"` // Successful logins since start.
+	LoginsFailed    int64 `json:"logins_failed"`    // Failed logins since start.
+	CacheHits       int64 `json:"cache_hits"`       // Cache lookups which found the item since start.
+	CacheMisses     int64 `json:"cache_misses"`     // Cache lookups which did not find the item since start.
+}
+
+// Stats returns a snapshot of the backend state.
+func (ib *imapBackend) Stats() BackendStats {
+	stats := BackendStats{
+		LoginsSucceeded: atomic.LoadInt64(&ib.loginsSucceeded),
+		LoginsFailed:    atomic.LoadInt64(&ib.loginsFailed),
+		CacheHits:       atomic.LoadInt64(&ib.cacheHits),
+		CacheMisses:     atomic.LoadInt64(&ib.cacheMisses),
+	}
+
+	ib.usersLocker.Lock()
+	for address, imapUser := range ib.users {
+		if isPrimaryEntry(address, imapUser) {
+			stats.Users++
+		}
+	}
+	ib.usersLocker.Unlock()
+
+	ib.imapCacheLock.RLock()
+	stats.CacheEntries = len(ib.imapCache)
+	ib.imapCacheLock.RUnlock()
+
+	return stats
+}
+
+func (ib *imapBackend) countLogin(err error) {
+	if err != nil {
+		atomic.AddInt64(&ib.loginsFailed, 1)
+	} else {
+		atomic.AddInt64(&ib.loginsSucceeded, 1)
+	}
+}
+
+func (ib *imapBackend) countCacheLookup(hit bool) {
+	if hit {
+		atomic.AddInt64(&ib.cacheHits, 1)
+	} else {
+		atomic.AddInt64(&ib.cacheMisses, 1)
+	}
+}
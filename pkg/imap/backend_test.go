@@ -0,0 +1,767 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/emersion/go-imap"
+	"github.com/golang/mock/gomock"
+	"github.com/ljanyst/peroxide/pkg/clock"
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+	"github.com/ljanyst/peroxide/pkg/events"
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	pmapimocks "github.com/ljanyst/peroxide/pkg/pmapi/mocks"
+	"github.com/ljanyst/peroxide/pkg/store"
+	"github.com/ljanyst/peroxide/pkg/users"
+	"github.com/ljanyst/peroxide/pkg/users/credentials"
+	usersmocks "github.com/ljanyst/peroxide/pkg/users/mocks"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	for input, want := range map[string]string{
+		"user@example.com":           "user@example.com",
+		"  user@example.com\t":       "user@example.com",
+		"User.Name@Example.COM":      "user.name@example.com",
+		" Ünïcode@Exämple.ÇOM ":      "ünïcode@exämple.çom",
+		"ΠΡΩΤΟΝ@ΠΑΡΆΔΕΙΓΜΑ.ΕΛ":       "πρωτον@παράδειγμα.ελ",
+		"user@bücher.example":        "user@bücher.example",
+		"user@xn--bcher-kva.example": "user@bücher.example",
+		"User@XN--BCHER-KVA.Example": "user@bücher.example",
+		"":                           "",
+	} {
+		require.Equal(t, want, normalizeAddress(input), input)
+	}
+}
+
+func TestNormalizeLoginTrimsSlot(t *testing.T) {
+	username, slot, password, err := normalizeLogin(" user..Phone @example.com ", " secret\r\n")
+	require.NoError(t, err)
+	require.Equal(t, "user@example.com", username)
+	require.Equal(t, "Phone", slot)
+	require.Equal(t, "secret", password)
+}
+
+func TestNormalizeLoginCasing(t *testing.T) {
+	// Addresses are case-insensitive, slot names are not.
+	username, slot, _, err := normalizeLogin("User.Name..PhoneSlot@Example.COM", "secret")
+	require.NoError(t, err)
+	require.Equal(t, "user.name@example.com", username)
+	require.Equal(t, "PhoneSlot", slot)
+}
+
+func TestNormalizeLoginKeepsInternalSpaces(t *testing.T) {
+	_, slot, password, err := normalizeLogin("user@example.com", "correct horse battery staple")
+	require.NoError(t, err)
+	require.Equal(t, "main", slot)
+	require.Equal(t, "correct horse battery staple", password)
+}
+
+func TestLoginRejectsEmptyPassword(t *testing.T) {
+	// No users manager: the password must be rejected before it is needed.
+	ib := &imapBackend{usersLocker: &sync.Mutex{}, imapCacheLock: &sync.RWMutex{}}
+
+	for _, password := range []string{"", " \t"} {
+		user, err := ib.Login(nil, "user@example.com", password)
+		require.ErrorIs(t, err, users.ErrEmptyPassword)
+		require.Nil(t, user)
+	}
+
+	require.Equal(t, BackendStats{LoginsFailed: 2}, ib.Stats())
+}
+
+func TestLoginRejectsLongUsername(t *testing.T) {
+	// No users manager and no password: an accepted username fails on the password.
+	ib := &imapBackend{usersLocker: &sync.Mutex{}, imapCacheLock: &sync.RWMutex{}, maxUsernameLength: 20}
+
+	atLimit := strings.Repeat("u", 14) + "@pm.me"
+	require.Len(t, atLimit, 20)
+	_, err := ib.Login(nil, atLimit, "")
+	require.ErrorIs(t, err, users.ErrEmptyPassword)
+
+	_, err = ib.Login(nil, "u"+atLimit, "")
+	require.ErrorIs(t, err, ErrUsernameTooLong)
+
+	require.Equal(t, BackendStats{LoginsFailed: 2}, ib.Stats())
+}
+
+func TestLoginIPAllowlist(t *testing.T) {
+	allowlist, err := ParseIPAllowlist("10.0.0.0/8, ::1/128")
+	require.NoError(t, err)
+
+	// No users manager and no password: an allowed client fails on the password.
+	ib := &imapBackend{usersLocker: &sync.Mutex{}, imapCacheLock: &sync.RWMutex{}, ipAllowlist: allowlist}
+
+	allowed := &imap.ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}}
+	_, err = ib.Login(allowed, "user@pm.me", "")
+	require.ErrorIs(t, err, users.ErrEmptyPassword)
+
+	allowed = &imap.ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.IPv6loopback, Port: 1234}}
+	_, err = ib.Login(allowed, "user@pm.me", "")
+	require.ErrorIs(t, err, users.ErrEmptyPassword)
+
+	denied := &imap.ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234}}
+	_, err = ib.Login(denied, "user@pm.me", "")
+	require.ErrorIs(t, err, ErrClientNotAllowed)
+
+	_, err = ib.Login(nil, "user@pm.me", "")
+	require.ErrorIs(t, err, ErrClientNotAllowed)
+
+	require.Equal(t, BackendStats{LoginsFailed: 4}, ib.Stats())
+}
+
+func TestLoginIPAllowlistMalformed(t *testing.T) {
+	setting := newTestSettings(t, t.TempDir(), settings.IMAPAllowedNetworks+": 10.0.0.0/8, 10.0.0.1")
+
+	_, err := NewIMAPBackendChecked(listener.New(), setting, nil)
+	require.ErrorIs(t, err, ErrInvalidIPAllowlist)
+
+	// The unchecked constructor rejects every login instead.
+	ib := newIMAPBackend(listener.New(), setting, nil)
+	allowed := &imap.ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}}
+	_, err = ib.Login(allowed, "user@pm.me", "password")
+	require.ErrorIs(t, err, ErrInvalidIPAllowlist)
+}
+
+func TestLoginIPAllowlistEmpty(t *testing.T) {
+	ib := newIMAPBackend(listener.New(), newTestSettings(t, t.TempDir()), nil)
+	require.Empty(t, ib.ipAllowlist)
+	require.NoError(t, ib.checkClientAllowed(nil))
+}
+
+// newCredentialsTestBackend returns a backend with a users manager holding a
+// single connected user "user@pm.me" with key slot "main" and its password.
+func newCredentialsTestBackend(t *testing.T, ctrl *gomock.Controller) (*imapBackend, *usersmocks.MockCredentialsStorer, *credentials.Credentials, string) {
+	var mainKey [32]byte
+	copy(mainKey[:], credentials.GenerateKey(32))
+	password := base64.StdEncoding.EncodeToString(mainKey[:])
+
+	creds := &credentials.Credentials{
+		UserID: "user",
+		Name:   "username",
+		Emails: []string{"user@pm.me"},
+		Secret: credentials.Secret{APIToken: "uid:acc", MailboxPassword: []byte("pass")},
+	}
+	copy(creds.Key[:], credentials.GenerateKey(32))
+	creds.SealedKeys = map[string][]byte{}
+	require.NoError(t, creds.SealKey("main", mainKey))
+
+	credStorer := usersmocks.NewMockCredentialsStorer(ctrl)
+	credStorer.EXPECT().List().Return([]string{"user"}, nil)
+	credStorer.EXPECT().Get("user").Return(creds, nil)
+
+	ib := &imapBackend{
+		usersMgr:    users.New(listener.New(), nil, credStorer, nil),
+		users:       map[string]*imapUser{},
+		usersLocker: &sync.Mutex{},
+	}
+
+	return ib, credStorer, creds, password
+}
+
+func TestVerifyCredentials(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ib, _, _, password := newCredentialsTestBackend(t, ctrl)
+
+	require.NoError(t, ib.VerifyCredentials(" User@PM.me", "main", password))
+	require.ErrorIs(t, ib.VerifyCredentials("user@pm.me", "main", "bad"), users.ErrBadSlotPassword)
+	require.ErrorIs(t, ib.VerifyCredentials("user@pm.me", "other", password), users.ErrBadSlotPassword)
+	require.ErrorIs(t, ib.VerifyCredentials("user@pm.me", "main", " "), users.ErrEmptyPassword)
+	require.Error(t, ib.VerifyCredentials("nobody@pm.me", "main", password))
+
+	require.Empty(t, ib.users)
+}
+
+func TestVerifyCredentialsDisabledUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ib, credStorer, creds, password := newCredentialsTestBackend(t, ctrl)
+	credStorer.EXPECT().SetEnabled("user", gomock.Any()).DoAndReturn(func(_ string, enabled bool) (*credentials.Credentials, error) {
+		creds.Disabled = !enabled
+		return creds, nil
+	}).Times(2)
+
+	require.NoError(t, ib.usersMgr.SetUserEnabled("user", false))
+	err := ib.VerifyCredentials("user@pm.me", "main", password)
+	require.ErrorIs(t, err, users.ErrUserDisabled)
+
+	var loginErr *users.LoginError
+	require.ErrorAs(t, err, &loginErr)
+	require.Equal(t, users.ErrUserDisabled, loginErr.Reason)
+
+	// A wrong password is reported as such, not revealing the user is disabled.
+	require.ErrorIs(t, ib.VerifyCredentials("user@pm.me", "main", "bad"), users.ErrBadSlotPassword)
+
+	require.NoError(t, ib.usersMgr.SetUserEnabled("user", true))
+	require.NoError(t, ib.VerifyCredentials("user@pm.me", "main", password))
+}
+
+func TestLoginDisabledUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ib, credStorer, creds, password := newCredentialsTestBackend(t, ctrl)
+	credStorer.EXPECT().SetEnabled("user", false).DoAndReturn(func(_ string, enabled bool) (*credentials.Credentials, error) {
+		creds.Disabled = !enabled
+		return creds, nil
+	})
+
+	fakeClock := clock.NewFake(time.Now())
+	ib.clock = fakeClock
+
+	// The user is already loaded so the login goes straight to the credentials check.
+	user, err := ib.usersMgr.GetUser("user@pm.me")
+	require.NoError(t, err)
+	ib.users["user@pm.me"] = &imapUser{backend: ib, user: user, userID: "user", currentAddressLowercase: "user@pm.me"}
+
+	require.NoError(t, ib.usersMgr.SetUserEnabled("user", false))
+
+	errCh := make(chan error)
+	go func() {
+		_, err := ib.Login(nil, "user@pm.me", password)
+		errCh <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		return fakeClock.Waiters() == 1
+	}, time.Second, 10*time.Millisecond)
+	fakeClock.Advance(badLoginDelay)
+
+	err = <-errCh
+	require.ErrorIs(t, err, users.ErrUserDisabled)
+
+	var loginErr *users.LoginError
+	require.ErrorAs(t, err, &loginErr)
+	require.Equal(t, users.ErrUserDisabled, loginErr.Reason)
+
+	require.Empty(t, ib.users)
+}
+
+func TestStripPlusTag(t *testing.T) {
+	for address, want := range map[string]string{
+		"user+tag@pm.me":     "user@pm.me",
+		"user+a+b@pm.me":     "user@pm.me",
+		"user@pm.me":         "user@pm.me",
+		"+tag@pm.me":         "+tag@pm.me",
+		"user+tag":           "user+tag",
+		"user@plus+host.com": "user@plus+host.com",
+	} {
+		require.Equal(t, want, stripPlusTag(address), address)
+	}
+}
+
+func TestVerifyCredentialsPlusTag(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ib, _, _, password := newCredentialsTestBackend(t, ctrl)
+
+	// Plus addresses are distinct unless stripping is enabled.
+	require.Error(t, ib.VerifyCredentials("user+tag@pm.me", "main", password))
+
+	WithPlusTagStripping(true)(ib)
+	require.NoError(t, ib.VerifyCredentials("User+Tag@pm.me", "main", password))
+	require.NoError(t, ib.VerifyCredentials("user@pm.me", "main", password))
+}
+
+func TestGetOrCreateUserReusesLoadedUser(t *testing.T) {
+	ib := &imapBackend{users: map[string]*imapUser{}, usersLocker: &sync.Mutex{}}
+
+	calls := 0
+	create := func() (*imapUser, error) {
+		calls++
+		user := &imapUser{currentAddressLowercase: "user@pm.me"}
+		ib.usersLocker.Lock()
+		ib.users["user@pm.me"] = user
+		ib.usersLocker.Unlock()
+		return user, nil
+	}
+
+	// Two quick logins resolve the user only once: the loaded user is kept
+	// under the login address.
+	for i := 0; i < 2; i++ {
+		_, err := ib.getOrCreateUser(context.Background(), "user@pm.me", create)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, calls)
+
+	// Closing the connections drops the user, so it is resolved again.
+	ch := make(chan string, 1)
+	ch <- "user@pm.me"
+	close(ch)
+	ib.processDisconnections(ch)
+
+	_, err := ib.getOrCreateUser(context.Background(), "user@pm.me", create)
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+}
+
+func TestGetOrCreateUserCoalescesSameAddress(t *testing.T) {
+	ib := &imapBackend{users: map[string]*imapUser{}, usersLocker: &sync.Mutex{}}
+
+	var calls int32
+	release := make(chan struct{})
+	create := func() (*imapUser, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		user := &imapUser{currentAddressLowercase: "user@pm.me"}
+		ib.usersLocker.Lock()
+		ib.users["user@pm.me"] = user
+		ib.usersLocker.Unlock()
+		return user, nil
+	}
+
+	results := make(chan *imapUser, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			user, err := ib.getOrCreateUser(context.Background(), "user@pm.me", create)
+			require.NoError(t, err)
+			results <- user
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		ib.usersLocker.Lock()
+		defer ib.usersLocker.Unlock()
+		return ib.userCreations["user@pm.me"] != nil
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	first, second := <-results, <-results
+	require.Same(t, first, second)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	require.Empty(t, ib.userCreations)
+}
+
+func TestGetOrCreateUserRetriesAfterFailedCreation(t *testing.T) {
+	ib := &imapBackend{users: map[string]*imapUser{}, usersLocker: &sync.Mutex{}}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	errBadPassword := errors.New("bad password")
+
+	go func() {
+		_, err := ib.getOrCreateUser(context.Background(), "user@pm.me", func() (*imapUser, error) {
+			close(started)
+			<-release
+			return nil, errBadPassword
+		})
+		require.ErrorIs(t, err, errBadPassword)
+	}()
+
+	<-started
+
+	done := make(chan *imapUser)
+	go func() {
+		user, err := ib.getOrCreateUser(context.Background(), "user@pm.me", func() (*imapUser, error) {
+			return &imapUser{}, nil
+		})
+		require.NoError(t, err)
+		done <- user
+	}()
+
+	close(release)
+	require.NotNil(t, <-done)
+}
+
+func TestGetOrCreateUserDifferentAddressesInParallel(t *testing.T) {
+	ib := &imapBackend{users: map[string]*imapUser{}, usersLocker: &sync.Mutex{}}
+
+	// Each creation only finishes once both have started.
+	var started sync.WaitGroup
+	started.Add(2)
+	create := func() (*imapUser, error) {
+		started.Done()
+		started.Wait()
+		return &imapUser{}, nil
+	}
+
+	var done sync.WaitGroup
+	for _, address := range []string{"user@pm.me", "other@pm.me"} {
+		done.Add(1)
+		go func(address string) {
+			defer done.Done()
+			_, err := ib.getOrCreateUser(context.Background(), address, create)
+			require.NoError(t, err)
+		}(address)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		done.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "creations for different addresses are serialized")
+	}
+}
+
+type testPrimaryAddressUser string
+
+func (testPrimaryAddressUser) ID() string                  { return "userID" }
+func (u testPrimaryAddressUser) GetPrimaryAddress() string { return string(u) }
+
+func TestPrimaryAddressKey(t *testing.T) {
+	address, err := primaryAddressKey(testPrimaryAddressUser("User@PM.me"))
+	require.NoError(t, err)
+	require.Equal(t, "user@pm.me", address)
+
+	_, err = primaryAddressKey(testPrimaryAddressUser(""))
+	require.ErrorIs(t, err, ErrNoPrimaryAddress)
+	require.Contains(t, err.Error(), "userID")
+}
+
+func TestConnectionLimitPerAddress(t *testing.T) {
+	ib := &imapBackend{maxConnectionsPerAddress: 1}
+
+	require.NoError(t, ib.acquireConnection("user@pm.me"))
+	require.ErrorIs(t, ib.acquireConnection("USER@pm.me"), ErrTooManyConnections)
+
+	// Other addresses are not affected.
+	require.NoError(t, ib.acquireConnection("other@pm.me"))
+
+	ib.releaseConnection("user@pm.me")
+	require.NoError(t, ib.acquireConnection("user@pm.me"))
+
+	ib.resetConnections("user@pm.me")
+	require.NoError(t, ib.acquireConnection("user@pm.me"))
+}
+
+func TestConnectionLimitServerWide(t *testing.T) {
+	ib := &imapBackend{maxConnections: 2}
+
+	require.NoError(t, ib.acquireConnection("user@pm.me"))
+	require.NoError(t, ib.acquireConnection("other@pm.me"))
+	require.ErrorIs(t, ib.acquireConnection("third@pm.me"), ErrTooManyServerConnections)
+
+	// The refused login does not affect the existing connections.
+	require.Equal(t, map[string]int{"user@pm.me": 1, "other@pm.me": 1}, ib.connections)
+
+	ib.releaseConnection("user@pm.me")
+	require.NoError(t, ib.acquireConnection("third@pm.me"))
+
+	// Releasing an unknown address must not free a slot.
+	ib.releaseConnection("unknown@pm.me")
+	require.ErrorIs(t, ib.acquireConnection("user@pm.me"), ErrTooManyServerConnections)
+
+	ib.resetConnections("other@pm.me")
+	require.NoError(t, ib.acquireConnection("user@pm.me"))
+	require.Equal(t, 2, ib.totalConnections)
+}
+
+func TestConnectionLimitUnlimited(t *testing.T) {
+	ib := &imapBackend{}
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, ib.acquireConnection("user@pm.me"))
+	}
+}
+
+func TestActiveUsers(t *testing.T) {
+	createdAt := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	ib := &imapBackend{
+		users:       map[string]*imapUser{},
+		usersLocker: &sync.Mutex{},
+	}
+
+	ib.usersLocker.Lock()
+	ib.users["user@pm.me"] = &imapUser{
+		backend:                 ib,
+		userID:                  "userID",
+		currentAddressLowercase: "user@pm.me",
+		createdAt:               createdAt,
+	}
+	ib.usersLocker.Unlock()
+
+	require.Equal(t, []ActiveUserInfo{{
+		Address:   "user@pm.me",
+		UserID:    "userID",
+		CreatedAt: createdAt,
+	}}, ib.ActiveUsers())
+
+	ib.deleteUser("User@PM.me")
+	require.Empty(t, ib.ActiveUsers())
+}
+
+func TestActiveUsersReportsLoginSlot(t *testing.T) {
+	ib := &imapBackend{
+		users:       map[string]*imapUser{},
+		usersLocker: &sync.Mutex{},
+	}
+
+	user := &imapUser{backend: ib, userID: "userID", currentAddressLowercase: "user@pm.me"}
+	ib.usersLocker.Lock()
+	ib.users["user@pm.me"] = user
+	ib.usersLocker.Unlock()
+
+	_, slot, _, err := normalizeLogin("user..Phone@pm.me", "secret")
+	require.NoError(t, err)
+	ib.setLoginSlot(user, slot)
+
+	infos := ib.ActiveUsers()
+	require.Len(t, infos, 1)
+	require.Equal(t, "Phone", infos[0].Slot)
+}
+
+func TestCombinedUserRemovedOnSecondaryAddressDisconnect(t *testing.T) {
+	ib := newIMAPBackend(listener.New(), newTestSettings(t, t.TempDir()), nil)
+
+	// Logged in via a secondary address; the user is stored under both.
+	user := &imapUser{backend: ib, userID: "userID", currentAddressLowercase: "user@pm.me"}
+	require.Equal(t, user, ib.addUser("alias@pm.me", user))
+
+	// A login via another address of the combined user keeps the loaded user.
+	other := &imapUser{backend: ib, userID: "userID", currentAddressLowercase: "user@pm.me"}
+	require.Equal(t, user, ib.addUser("other@pm.me", other))
+
+	require.Len(t, ib.users, 3)
+	require.Len(t, ib.ActiveUsers(), 1)
+	require.Equal(t, 1, ib.Stats().Users)
+
+	ch := make(chan string, 1)
+	ch <- "Alias@PM.me"
+	close(ch)
+	ib.processDisconnections(ch)
+
+	require.Empty(t, ib.users)
+}
+
+func TestReportLoginWarning(t *testing.T) {
+	ib := &imapBackend{eventListener: listener.New()}
+
+	warnings := make(chan string, 1)
+	ib.eventListener.Add(events.LoginWarningEvent, warnings)
+
+	ib.reportLoginWarning("user@pm.me", "")
+	ib.reportLoginWarning("user@pm.me", "API session expires in 1m0s")
+
+	select {
+	case warning := <-warnings:
+		require.Equal(t, "user@pm.me: API session expires in 1m0s", warning)
+	case <-time.After(time.Second):
+		require.Fail(t, "login warning event was not emitted")
+	}
+
+	select {
+	case warning := <-warnings:
+		require.Fail(t, "unexpected login warning", warning)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// fakeUserStore is a store which does nothing, for users brought online in tests.
+type fakeUserStore struct{}
+
+func (fakeUserStore) Close() error                                    { return nil }
+func (fakeUserStore) CloseEventLoopAndCacher()                        {}
+func (fakeUserStore) GetAddressID(address string) (string, error)     { return "addressID", nil }
+func (fakeUserStore) PauseEventLoop()                                 {}
+func (fakeUserStore) Remove() error                                   { return nil }
+func (fakeUserStore) RemoveCache() error                              { return nil }
+func (fakeUserStore) Resync() error                                   { return nil }
+func (fakeUserStore) ResumeEventLoop()                                {}
+func (fakeUserStore) SetChangeNotifier(notifier store.ChangeNotifier) {}
+func (fakeUserStore) StartWatcher()                                   {}
+func (fakeUserStore) UnlockCache(kr *crypto.KeyRing) error            { return nil }
+
+func TestLoginWithSessionNearExpiry(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ib, credStorer, creds, password := newCredentialsTestBackend(t, ctrl)
+
+	fakeClock := clock.NewFake(time.Now())
+	ib.clock = fakeClock
+	ib.eventListener = listener.New()
+	ib.updates = newIMAPUpdates()
+
+	warnings := make(chan string, 1)
+	ib.eventListener.Add(events.LoginWarningEvent, warnings)
+
+	manager := pmapimocks.NewMockManager(ctrl)
+	client := pmapimocks.NewMockClient(ctrl)
+	storeMaker := usersmocks.NewMockStoreMaker(ctrl)
+
+	credStorer.EXPECT().List().Return([]string{"user"}, nil)
+	credStorer.EXPECT().Get("user").Return(creds, nil)
+	ib.usersMgr = users.New(listener.New(), manager, credStorer, storeMaker)
+
+	// Bring the user online with a session which ends in a minute.
+	manager.EXPECT().NewClientWithRefresh(gomock.Any(), "uid", "acc").Return(client, &pmapi.AuthRefresh{UID: "uid"}, nil)
+	credStorer.EXPECT().UpdateToken("user", "uid", "").Return(creds, nil)
+	client.EXPECT().AddAuthRefreshHandler(gomock.Any())
+	client.EXPECT().IsUnlocked().Return(true).AnyTimes()
+	storeMaker.EXPECT().New(gomock.Any(), true).Return(fakeUserStore{}, nil)
+	client.EXPECT().GetUserKeyRing().Return(nil, nil)
+	client.EXPECT().GetUser(gomock.Any()).Return(&pmapi.User{}, nil)
+	client.EXPECT().SessionExpiry().Return(fakeClock.Now().Add(time.Minute))
+
+	user, err := ib.usersMgr.GetUser("user@pm.me")
+	require.NoError(t, err)
+	require.NoError(t, user.BringOnline("main", password))
+	ib.users["user@pm.me"] = &imapUser{backend: ib, user: user, userID: "user", currentAddressLowercase: "user@pm.me"}
+
+	session, err := ib.Login(nil, "user@pm.me", password)
+	require.NoError(t, err)
+	require.NotNil(t, session)
+
+	select {
+	case warning := <-warnings:
+		require.Equal(t, "user@pm.me: API session expires in 1m0s", warning)
+	case <-time.After(time.Second):
+		require.Fail(t, "login warning event was not emitted")
+	}
+}
+
+func TestSetLoginsEnabled(t *testing.T) {
+	// No users manager: a disabled login must not get as far as looking up the user.
+	ib := &imapBackend{
+		users:       map[string]*imapUser{},
+		usersLocker: &sync.Mutex{},
+	}
+
+	ib.usersLocker.Lock()
+	ib.users["user@pm.me"] = &imapUser{backend: ib, userID: "userID", currentAddressLowercase: "user@pm.me"}
+	ib.usersLocker.Unlock()
+
+	ib.SetLoginsEnabled(false)
+
+	user, err := ib.Login(nil, "user@pm.me", "pass")
+	require.ErrorIs(t, err, ErrLoginsDisabled)
+	require.Nil(t, user)
+	require.Len(t, ib.ActiveUsers(), 1, "existing sessions must be kept")
+
+	ib.SetLoginsEnabled(true)
+	require.Zero(t, ib.loginsDisabled)
+}
+
+type testOnlineUser struct {
+	online                bool
+	slow                  bool
+	bringOnlineErr        error
+	onlineCalls, offlines int
+}
+
+func (u *testOnlineUser) IsOnline() bool { return u.online }
+
+func (u *testOnlineUser) BringOnlineCtx(ctx context.Context, slot, password string) error {
+	u.onlineCalls++
+	if u.slow {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if u.bringOnlineErr != nil {
+		return u.bringOnlineErr
+	}
+	u.online = true
+	return nil
+}
+
+func (u *testOnlineUser) BringOffline() error {
+	u.offlines++
+	u.online = false
+	return nil
+}
+
+func TestWithOnlineUserBringsOfflineOnFailure(t *testing.T) {
+	errCreate := errors.New("cannot create IMAP user")
+
+	user := &testOnlineUser{}
+	err := withOnlineUser(context.Background(), user, "main", "pass", func() error { return errCreate })
+	require.ErrorIs(t, err, errCreate)
+	require.Equal(t, 1, user.onlineCalls)
+	require.Equal(t, 1, user.offlines)
+	require.False(t, user.online)
+}
+
+func TestWithOnlineUserKeepsUserOnline(t *testing.T) {
+	errCreate := errors.New("cannot create IMAP user")
+
+	// Success leaves the freshly onlined user online.
+	user := &testOnlineUser{}
+	require.NoError(t, withOnlineUser(context.Background(), user, "main", "pass", func() error { return nil }))
+	require.Equal(t, 0, user.offlines)
+	require.True(t, user.online)
+
+	// A user that was online already, e.g. for SMTP, is left alone.
+	require.ErrorIs(t, withOnlineUser(context.Background(), user, "main", "pass", func() error { return errCreate }), errCreate)
+	require.Equal(t, 0, user.offlines)
+
+	// Nothing to undo when BringOnline itself fails.
+	user = &testOnlineUser{bringOnlineErr: errCreate}
+	called := false
+	require.ErrorIs(t, withOnlineUser(context.Background(), user, "main", "pass", func() error { called = true; return nil }), errCreate)
+	require.False(t, called)
+	require.Equal(t, 0, user.offlines)
+}
+
+func TestWithOnlineUserCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	user := &testOnlineUser{slow: true}
+	start := time.Now()
+	err := withOnlineUser(ctx, user, "main", "pass", func() error { return nil })
+	require.ErrorIs(t, err, context.Canceled)
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+	require.Equal(t, 0, user.offlines)
+}
+
+func TestTimeOpLogsSlowOperation(t *testing.T) {
+	hook := logtest.NewLocal(log.Logger)
+	defer log.Logger.ReplaceHooks(logrus.LevelHooks{})
+
+	clk := clock.NewFake(time.Now())
+	ib := &imapBackend{clock: clk, slowOpThreshold: time.Second}
+
+	done := ib.timeOp("login", logrus.Fields{"address": "user@pm.me"})
+	clk.Advance(500 * time.Millisecond)
+	done()
+	require.Empty(t, hook.AllEntries())
+
+	done = ib.timeOp("login", logrus.Fields{"address": "user@pm.me"})
+	clk.Advance(2 * time.Second)
+	done()
+
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	require.Equal(t, logrus.WarnLevel, entry.Level)
+	require.Equal(t, "login", entry.Data["op"])
+	require.Equal(t, "user@pm.me", entry.Data["address"])
+	require.Equal(t, 2*time.Second, entry.Data["elapsed"])
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"context"
+
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+	"github.com/ljanyst/peroxide/pkg/store"
+)
+
+// warmCacheMessages is the number of the most recent messages of a mailbox
+// which WarmCache builds.
+const warmCacheMessages = 50
+
+// warmableMailbox is the part of store.Mailbox which warming needs.
+type warmableMailbox interface {
+	GetCounts() (total, unread, unseenSeqNum uint, err error)
+	GetAPIIDsFromSequenceRange(start, stop uint32) ([]string, error)
+}
+
+// WarmCache builds and caches the most recent messages of the mailbox of the
+// logged in address in the background, expecting the client to fetch them
+// next. It is called whenever a client selects a mailbox.
+// It is a no-op unless settings.IMAPCacheWarming is enabled. The messages are
+// built with background priority, so the number of builds running at once is
+// capped by the builder.
+func (ib *imapBackend) WarmCache(address, mailbox string) {
+	if !ib.isCacheWarmingEnabled() {
+		return
+	}
+
+	ib.usersLocker.Lock()
+	imapUser, ok := ib.users[normalizeAddress(address)]
+	ib.usersLocker.Unlock()
+
+	if !ok {
+		return
+	}
+
+	storeMailbox, err := imapUser.storeAddress.GetMailbox(mailbox)
+	if err != nil {
+		log.WithField("mailbox", mailbox).WithError(err).Debug("Cannot warm cache of unknown mailbox")
+		return
+	}
+
+	jobs := ib.warmMailbox(imapUser.storeUser, storeMailbox)
+	log.WithField("address", address).WithField("mailbox", mailbox).WithField("jobs", jobs).Debug("Warming cache")
+}
+
+func (ib *imapBackend) isCacheWarmingEnabled() bool {
+	return ib.setting != nil && ib.setting.GetBool(settings.IMAPCacheWarming)
+}
+
+// warmMailbox starts building the most recent messages of the mailbox and
+// returns how many builds were started.
+func (ib *imapBackend) warmMailbox(storer store.Storer, mailbox warmableMailbox) int {
+	if !ib.isCacheWarmingEnabled() {
+		return 0
+	}
+
+	total, _, _, err := mailbox.GetCounts()
+	if err != nil || total == 0 {
+		return 0
+	}
+
+	start := uint(1)
+	if total > warmCacheMessages {
+		start = total - warmCacheMessages + 1
+	}
+
+	messageIDs, err := mailbox.GetAPIIDsFromSequenceRange(uint32(start), uint32(total))
+	if err != nil {
+		log.WithError(err).Warn("Cannot list messages to warm cache")
+		return 0
+	}
+
+	return ib.warmMessages(storer, messageIDs)
+}
+
+// warmMessages starts building the messages which are not cached yet and
+// returns how many builds were started.
+func (ib *imapBackend) warmMessages(storer store.Storer, messageIDs []string) int {
+	jobs := 0
+
+	for _, messageID := range messageIDs {
+		if storer.IsCached(messageID) {
+			continue
+		}
+
+		jobs++
+
+		go func(messageID string) {
+			if err := storer.BuildAndCacheMessage(context.Background(), messageID); err != nil {
+				log.WithError(err).WithField("messageID", messageID).Warn("Failed to warm cache")
+			}
+		}(messageID)
+	}
+
+	return jobs
+}
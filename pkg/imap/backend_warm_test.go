@@ -0,0 +1,123 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeStorer struct {
+	cached map[string]bool
+	built  chan string
+}
+
+func (s *fakeStorer) IsCached(messageID string) bool {
+	return s.cached[messageID]
+}
+
+func (s *fakeStorer) BuildAndCacheMessage(_ context.Context, messageID string) error {
+	s.built <- messageID
+	return nil
+}
+
+func TestWarmMessagesBuildsUncached(t *testing.T) {
+	ib := &imapBackend{}
+	storer := &fakeStorer{cached: map[string]bool{"msg2": true}, built: make(chan string, 3)}
+
+	require.Equal(t, 2, ib.warmMessages(storer, []string{"msg1", "msg2", "msg3"}))
+
+	built := []string{<-storer.built, <-storer.built}
+	sort.Strings(built)
+	require.Equal(t, []string{"msg1", "msg3"}, built)
+}
+
+type fakeWarmableMailbox struct {
+	messageIDs []string
+}
+
+func (m *fakeWarmableMailbox) GetCounts() (uint, uint, uint, error) {
+	return uint(len(m.messageIDs)), 0, 0, nil
+}
+
+func (m *fakeWarmableMailbox) GetAPIIDsFromSequenceRange(start, stop uint32) ([]string, error) {
+	return m.messageIDs[start-1 : stop], nil
+}
+
+func TestWarmMailboxEnabled(t *testing.T) {
+	ib := newIMAPBackend(listener.New(), newTestSettings(t, t.TempDir(), settings.IMAPCacheWarming+": true"), nil)
+	storer := &fakeStorer{cached: map[string]bool{"msg1": true}, built: make(chan string, 2)}
+	mailbox := &fakeWarmableMailbox{messageIDs: []string{"msg1", "msg2", "msg3"}}
+
+	require.Equal(t, 2, ib.warmMailbox(storer, mailbox))
+
+	built := []string{<-storer.built, <-storer.built}
+	sort.Strings(built)
+	require.Equal(t, []string{"msg2", "msg3"}, built)
+}
+
+func TestWarmMailboxOnlyMostRecent(t *testing.T) {
+	ib := newIMAPBackend(listener.New(), newTestSettings(t, t.TempDir(), settings.IMAPCacheWarming+": true"), nil)
+	storer := &fakeStorer{built: make(chan string, warmCacheMessages)}
+
+	mailbox := &fakeWarmableMailbox{}
+	for i := 0; i < warmCacheMessages+10; i++ {
+		mailbox.messageIDs = append(mailbox.messageIDs, fmt.Sprintf("msg%d", i))
+	}
+
+	require.Equal(t, warmCacheMessages, ib.warmMailbox(storer, mailbox))
+}
+
+func TestWarmMailboxDisabled(t *testing.T) {
+	ib := newIMAPBackend(listener.New(), newTestSettings(t, t.TempDir(), settings.IMAPCacheWarming+": false"), nil)
+	storer := &fakeStorer{built: make(chan string, 1)}
+
+	require.Equal(t, 0, ib.warmMailbox(storer, &fakeWarmableMailbox{messageIDs: []string{"msg1"}}))
+	require.Empty(t, storer.built)
+}
+
+func TestWarmCacheDisabled(t *testing.T) {
+	ib := newIMAPBackend(listener.New(), newTestSettings(t, t.TempDir(), settings.IMAPCacheWarming+": false"), nil)
+
+	// The user has no store: warming it would panic.
+	ib.usersLocker.Lock()
+	ib.users["user@pm.me"] = &imapUser{backend: ib, currentAddressLowercase: "user@pm.me"}
+	ib.usersLocker.Unlock()
+
+	require.NotPanics(t, func() { ib.WarmCache("user@pm.me", "INBOX") })
+}
+
+func TestSelectExtensionOverridesSelect(t *testing.T) {
+	ext := selectExtension{}
+
+	sel, ok := ext.Command("SELECT")().(*selectHandler)
+	require.True(t, ok)
+	require.False(t, sel.ReadOnly)
+
+	examineHandler, ok := ext.Command("EXAMINE")().(*selectHandler)
+	require.True(t, ok)
+	require.True(t, examineHandler.ReadOnly)
+
+	require.Nil(t, ext.Command("FETCH"))
+}
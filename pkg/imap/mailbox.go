@@ -56,6 +56,14 @@ func newIMAPMailbox(user *imapUser, storeMailbox *store.Mailbox) *imapMailbox {
 	}
 }
 
+// warmCache starts building the most recent messages of the mailbox in the
+// background if cache warming is enabled, see imapBackend.WarmCache.
+func (im *imapMailbox) warmCache() {
+	if jobs := im.user.backend.warmMailbox(im.storeUser, im.storeMailbox); jobs > 0 {
+		im.log.WithField("jobs", jobs).Debug("Warming cache")
+	}
+}
+
 // logCommand is helper to log commands requested by IMAP client with their
 // params, result, and duration, but without private data.
 // It's logged as INFO so it's logged for every user by default. This should
@@ -92,26 +100,7 @@ func (im *imapMailbox) Info() (*imap.MailboxInfo, error) {
 }
 
 func (im *imapMailbox) getFlags() []string {
-	flags := []string{}
-	if !im.storeMailbox.IsFolder() || im.storeMailbox.IsSystem() {
-		flags = append(flags, imap.NoInferiorsAttr) // Subfolders are not supported for System or Label
-	}
-	switch im.storeMailbox.LabelID() {
-	case pmapi.SentLabel:
-		flags = append(flags, imap.SentAttr)
-	case pmapi.TrashLabel:
-		flags = append(flags, imap.TrashAttr)
-	case pmapi.SpamLabel:
-		flags = append(flags, imap.JunkAttr)
-	case pmapi.ArchiveLabel:
-		flags = append(flags, imap.ArchiveAttr)
-	case pmapi.AllMailLabel:
-		flags = append(flags, imap.AllAttr)
-	case pmapi.DraftLabel:
-		flags = append(flags, imap.DraftsAttr)
-	}
-
-	return flags
+	return im.user.backend.mailboxAttributes(im.storeMailbox, im.name)
 }
 
 // Status returns this mailbox status. The fields Name, Flags and
@@ -168,6 +157,7 @@ func (im *imapMailbox) SetSubscribed(subscribed bool) error {
 	if !subscribed && im.user.isSubscribed(label) {
 		im.user.addToCache(SubscriptionException, label)
 	}
+	im.user.backend.updates.setSubscribed(im.user.currentAddressLowercase, im.name, subscribed)
 	return nil
 }
 
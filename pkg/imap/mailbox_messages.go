@@ -518,6 +518,11 @@ func (im *imapMailbox) SearchMessages(isUID bool, criteria *imap.SearchCriteria)
 //
 // Messages must be sent to msgResponse. When the function returns, msgResponse must be closed.
 func (im *imapMailbox) ListMessages(isUID bool, seqSet *imap.SeqSet, items []imap.FetchItem, msgResponse chan<- *imap.Message) error {
+	defer im.user.backend.timeOp("fetch", logrus.Fields{
+		"address": im.user.currentAddressLowercase,
+		"labelID": im.storeMailbox.LabelID(),
+	})()
+
 	return im.logCommand(func() error {
 		return im.listMessages(isUID, seqSet, items, msgResponse)
 	}, "FETCH", isUID, seqSet, items)
@@ -533,7 +538,7 @@ func (im *imapMailbox) listMessages(isUID bool, seqSet *imap.SeqSet, items []ima
 
 	// We always report the sent folder as empty in the BCC self mode because
 	// the sent messages will appear in different folders
-	if im.user.backend.bccSelf && im.storeMailbox.LabelID() == pmapi.SentLabel {
+	if im.user.bccSelf && im.storeMailbox.LabelID() == pmapi.SentLabel {
 		return nil
 	}
 
@@ -0,0 +1,102 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+)
+
+// ErrInvalidSpecialUse is returned for malformed SPECIAL-USE mapping entries.
+var ErrInvalidSpecialUse = errors.New("invalid special-use mapping")
+
+// specialUseAttrs are the SPECIAL-USE attributes (RFC 6154) which can be
+// configured, keyed by their lowercase name without the backslash.
+var specialUseAttrs = map[string]string{ //nolint[gochecknoglobals]
+	"all":     imap.AllAttr,
+	"archive": imap.ArchiveAttr,
+	"drafts":  imap.DraftsAttr,
+	"flagged": imap.FlaggedAttr,
+	"junk":    imap.JunkAttr,
+	"sent":    imap.SentAttr,
+	"trash":   imap.TrashAttr,
+}
+
+// defaultSpecialUse maps the system labels to their SPECIAL-USE attributes.
+func defaultSpecialUse() map[string]string {
+	return map[string]string{
+		pmapi.SentLabel:    imap.SentAttr,
+		pmapi.TrashLabel:   imap.TrashAttr,
+		pmapi.SpamLabel:    imap.JunkAttr,
+		pmapi.ArchiveLabel: imap.ArchiveAttr,
+		pmapi.AllMailLabel: imap.AllAttr,
+		pmapi.DraftLabel:   imap.DraftsAttr,
+	}
+}
+
+// ParseSpecialUse parses a comma-separated list of label=attribute entries,
+// e.g. "Folders/Receipts=Archive, 6=". The label is a label ID or a mailbox
+// name and the attribute is a SPECIAL-USE name such as Sent or \Sent.
+// An empty attribute removes the label from the mapping. The entries are
+// applied on top of the defaults for the system labels.
+func ParseSpecialUse(value string) (map[string]string, error) {
+	mapping := defaultSpecialUse()
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		idx := strings.LastIndex(entry, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("%w: %q is not label=attribute", ErrInvalidSpecialUse, entry)
+		}
+
+		label := strings.TrimSpace(entry[:idx])
+		name := strings.TrimSpace(entry[idx+1:])
+
+		if name == "" {
+			delete(mapping, label)
+			continue
+		}
+
+		attr, ok := specialUseAttrs[strings.ToLower(strings.TrimPrefix(name, `\`))]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown attribute %q", ErrInvalidSpecialUse, name)
+		}
+
+		mapping[label] = attr
+	}
+
+	return mapping, nil
+}
+
+// specialUseAttr returns the SPECIAL-USE attribute of the mailbox or "" if it
+// has none. An entry for the mailbox name takes precedence over its label ID.
+func (ib *imapBackend) specialUseAttr(labelID, name string) string {
+	if attr, ok := ib.specialUse[name]; ok {
+		return attr
+	}
+
+	return ib.specialUse[labelID]
+}
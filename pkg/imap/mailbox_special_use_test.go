@@ -0,0 +1,73 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSpecialUseDefaults(t *testing.T) {
+	mapping, err := ParseSpecialUse("")
+	require.NoError(t, err)
+	require.Equal(t, defaultSpecialUse(), mapping)
+	require.Equal(t, imap.SentAttr, mapping[pmapi.SentLabel])
+	require.Equal(t, imap.JunkAttr, mapping[pmapi.SpamLabel])
+}
+
+func TestParseSpecialUse(t *testing.T) {
+	mapping, err := ParseSpecialUse(`Folders/Receipts=Archive, Folders/Old=\trash, 5=`)
+	require.NoError(t, err)
+
+	require.Equal(t, imap.ArchiveAttr, mapping["Folders/Receipts"])
+	require.Equal(t, imap.TrashAttr, mapping["Folders/Old"])
+	require.NotContains(t, mapping, pmapi.AllMailLabel)
+	require.Equal(t, imap.SentAttr, mapping[pmapi.SentLabel], "other defaults are kept")
+}
+
+func TestParseSpecialUseInvalid(t *testing.T) {
+	for _, value := range []string{"Sent", "=Sent", "Folders/Receipts=Receipts"} {
+		_, err := ParseSpecialUse(value)
+		require.ErrorIs(t, err, ErrInvalidSpecialUse, value)
+	}
+}
+
+func TestSpecialUseAttrFromSettings(t *testing.T) {
+	setting := newTestSettings(t, t.TempDir(), settings.IMAPSpecialUse+": Folders/Receipts=Archive, Archive=Junk")
+	ib := newIMAPBackend(listener.New(), setting, nil)
+
+	require.Equal(t, imap.ArchiveAttr, ib.specialUseAttr("labelID", "Folders/Receipts"))
+	require.Equal(t, imap.JunkAttr, ib.specialUseAttr(pmapi.ArchiveLabel, "Archive"), "name takes precedence over label ID")
+	require.Equal(t, imap.SentAttr, ib.specialUseAttr(pmapi.SentLabel, "Sent"))
+	require.Equal(t, "", ib.specialUseAttr(pmapi.InboxLabel, "INBOX"))
+}
+
+func TestNewIMAPBackendCheckedInvalidSpecialUse(t *testing.T) {
+	setting := newTestSettings(t, t.TempDir(), settings.IMAPSpecialUse+": Folders/Receipts=Receipts")
+
+	_, err := NewIMAPBackendChecked(listener.New(), setting, nil)
+	require.ErrorIs(t, err, ErrInvalidSpecialUse)
+
+	ib := newIMAPBackend(listener.New(), setting, nil)
+	require.Equal(t, defaultSpecialUse(), ib.specialUse)
+}
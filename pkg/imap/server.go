@@ -23,6 +23,7 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap"
@@ -33,6 +34,7 @@ import (
 	"github.com/emersion/go-imap/backend"
 	imapserver "github.com/emersion/go-imap/server"
 	"github.com/emersion/go-sasl"
+	"github.com/ljanyst/peroxide/pkg/events"
 	"github.com/ljanyst/peroxide/pkg/imap/idle"
 	"github.com/ljanyst/peroxide/pkg/imap/uidplus"
 	"github.com/ljanyst/peroxide/pkg/listener"
@@ -45,9 +47,16 @@ type Server struct {
 	debugServer bool
 	address     string
 	port        int
+	useSSL      bool
 
 	server     *imapserver.Server
 	controller serverutil.Controller
+
+	eventListener listener.Listener
+
+	// closeRevokedSessions is closed to stop the monitor of revoked sessions.
+	closeRevokedSessions     chan struct{}
+	closeRevokedSessionsOnce *sync.Once
 }
 
 // NewIMAPServer constructs a new IMAP server configured with the given options.
@@ -55,6 +64,7 @@ func NewIMAPServer(
 	debugClient, debugServer bool,
 	address string,
 	port int,
+	useSSL bool,
 	tls *tls.Config,
 	imapBackend backend.Backend,
 	eventListener listener.Listener,
@@ -64,6 +74,11 @@ func NewIMAPServer(
 		debugServer: debugServer,
 		address:     address,
 		port:        port,
+		useSSL:      useSSL,
+
+		eventListener:            eventListener,
+		closeRevokedSessions:     make(chan struct{}),
+		closeRevokedSessionsOnce: &sync.Once{},
 	}
 
 	server.server = newGoIMAPServer(tls, imapBackend, server.Address())
@@ -81,7 +96,7 @@ func newGoIMAPServer(tls *tls.Config, backend backend.Backend, address string) *
 
 	server.EnableAuth(sasl.Login, func(conn imapserver.Conn) sasl.Server {
 		return sasl.NewLoginServer(func(address, password string) error {
-			user, err := conn.Server().Backend.Login(nil, address, password)
+			user, err := conn.Server().Backend.Login(conn.Info(), address, password)
 			if err != nil {
 				return err
 			}
@@ -100,21 +115,60 @@ func newGoIMAPServer(tls *tls.Config, backend backend.Backend, address string) *
 		imapappendlimit.NewExtension(),
 		imapunselect.NewExtension(),
 		uidplus.NewExtension(),
+		selectExtension{},
 	)
 
 	return server
 }
 
 // ListenAndServe will run server and all monitors.
-func (s *Server) ListenAndServe() { s.controller.ListenAndServe() }
+func (s *Server) ListenAndServe() {
+	ch := make(chan string)
+	s.eventListener.Add(events.CloseSessionEvent, ch)
+	go s.monitorRevokedSessions(ch)
+
+	s.controller.ListenAndServe()
+}
+
+// Close turns off server and monitors. Logins in flight are canceled if the
+// backend supports it.
+func (s *Server) Close() {
+	if closer, ok := s.server.Backend.(interface{ Close() }); ok {
+		closer.Close()
+	}
+
+	s.stopMonitoringRevokedSessions()
+	s.controller.Close()
+}
 
-// Close turns off server and monitors.
-func (s *Server) Close() { s.controller.Close() }
+// stopMonitoringRevokedSessions stops the monitor of revoked sessions, also
+// when it was never started. It can be called more than once.
+func (s *Server) stopMonitoringRevokedSessions() {
+	s.closeRevokedSessionsOnce.Do(func() {
+		close(s.closeRevokedSessions)
+	})
+}
+
+// monitorRevokedSessions closes the connections of sessions revoked by the
+// backend, which are received on ch. The channel is removed from the event
+// listener once the monitor is stopped, so that later events do not block.
+func (s *Server) monitorRevokedSessions(ch chan string) {
+	defer s.eventListener.Remove(events.CloseSessionEvent, ch)
+
+	for {
+		select {
+		case <-s.closeRevokedSessions:
+			return
+		case id := <-ch:
+			s.DisconnectSession(id)
+		}
+	}
+}
 
 // Implements serverutil.Server interface.
 
 func (Server) Protocol() serverutil.Protocol { return serverutil.IMAP }
-func (s *Server) UseSSL() bool               { return false }
+func (s *Server) UseSSL() bool               { return s.useSSL }
 func (s *Server) Address() string            { return fmt.Sprintf("%s:%d", s.address, s.port) }
 func (s *Server) TLSConfig() *tls.Config     { return s.server.TLSConfig }
 
@@ -137,5 +191,18 @@ func (s *Server) DisconnectUser(address string) {
 	})
 }
 
+// DisconnectSession closes the connection of the session with the given ID.
+func (s *Server) DisconnectSession(id string) {
+	s.server.ForEachConn(func(conn imapserver.Conn) {
+		session, ok := conn.Context().User.(*imapSession)
+		if ok && session.id == id {
+			log.WithField("session", id).Info("Disconnecting revoked IMAP session")
+			if err := conn.Close(); err != nil {
+				log.WithError(err).Error("Failed to close the connection")
+			}
+		}
+	})
+}
+
 func (s *Server) Serve(listener net.Listener) error { return s.server.Serve(listener) }
 func (s *Server) StopServe() error                  { return s.server.Close() }
@@ -0,0 +1,61 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// selectExtension overrides SELECT and EXAMINE to warm the cache of the
+// selected mailbox, see imapBackend.WarmCache.
+type selectExtension struct{}
+
+func (selectExtension) Capabilities(imapserver.Conn) []string {
+	return nil
+}
+
+func (selectExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "SELECT":
+		return func() imapserver.Handler {
+			return &selectHandler{}
+		}
+	case "EXAMINE":
+		return func() imapserver.Handler {
+			handler := &selectHandler{}
+			handler.ReadOnly = true
+			return handler
+		}
+	}
+	return nil
+}
+
+type selectHandler struct {
+	imapserver.Select
+}
+
+func (cmd *selectHandler) Handle(conn imapserver.Conn) error {
+	err := cmd.Select.Handle(conn)
+
+	// The mailbox is set only when the selection succeeded.
+	if mailbox, ok := conn.Context().Mailbox.(*imapMailbox); ok {
+		go mailbox.warmCache()
+	}
+
+	return err
+}
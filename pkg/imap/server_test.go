@@ -0,0 +1,72 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ljanyst/peroxide/pkg/events"
+	usersmocks "github.com/ljanyst/peroxide/pkg/users/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonitorRevokedSessionsRemovesListener(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	eventListener := usersmocks.NewMockListener(ctrl)
+	s := &Server{eventListener: eventListener, closeRevokedSessions: make(chan struct{}), closeRevokedSessionsOnce: &sync.Once{}}
+
+	ch := make(chan string)
+	removed := make(chan struct{})
+	eventListener.EXPECT().Remove(events.CloseSessionEvent, gomock.Any()).Do(func(_ string, got chan<- string) {
+		require.Equal(t, (chan<- string)(ch), got)
+		close(removed)
+	})
+
+	go s.monitorRevokedSessions(ch)
+
+	// Stopping twice must not block nor panic.
+	s.stopMonitoringRevokedSessions()
+	s.stopMonitoringRevokedSessions()
+
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		require.Fail(t, "listener channel was not removed")
+	}
+}
+
+func TestStopMonitoringRevokedSessionsNeverStarted(t *testing.T) {
+	s := &Server{closeRevokedSessions: make(chan struct{}), closeRevokedSessionsOnce: &sync.Once{}}
+
+	done := make(chan struct{})
+	go func() {
+		s.stopMonitoringRevokedSessions()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail(t, "stopping the monitor blocked")
+	}
+}
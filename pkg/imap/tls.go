@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+)
+
+// TLSMode selects how the IMAP listener negotiates TLS.
+type TLSMode string
+
+const (
+	// TLSModeSTARTTLS accepts cleartext connections and upgrades them with
+	// STARTTLS. This is the usual setup for port 143 and the default 1143.
+	TLSModeSTARTTLS TLSMode = "starttls"
+
+	// TLSModeImplicit wraps every connection in TLS from the first byte, as
+	// clients expect on port 993. STARTTLS is not offered in this mode.
+	TLSModeImplicit TLSMode = "implicit"
+)
+
+var (
+	// ErrUnknownTLSVersion is returned for TLS versions other than 1.0 to 1.3.
+	ErrUnknownTLSVersion = errors.New("unknown TLS version")
+
+	// ErrUnknownTLSMode is returned for TLS modes other than starttls and implicit.
+	ErrUnknownTLSMode = errors.New("unknown TLS mode")
+)
+
+// ParseTLSMode maps a settings value to a TLSMode. An empty string selects
+// STARTTLS to keep the historical behaviour.
+func ParseTLSMode(mode string) (TLSMode, error) {
+	switch TLSMode(strings.ToLower(strings.TrimSpace(mode))) {
+	case "", TLSModeSTARTTLS:
+		return TLSModeSTARTTLS, nil
+	case TLSModeImplicit:
+		return TLSModeImplicit, nil
+	}
+
+	return "", fmt.Errorf("%w: %q", ErrUnknownTLSMode, mode)
+}
+
+// UseSSL reports whether the listener itself has to be a TLS listener.
+func (mode TLSMode) UseSSL() bool {
+	return mode == TLSModeImplicit
+}
+
+// ParseTLSVersion maps a version string such as "1.2" to its tls constant.
+// An empty string yields 0, which keeps the crypto/tls default.
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+
+	return 0, fmt.Errorf("%w: %q", ErrUnknownTLSVersion, version)
+}
+
+// NewTLSConfig returns a copy of base adjusted by the IMAP TLS settings.
+func NewTLSConfig(base *tls.Config, setting *settings.Settings) (*tls.Config, error) {
+	minVersion, err := ParseTLSVersion(setting.Get(settings.IMAPTLSMinVersion))
+	if err != nil {
+		return nil, err
+	}
+
+	config := base.Clone()
+	config.MinVersion = minVersion
+
+	return config, nil
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	for version, want := range map[string]uint16{
+		"":    0,
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	} {
+		got, err := ParseTLSVersion(version)
+		require.NoError(t, err, version)
+		require.Equal(t, want, got, version)
+	}
+
+	for _, version := range []string{"1.4", "TLS1.2", "12"} {
+		_, err := ParseTLSVersion(version)
+		require.ErrorIs(t, err, ErrUnknownTLSVersion, version)
+	}
+}
+
+func TestParseTLSMode(t *testing.T) {
+	for mode, want := range map[string]TLSMode{
+		"":           TLSModeSTARTTLS,
+		"starttls":   TLSModeSTARTTLS,
+		"STARTTLS":   TLSModeSTARTTLS,
+		"implicit":   TLSModeImplicit,
+		" Implicit ": TLSModeImplicit,
+	} {
+		got, err := ParseTLSMode(mode)
+		require.NoError(t, err, mode)
+		require.Equal(t, want, got, mode)
+		require.Equal(t, want == TLSModeImplicit, got.UseSSL(), mode)
+	}
+
+	_, err := ParseTLSMode("ssl")
+	require.ErrorIs(t, err, ErrUnknownTLSMode)
+}
@@ -48,6 +48,16 @@ type imapUpdates struct {
 	delayedExpunges map[string][]chan struct{}
 	chout           chan goIMAPBackend.Update
 	chin            chan updateHelper
+
+	// subscribedOnly suppresses the mailbox list updates of mailboxes in
+	// unsubscribed, see isSuppressed. The filter works per address, not per
+	// connection: subscriptions are stored with the account, so an update is
+	// suppressed for all sessions of the address alike. unsubscribed is keyed by lowercase address and then
+	// by lowercase mailbox name. The names follow renames and deletions made
+	// over IMAP and are rebuilt from the label IDs on every login, which picks
+	// up renames made elsewhere.
+	subscribedOnly bool
+	unsubscribed   map[string]map[string]bool
 }
 
 func newIMAPUpdates() *imapUpdates {
@@ -57,6 +67,7 @@ func newIMAPUpdates() *imapUpdates {
 		delayedExpunges: map[string][]chan struct{}{},
 		chout:           make(chan goIMAPBackend.Update),
 		chin:            make(chan updateHelper, 1000),
+		unsubscribed:    map[string]map[string]bool{},
 	}
 
 	go func() {
@@ -104,6 +115,81 @@ func getBlockingKey(address, mailboxName string, op operation) string {
 	return strings.ToLower(address + "_" + mailboxName + "_" + string(op))
 }
 
+// setSubscribedOnly switches the suppression of updates of unsubscribed mailboxes.
+func (iu *imapUpdates) setSubscribedOnly(subscribedOnly bool) {
+	iu.lock.Lock()
+	defer iu.lock.Unlock()
+
+	iu.subscribedOnly = subscribedOnly
+}
+
+func (iu *imapUpdates) isSubscribedOnly() bool {
+	iu.lock.Lock()
+	defer iu.lock.Unlock()
+
+	return iu.subscribedOnly
+}
+
+// setSubscribed records whether the address is subscribed to the mailbox.
+// Mailboxes are subscribed unless recorded otherwise.
+func (iu *imapUpdates) setSubscribed(address, mailboxName string, subscribed bool) {
+	iu.lock.Lock()
+	defer iu.lock.Unlock()
+
+	address, mailboxName = strings.ToLower(address), strings.ToLower(mailboxName)
+
+	if subscribed {
+		delete(iu.unsubscribed[address], mailboxName)
+		return
+	}
+
+	if iu.unsubscribed[address] == nil {
+		iu.unsubscribed[address] = map[string]bool{}
+	}
+	iu.unsubscribed[address][mailboxName] = true
+}
+
+// renameSubscription moves the subscription state of the mailbox of the
+// address to its new name.
+func (iu *imapUpdates) renameSubscription(address, oldName, newName string) {
+	iu.lock.Lock()
+	defer iu.lock.Unlock()
+
+	address, oldName, newName = strings.ToLower(address), strings.ToLower(oldName), strings.ToLower(newName)
+
+	if !iu.unsubscribed[address][oldName] {
+		return
+	}
+
+	delete(iu.unsubscribed[address], oldName)
+	iu.unsubscribed[address][newName] = true
+}
+
+// resetSubscriptions forgets the subscription state of all mailboxes of the address.
+func (iu *imapUpdates) resetSubscriptions(address string) {
+	iu.lock.Lock()
+	defer iu.lock.Unlock()
+
+	delete(iu.unsubscribed, strings.ToLower(address))
+}
+
+// isSuppressed returns whether the update is not sent because it lists an
+// unsubscribed mailbox. Only mailbox list updates are suppressed: message
+// updates (FETCH, EXPUNGE, EXISTS) reach just the connections which have the
+// mailbox selected and keep their sequence numbers in sync, so they are sent
+// whether the mailbox is subscribed or not.
+func (iu *imapUpdates) isSuppressed(update goIMAPBackend.Update) bool {
+	infoUpdate, ok := update.(*goIMAPBackend.MailboxInfoUpdate)
+	if !ok || infoUpdate.MailboxInfo == nil {
+		return false
+	}
+
+	iu.lock.Lock()
+	defer iu.lock.Unlock()
+
+	return iu.subscribedOnly && iu.unsubscribed[strings.ToLower(update.Username())][strings.ToLower(infoUpdate.MailboxInfo.Name)]
+}
+
 func (iu *imapUpdates) forbidExpunge(mailboxID string) {
 	iu.lock.Lock()
 	defer iu.lock.Unlock()
@@ -223,6 +309,11 @@ func (iu *imapUpdates) sendIMAPUpdate(update goIMAPBackend.Update, isBlocking bo
 		return
 	}
 
+	if iu.isSuppressed(update) {
+		log.WithField("address", update.Username()).Trace("IMAP list update of unsubscribed mailbox suppressed")
+		return
+	}
+
 	done := update.Done()
 	iu.chin <- updateHelper{
 		data:       update,
@@ -21,6 +21,8 @@ import (
 	"testing"
 	"time"
 
+	goIMAPBackend "github.com/emersion/go-imap/backend"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/stretchr/testify/require"
 )
 
@@ -58,3 +60,95 @@ func TestUpdatesCannotDelete(t *testing.T) {
 
 	require.True(t, duration > 200*time.Millisecond)
 }
+
+// listedMailboxName returns the name of the mailbox listed by a mailbox info update.
+func listedMailboxName(update goIMAPBackend.Update) string {
+	return update.(*goIMAPBackend.MailboxInfoUpdate).MailboxInfo.Name
+}
+
+func TestUpdatesSubscribedOnly(t *testing.T) {
+	u := newIMAPUpdates()
+	u.setSubscribedOnly(true)
+	u.setSubscribed("user@pm.me", "INBOX", true)
+	u.setSubscribed("user@pm.me", "Folders/Other", false)
+
+	u.MailboxCreated("user@pm.me", "Folders/Other")
+	u.MailboxCreated("User@PM.me", "INBOX")
+
+	select {
+	case update := <-u.chout:
+		require.Equal(t, "INBOX", listedMailboxName(update))
+	case <-time.After(time.Second):
+		require.Fail(t, "update of subscribed mailbox was not delivered")
+	}
+
+	select {
+	case update := <-u.chout:
+		require.Fail(t, "unexpected update", listedMailboxName(update))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Subscribing again, or turning the filter off, delivers the updates.
+	u.setSubscribed("user@pm.me", "Folders/Other", true)
+	u.MailboxCreated("user@pm.me", "Folders/Other")
+	require.Equal(t, "Folders/Other", listedMailboxName(<-u.chout))
+
+	u.setSubscribed("user@pm.me", "Folders/Other", false)
+	u.setSubscribedOnly(false)
+	u.MailboxCreated("user@pm.me", "Folders/Other")
+	require.Equal(t, "Folders/Other", listedMailboxName(<-u.chout))
+}
+
+func TestUpdatesSubscribedOnlyKeepsSelectedMailboxInSync(t *testing.T) {
+	u := newIMAPUpdates()
+	u.setSubscribedOnly(true)
+	u.setSubscribed("user@pm.me", "Folders/Other", false)
+
+	// The message updates of an unsubscribed mailbox only reach connections
+	// which selected it, and are delivered to them.
+	go func() {
+		u.UpdateMessage("user@pm.me", "Folders/Other", 10, 1, &pmapi.Message{}, false)
+		u.DeleteMessage("user@pm.me", "Folders/Other", 1)
+		u.MailboxStatus("user@pm.me", "Folders/Other", 0, 0, 0)
+	}()
+
+	for _, want := range []interface{}{
+		&goIMAPBackend.MessageUpdate{},
+		&goIMAPBackend.ExpungeUpdate{},
+		&goIMAPBackend.MailboxUpdate{},
+	} {
+		select {
+		case update := <-u.chout:
+			require.IsType(t, want, update)
+			require.Equal(t, "Folders/Other", update.Mailbox())
+			close(update.Done())
+		case <-time.After(time.Second):
+			require.Fail(t, "update of selected mailbox was not delivered")
+		}
+	}
+}
+
+func TestUpdatesSubscriptionFollowsRename(t *testing.T) {
+	u := newIMAPUpdates()
+	u.setSubscribedOnly(true)
+	u.setSubscribed("user@pm.me", "Folders/Old", false)
+
+	u.renameSubscription("User@PM.me", "Folders/Old", "Folders/New")
+
+	// The renamed mailbox stays unsubscribed; a new mailbox with the old
+	// name is subscribed.
+	u.MailboxCreated("user@pm.me", "Folders/New")
+	u.MailboxCreated("user@pm.me", "Folders/Old")
+	require.Equal(t, "Folders/Old", listedMailboxName(<-u.chout))
+
+	select {
+	case update := <-u.chout:
+		require.Fail(t, "unexpected update", listedMailboxName(update))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Subscriptions are rebuilt on login after resetting them.
+	u.resetSubscriptions("user@pm.me")
+	u.MailboxCreated("user@pm.me", "Folders/New")
+	require.Equal(t, "Folders/New", listedMailboxName(<-u.chout))
+}
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"strings"
 	"sync"
+	"time"
 
 	imapquota "github.com/emersion/go-imap-quota"
 	goIMAPBackend "github.com/emersion/go-imap/backend"
@@ -32,11 +33,17 @@ import (
 type imapUser struct {
 	backend *imapBackend
 	user    *users.User
+	userID  string
+	bccSelf bool
+
+	// slot is the key slot of the most recent login; guarded by backend.usersLocker.
+	slot string
 
 	storeUser    *store.Store
 	storeAddress *store.Address
 
 	currentAddressLowercase string
+	createdAt               time.Time
 
 	// Some clients, for example Outlook, do MOVE by STORE \Deleted, APPEND,
 	// EXPUNGE where APPEN and EXPUNGE can go in parallel. Usual IMAP servers
@@ -78,11 +85,14 @@ func newIMAPUser(
 	return &imapUser{
 		backend: backend,
 		user:    user,
+		userID:  user.ID(),
+		bccSelf: backend.bccSelfFor(address),
 
 		storeUser:    storeUser,
 		storeAddress: storeAddress,
 
-		currentAddressLowercase: strings.ToLower(address),
+		currentAddressLowercase: normalizeAddress(address),
+		createdAt:               backend.clock.Now(),
 	}, err
 }
 
@@ -91,6 +101,20 @@ func (iu *imapUser) client() pmapi.Client {
 	return iu.user.GetClient()
 }
 
+// trackSubscriptions tells the updates which mailboxes of the user are
+// subscribed, see settings.IMAPUpdatesSubscribedOnly. Earlier state of the
+// address is dropped, as mailboxes may have been renamed since.
+func (iu *imapUser) trackSubscriptions() {
+	if !iu.backend.updates.isSubscribedOnly() {
+		return
+	}
+
+	iu.backend.updates.resetSubscriptions(iu.currentAddressLowercase)
+	for _, storeMailbox := range iu.storeAddress.ListMailboxes() {
+		iu.backend.updates.setSubscribed(iu.currentAddressLowercase, storeMailbox.Name(), iu.isSubscribed(storeMailbox.LabelID()))
+	}
+}
+
 func (iu *imapUser) isSubscribed(labelID string) bool {
 	subscriptionExceptions := iu.backend.getCacheList(iu.storeUser.UserID(), SubscriptionException)
 	exceptions := strings.Split(subscriptionExceptions, ";")
@@ -173,7 +197,12 @@ func (iu *imapUser) DeleteMailbox(name string) (err error) {
 		return
 	}
 
-	return storeMailbox.Delete()
+	if err = storeMailbox.Delete(); err != nil {
+		return
+	}
+
+	iu.backend.updates.setSubscribed(iu.currentAddressLowercase, name, true)
+	return nil
 }
 
 // RenameMailbox changes the name of a mailbox. It is an error to attempt to
@@ -186,7 +215,12 @@ func (iu *imapUser) RenameMailbox(oldName, newName string) (err error) {
 		return
 	}
 
-	return storeMailbox.Rename(newName)
+	if err = storeMailbox.Rename(newName); err != nil {
+		return
+	}
+
+	iu.backend.updates.renameSubscription(iu.currentAddressLowercase, oldName, newName)
+	return nil
 }
 
 // Logout is called when this User will no longer be used, likely because the
@@ -195,6 +229,8 @@ func (iu *imapUser) Logout() (err error) {
 	log.Debug("IMAP client logged out address ", iu.storeAddress.AddressID())
 
 	iu.backend.deleteUser(iu.currentAddressLowercase)
+	iu.backend.releaseConnection(iu.currentAddressLowercase)
+	iu.backend.releaseChangeNotifier(iu.currentAddressLowercase)
 
 	return nil
 }
@@ -18,17 +18,45 @@
 package logging
 
 import (
+	"errors"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// Log output formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// ErrUnknownFormat is returned by SetFormat for an unsupported format.
+var ErrUnknownFormat = errors.New("unknown log format")
+
 func Init() error {
-	logrus.SetFormatter(&logrus.TextFormatter{
-		ForceColors:     true,
-		FullTimestamp:   true,
-		TimestampFormat: time.StampMilli,
-	})
+	return SetFormat(FormatText)
+}
+
+// SetFormat switches the format of all log output, including the loggers
+// of the individual packages which derive from the standard logger.
+// An empty format means text.
+func SetFormat(format string) error {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", FormatText:
+		logrus.SetFormatter(&logrus.TextFormatter{
+			ForceColors:     true,
+			FullTimestamp:   true,
+			TimestampFormat: time.StampMilli,
+		})
+	case FormatJSON:
+		logrus.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+		})
+	default:
+		return ErrUnknownFormat
+	}
+
 	return nil
 }
 
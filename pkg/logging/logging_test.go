@@ -0,0 +1,53 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetFormatJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	defer logrus.SetOutput(os.Stderr)
+	defer Init() //nolint:errcheck
+
+	require.NoError(t, SetFormat("JSON"))
+
+	// Same as the per-package loggers.
+	log := logrus.WithField("pkg", "test")
+	log.WithField("userID", "user").Warn("Something happened")
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, "test", entry["pkg"])
+	require.Equal(t, "user", entry["userID"])
+	require.Equal(t, "Something happened", entry["msg"])
+	require.Equal(t, "warning", entry["level"])
+	require.Contains(t, entry, "time")
+}
+
+func TestSetFormatUnknown(t *testing.T) {
+	require.Equal(t, ErrUnknownFormat, SetFormat("xml"))
+}
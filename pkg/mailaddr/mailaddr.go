@@ -0,0 +1,46 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+// Package mailaddr provides the canonical form of e-mail addresses shared by
+// the packages which compare or key addresses.
+package mailaddr
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Normalize returns the canonical form of an address in which addresses are
+// compared and keyed: without surrounding whitespace, lowercased and with an
+// internationalized domain in its Unicode form, so that the punycode and the
+// Unicode spelling of a domain are the same address.
+func Normalize(address string) string {
+	address = strings.ToLower(strings.TrimSpace(address))
+
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return address
+	}
+
+	domain, err := idna.Punycode.ToUnicode(address[at+1:])
+	if err != nil {
+		return address
+	}
+
+	return address[:at+1] + strings.ToLower(domain)
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package mailaddr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalize(t *testing.T) {
+	for input, want := range map[string]string{
+		"user@example.com":           "user@example.com",
+		"  User@Example.COM\t":       "user@example.com",
+		"user@bücher.example":        "user@bücher.example",
+		"user@xn--bcher-kva.example": "user@bücher.example",
+		"User@XN--BCHER-KVA.Example": "user@bücher.example",
+		" Not An Address ":           "not an address",
+		"":                           "",
+	} {
+		require.Equal(t, want, Normalize(input), input)
+	}
+}
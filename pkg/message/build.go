@@ -26,12 +26,14 @@ import (
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/ljanyst/peroxide/pkg/pool"
+	"github.com/ljanyst/peroxide/pkg/semaphore"
 	"github.com/pkg/errors"
 )
 
 var (
 	ErrDecryptionFailed = errors.New("message could not be decrypted")
 	ErrNoSuchKeyRing    = errors.New("the keyring to decrypt this message could not be found")
+	ErrInvalidBuildJobs = errors.New("the maximum number of concurrent build jobs must be at least 1")
 )
 
 const (
@@ -40,9 +42,11 @@ const (
 )
 
 type Builder struct {
-	pool *pool.Pool
-	jobs map[string]*Job
-	lock sync.Mutex
+	pool      *pool.Pool
+	jobs      map[string]*Job
+	lock      sync.Mutex
+	stats     *builderStats
+	forceCRLF bool
 }
 
 type Fetcher interface {
@@ -59,16 +63,51 @@ type Fetcher interface {
 //
 // Call (*Builder).Done to shut down the builder and stop all workers.
 func NewBuilder(fetchWorkers, attachmentWorkers int) *Builder {
+	return newBuilder(fetchWorkers, attachmentWorkers, fetchWorkers)
+}
+
+// NewBuilderWithLimit is like NewBuilder but additionally caps the number of
+// build jobs running at the same time to maxBuildJobs, regardless of the number
+// of fetch workers. Lower values put less pressure on the API.
+func NewBuilderWithLimit(fetchWorkers, attachmentWorkers, maxBuildJobs int) (*Builder, error) {
+	if maxBuildJobs < 1 {
+		return nil, ErrInvalidBuildJobs
+	}
+
+	return newBuilder(fetchWorkers, attachmentWorkers, maxBuildJobs), nil
+}
+
+func newBuilder(fetchWorkers, attachmentWorkers, maxBuildJobs int) *Builder {
 	attachmentPool := pool.New(attachmentWorkers, newAttacherWorkFunc())
 
-	fetcherPool := pool.New(fetchWorkers, newFetcherWorkFunc(attachmentPool))
+	stats := &builderStats{}
+
+	fetcherWork := stats.wrap(newFetcherWorkFunc(attachmentPool))
+	if maxBuildJobs < fetchWorkers {
+		fetcherWork = newLimitedWorkFunc(maxBuildJobs, fetcherWork)
+	}
+
+	fetcherPool := pool.New(fetchWorkers, fetcherWork)
 
 	return &Builder{
-		pool: fetcherPool,
-		jobs: make(map[string]*Job),
+		pool:  fetcherPool,
+		jobs:  make(map[string]*Job),
+		stats: stats,
 	}
 }
 
+// SetForceCRLF makes all jobs of the builder convert the line endings of built
+// messages to CRLF, as if JobOptions.ForceCRLF was set. It must be called
+// before any job is created. It is off by default.
+func (builder *Builder) SetForceCRLF(force bool) {
+	builder.forceCRLF = force
+}
+
+// Stats returns a snapshot of the fetch worker pool counters.
+func (builder *Builder) Stats() BuilderStats {
+	return builder.stats.snapshot()
+}
+
 func (builder *Builder) NewJob(ctx context.Context, fetcher Fetcher, messageID string, prio int) (*Job, pool.DoneFunc) {
 	return builder.NewJobWithOptions(ctx, fetcher, messageID, JobOptions{}, prio)
 }
@@ -85,6 +124,10 @@ func (builder *Builder) NewJobWithOptions(ctx context.Context, fetcher Fetcher,
 		return job, job.done
 	}
 
+	builder.stats.jobQueued()
+
+	opts.ForceCRLF = opts.ForceCRLF || builder.forceCRLF
+
 	job, done := builder.pool.NewJob(
 		&fetchReq{
 			ctx:       ctx,
@@ -183,6 +226,18 @@ func newAttacherWorkFunc() pool.WorkFunc {
 	}
 }
 
+// newLimitedWorkFunc lets at most max calls of work run at the same time.
+func newLimitedWorkFunc(max int, work pool.WorkFunc) pool.WorkFunc {
+	sem := semaphore.New(max)
+
+	return func(payload interface{}, prio int) (interface{}, error) {
+		sem.Lock()
+		defer sem.Unlock()
+
+		return work(payload, prio)
+	}
+}
+
 func newFetcherWorkFunc(attachmentPool *pool.Pool) pool.WorkFunc {
 	return func(payload interface{}, prio int) (interface{}, error) {
 		req, ok := payload.(*fetchReq)
@@ -24,4 +24,9 @@ type JobOptions struct {
 	AddExternalID          bool // Whether to include ExternalID as X-Pm-External-Id.
 	AddMessageDate         bool // Whether to include message time as X-Pm-Date.
 	AddMessageIDReference  bool // Whether to include the MessageID in References.
+
+	// Whether to convert every line ending of the built message to CRLF.
+	// Without it, line endings of the original message body are kept as they
+	// are, so a literal may mix CRLF and LF.
+	ForceCRLF bool
 }
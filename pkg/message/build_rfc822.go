@@ -35,16 +35,48 @@ import (
 )
 
 func buildRFC822(kr *crypto.KeyRing, msg *pmapi.Message, attData map[string][]byte, opts JobOptions) ([]byte, error) {
+	var (
+		res []byte
+		err error
+	)
+
 	switch {
 	case len(msg.Attachments) > 0:
-		return buildMultipartRFC822(kr, msg, attData, opts)
+		res, err = buildMultipartRFC822(kr, msg, attData, opts)
 
 	case msg.MIMEType == "multipart/mixed":
-		return buildPGPRFC822(kr, msg, opts)
+		res, err = buildPGPRFC822(kr, msg, opts)
 
 	default:
-		return buildSimpleRFC822(kr, msg, opts)
+		res, err = buildSimpleRFC822(kr, msg, opts)
+	}
+
+	if err != nil || !opts.ForceCRLF {
+		return res, err
+	}
+
+	return toCRLF(res), nil
+}
+
+// toCRLF converts lone LF and lone CR line endings to CRLF.
+func toCRLF(b []byte) []byte {
+	res := make([]byte, 0, len(b)+len(b)/32)
+
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\r':
+			res = append(res, '\r', '\n')
+			if i+1 < len(b) && b[i+1] == '\n' {
+				i++
+			}
+		case '\n':
+			res = append(res, '\r', '\n')
+		default:
+			res = append(res, b[i])
+		}
 	}
+
+	return res
 }
 
 func buildSimpleRFC822(kr *crypto.KeyRing, msg *pmapi.Message, opts JobOptions) ([]byte, error) {
@@ -0,0 +1,88 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package message
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/pool"
+)
+
+// BuilderStats is a snapshot of the builder's worker pool counters.
+type BuilderStats struct {
+	Queued    int64         // Jobs waiting for a free fetch worker.
+	InFlight  int64         // Jobs currently being fetched and built.
+	Completed int64         // Jobs that finished, successfully or not.
+	Failed    int64         // Jobs that finished with an error.
+	BuildTime time.Duration // Total time spent by workers on finished jobs.
+}
+
+// AverageBuildTime returns the mean time a worker spent on a finished job.
+func (stats BuilderStats) AverageBuildTime() time.Duration {
+	if stats.Completed == 0 {
+		return 0
+	}
+
+	return stats.BuildTime / time.Duration(stats.Completed)
+}
+
+// builderStats holds the live counters. All fields are accessed atomically
+// so that workers never contend on a lock just to report progress.
+type builderStats struct {
+	queued    int64
+	inFlight  int64
+	completed int64
+	failed    int64
+	buildTime int64
+}
+
+func (stats *builderStats) jobQueued() {
+	atomic.AddInt64(&stats.queued, 1)
+}
+
+// wrap instruments the given work function with the pool counters.
+func (stats *builderStats) wrap(work pool.WorkFunc) pool.WorkFunc {
+	return func(payload interface{}, prio int) (interface{}, error) {
+		atomic.AddInt64(&stats.queued, -1)
+		atomic.AddInt64(&stats.inFlight, 1)
+
+		start := time.Now()
+
+		res, err := work(payload, prio)
+
+		atomic.AddInt64(&stats.buildTime, int64(time.Since(start)))
+		if err != nil {
+			atomic.AddInt64(&stats.failed, 1)
+		}
+		atomic.AddInt64(&stats.completed, 1)
+		atomic.AddInt64(&stats.inFlight, -1)
+
+		return res, err
+	}
+}
+
+func (stats *builderStats) snapshot() BuilderStats {
+	return BuilderStats{
+		Queued:    atomic.LoadInt64(&stats.queued),
+		InFlight:  atomic.LoadInt64(&stats.inFlight),
+		Completed: atomic.LoadInt64(&stats.completed),
+		Failed:    atomic.LoadInt64(&stats.failed),
+		BuildTime: time.Duration(atomic.LoadInt64(&stats.buildTime)),
+	}
+}
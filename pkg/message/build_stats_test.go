@@ -0,0 +1,168 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package message
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errStubFetch = errors.New("stub fetch")
+
+// stubFetcher blocks every GetMessage call until release is closed.
+type stubFetcher struct {
+	started chan string
+	release chan struct{}
+}
+
+func (f *stubFetcher) GetMessage(_ context.Context, messageID string) (*pmapi.Message, error) {
+	f.started <- messageID
+	<-f.release
+	return nil, errStubFetch
+}
+
+func (f *stubFetcher) GetAttachment(context.Context, string) (io.ReadCloser, error) {
+	return nil, errStubFetch
+}
+
+func (f *stubFetcher) KeyRingForAddressID(string) (*crypto.KeyRing, error) {
+	return nil, errStubFetch
+}
+
+func TestBuilderStats(t *testing.T) {
+	b := NewBuilder(1, 1)
+	defer b.Done()
+
+	f := &stubFetcher{
+		started: make(chan string, 3),
+		release: make(chan struct{}),
+	}
+
+	var jobs []*Job
+
+	for _, messageID := range []string{"msg1", "msg2", "msg3"} {
+		job, done := b.NewJob(context.Background(), f, messageID, ForegroundPriority)
+		defer done()
+
+		jobs = append(jobs, job)
+	}
+
+	// Submitting the same message again must not count as a new job.
+	_, done := b.NewJob(context.Background(), f, "msg1", ForegroundPriority)
+	defer done()
+
+	<-f.started
+
+	stats := b.Stats()
+	assert.Equal(t, int64(2), stats.Queued)
+	assert.Equal(t, int64(1), stats.InFlight)
+	assert.Equal(t, int64(0), stats.Completed)
+
+	close(f.release)
+
+	// The pool does not guarantee the order in which equal-priority jobs run,
+	// and a worker only picks the next job once the current one is done.
+	var wg sync.WaitGroup
+
+	for _, job := range jobs {
+		wg.Add(1)
+
+		go func(job *Job) {
+			defer wg.Done()
+
+			_, err := job.GetResult()
+			assert.ErrorIs(t, err, errStubFetch)
+			job.done()
+		}(job)
+	}
+
+	wg.Wait()
+
+	stats = b.Stats()
+	assert.Equal(t, int64(0), stats.Queued)
+	assert.Equal(t, int64(0), stats.InFlight)
+	assert.Equal(t, int64(3), stats.Completed)
+	assert.Equal(t, int64(3), stats.Failed)
+	assert.Equal(t, stats.BuildTime/3, stats.AverageBuildTime())
+}
+
+// countingFetcher records the highest number of concurrent GetMessage calls.
+type countingFetcher struct {
+	stubFetcher
+
+	lock            sync.Mutex
+	active, maxSeen int
+}
+
+func (f *countingFetcher) GetMessage(_ context.Context, messageID string) (*pmapi.Message, error) {
+	f.lock.Lock()
+	f.active++
+	if f.active > f.maxSeen {
+		f.maxSeen = f.active
+	}
+	f.lock.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	f.lock.Lock()
+	f.active--
+	f.lock.Unlock()
+
+	return nil, errStubFetch
+}
+
+func TestBuilderMaxBuildJobs(t *testing.T) {
+	_, err := NewBuilderWithLimit(4, 1, 0)
+	require.ErrorIs(t, err, ErrInvalidBuildJobs)
+
+	b, err := NewBuilderWithLimit(4, 1, 1)
+	require.NoError(t, err)
+	defer b.Done()
+
+	f := &countingFetcher{}
+
+	var wg sync.WaitGroup
+
+	for _, messageID := range []string{"msg1", "msg2", "msg3", "msg4"} {
+		job, done := b.NewJob(context.Background(), f, messageID, ForegroundPriority)
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer done()
+
+			_, err := job.GetResult()
+			assert.ErrorIs(t, err, errStubFetch)
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, 1, f.maxSeen)
+	assert.Equal(t, int64(4), b.Stats().Completed)
+}
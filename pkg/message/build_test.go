@@ -1665,3 +1665,30 @@ func TestBuildNoSuchKeyRing(t *testing.T) {
 	// The returned error should be of this specific type.
 	assert.True(t, errors.Is(err, ErrNoSuchKeyRing))
 }
+
+func TestBuildMessageForceCRLF(t *testing.T) {
+	m := gomock.NewController(t)
+	defer m.Finish()
+
+	b := NewBuilder(2, 2)
+	defer b.Done()
+
+	body := "Content-Type: text/plain\r\n\r\nfirst\nsecond\r\nthird\rfourth\n"
+
+	kr := testutil.MakeKeyRing(t)
+	msg := newTestMessage(t, kr, "messageID", "addressID", "multipart/mixed", body, time.Now())
+
+	job, done := b.NewJobWithOptions(context.Background(), newTestFetcher(m, kr, msg), msg.ID, JobOptions{ForceCRLF: true}, ForegroundPriority)
+	defer done()
+
+	res, err := job.GetResult()
+	require.NoError(t, err)
+
+	require.Contains(t, string(res), "first\r\nsecond\r\nthird\r\nfourth\r\n")
+	require.NotContains(t, strings.ReplaceAll(string(res), "\r\n", ""), "\n")
+	require.NotContains(t, strings.ReplaceAll(string(res), "\r\n", ""), "\r")
+}
+
+func TestToCRLF(t *testing.T) {
+	require.Equal(t, []byte("a\r\nb\r\nc\r\nd\r\n\r\n"), toCRLF([]byte("a\nb\r\nc\rd\r\n\n")))
+}
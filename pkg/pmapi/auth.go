@@ -175,6 +175,21 @@ func (c *client) AddAuthRefreshHandler(handler AuthRefreshHandler) {
 	c.authHandlers = append(c.authHandlers, handler)
 }
 
+// SessionExpiry returns when the session of the client ends for good. The
+// access token is refreshed automatically by the next request made after it
+// expires, so that only happens once there is no refresh token to renew it
+// with; while there is one, the zero time is returned.
+func (c *client) SessionExpiry() time.Time {
+	c.authLocker.RLock()
+	defer c.authLocker.RUnlock()
+
+	if c.ref != "" {
+		return time.Time{}
+	}
+
+	return c.exp
+}
+
 func (c *client) authRefresh(ctx context.Context) error {
 	c.authLocker.Lock()
 	defer c.authLocker.Unlock()
@@ -66,6 +66,17 @@ func TestAutomaticAuthRefresh(t *testing.T) {
 	r.WithinDuration(expiresIn(100), cl.exp, time.Second)
 }
 
+func TestSessionExpiry(t *testing.T) {
+	r := require.New(t)
+
+	exp := time.Now().Add(time.Minute)
+	m := New(Config{})
+
+	// A refresh token renews the session, so it has no known expiry.
+	r.True(m.NewClient("uid", "acc", "ref", exp).SessionExpiry().IsZero())
+	r.Equal(exp, m.NewClient("uid", "acc", "", exp).SessionExpiry())
+}
+
 func Test401AuthRefresh(t *testing.T) {
 	r := require.New(t)
 	currentTokens := newTestRefreshToken(r)
@@ -20,6 +20,7 @@ package pmapi
 import (
 	"context"
 	"io"
+	"time"
 
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/go-resty/resty/v2"
@@ -31,6 +32,7 @@ type Client interface {
 	AuthSalt(ctx context.Context) (string, error)
 	AuthDelete(context.Context) error
 	AddAuthRefreshHandler(AuthRefreshHandler)
+	SessionExpiry() time.Time
 
 	GetUser(ctx context.Context) (*User, error)
 	CurrentUser(ctx context.Context) (*User, error)
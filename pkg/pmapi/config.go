@@ -17,6 +17,15 @@
 
 package pmapi
 
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// ErrInvalidProxyURL is returned by ParseProxyURL for malformed or unsupported proxy URLs.
+var ErrInvalidProxyURL = errors.New("invalid proxy URL")
+
 type Config struct {
 	// HostURL is the base URL of API.
 	HostURL string
@@ -29,6 +38,10 @@ type Config struct {
 
 	// TLSIssueHandler is used to notify when there is a TLS issue.
 	TLSIssueHandler func()
+
+	// ProxyURL is the HTTP or SOCKS5 proxy all API requests go through.
+	// When nil, the proxy is taken from the environment.
+	ProxyURL *url.URL
 }
 
 func NewConfig() Config {
@@ -41,3 +54,30 @@ func NewConfig() Config {
 func (c *Config) getUserAgent() string {
 	return "UnknownClient/0.0.1"
 }
+
+// ParseProxyURL parses a proxy URL with either the http or the socks5 scheme.
+// HTTPS proxies are not supported: the TLS connection to the proxy itself
+// would be subject to the API certificate pinning.
+// An empty string means no proxy and yields nil.
+func ParseProxyURL(rawURL string) (*url.URL, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProxyURL, err)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "socks5":
+	default:
+		return nil, fmt.Errorf("%w: unsupported scheme %q", ErrInvalidProxyURL, proxyURL.Scheme)
+	}
+
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("%w: missing host", ErrInvalidProxyURL)
+	}
+
+	return proxyURL, nil
+}
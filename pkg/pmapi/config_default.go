@@ -32,5 +32,6 @@ func newProxyDialerAndTransport(cfg Config) (*ProxyTLSDialer, http.RoundTripper)
 	basicDialer := NewBasicTLSDialer(cfg)
 	pinningDialer := NewPinningTLSDialer(cfg, basicDialer)
 	proxyDialer := NewProxyTLSDialer(cfg, pinningDialer)
-	return proxyDialer, CreateTransportWithDialer(proxyDialer)
+	transport := withProxyURL(CreateTransportWithDialer(proxyDialer), cfg.ProxyURL, pinningDialer.VerifyConnection)
+	return proxyDialer, transport
 }
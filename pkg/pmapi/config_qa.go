@@ -45,5 +45,5 @@ func newProxyDialerAndTransport(cfg Config) (*ProxyTLSDialer, http.RoundTripper)
 	// TLS certificate of testing environment might be self-signed.
 	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 
-	return nil, transport
+	return nil, withProxyURL(transport, cfg.ProxyURL, nil)
 }
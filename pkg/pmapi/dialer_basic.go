@@ -21,6 +21,7 @@ import (
 	"crypto/tls"
 	"net"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -51,6 +52,27 @@ func CreateTransportWithDialer(dialer TLSDialer) *http.Transport {
 	}
 }
 
+// withProxyURL makes the transport send all requests through proxyURL.
+// Proxied connections are tunneled and their TLS handshake with the API is
+// done by the transport itself rather than by its TLS dialer, so verify, if
+// set, is run on those connections instead, e.g. to check the pins.
+func withProxyURL(transport *http.Transport, proxyURL *url.URL, verify func(tls.ConnectionState) error) *http.Transport {
+	if proxyURL == nil {
+		return transport
+	}
+
+	transport.Proxy = http.ProxyURL(proxyURL)
+
+	if verify != nil {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{} //nolint:gosec
+		}
+		transport.TLSClientConfig.VerifyConnection = verify
+	}
+
+	return transport
+}
+
 // BasicTLSDialer implements TLSDialer.
 type BasicTLSDialer struct {
 	cfg Config
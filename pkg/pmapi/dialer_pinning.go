@@ -90,21 +90,38 @@ func (p *PinningTLSDialer) DialTLS(network, address string) (net.Conn, error) {
 	}
 
 	if err := p.pinChecker.checkCertificate(conn); err != nil {
-		if p.tlsIssueNotifier != nil {
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			p.handleCertIssue(host, port, tlsConn.ConnectionState())
+		} else if p.tlsIssueNotifier != nil {
 			go p.tlsIssueNotifier()
 		}
 
-		if tlsConn, ok := conn.(*tls.Conn); ok && p.reporter != nil {
-			p.reporter.reportCertIssue(
-				TLSReportURI,
-				host,
-				port,
-				tlsConn.ConnectionState(),
-			)
-		}
-
 		return nil, err
 	}
 
 	return conn, nil
 }
+
+// VerifyConnection checks the pins of a TLS connection which was not dialed by
+// the dialer, e.g. one tunneled through a proxy by the transport. It is meant
+// to be used as tls.Config.VerifyConnection.
+func (p *PinningTLSDialer) VerifyConnection(state tls.ConnectionState) error {
+	if err := p.pinChecker.checkConnectionState(state); err != nil {
+		// Tunneled connections always go to the HTTPS port of the API.
+		p.handleCertIssue(state.ServerName, "443", state)
+		return err
+	}
+
+	return nil
+}
+
+// handleCertIssue notifies and reports a connection failing the pin check.
+func (p *PinningTLSDialer) handleCertIssue(host, port string, state tls.ConnectionState) {
+	if p.tlsIssueNotifier != nil {
+		go p.tlsIssueNotifier()
+	}
+
+	if p.reporter != nil {
+		p.reporter.reportCertIssue(TLSReportURI, host, port, state)
+	}
+}
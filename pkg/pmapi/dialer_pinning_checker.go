@@ -47,8 +47,11 @@ func (p *pinChecker) checkCertificate(conn net.Conn) error {
 		return errors.New("connection is not a TLS connection")
 	}
 
-	connState := tlsConn.ConnectionState()
+	return p.checkConnectionState(tlsConn.ConnectionState())
+}
 
+// checkConnectionState returns whether the connection presents a known TLS certificate.
+func (p *pinChecker) checkConnectionState(connState tls.ConnectionState) error {
 	for _, peerCert := range connState.PeerCertificates {
 		fingerprint := certFingerprint(peerCert)
 
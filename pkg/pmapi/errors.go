@@ -17,7 +17,10 @@
 
 package pmapi
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 var (
 	ErrNoConnection       = errors.New("no internet connection")
@@ -59,6 +62,37 @@ func (err ErrBadRequest) Error() string {
 	return err.OriginalError.Error()
 }
 
+// ErrServerError ...
+type ErrServerError struct {
+	OriginalError error
+}
+
+func IsServerError(err error) bool {
+	_, ok := err.(ErrServerError)
+	return ok
+}
+
+func (err ErrServerError) Error() string {
+	return err.OriginalError.Error()
+}
+
+// ErrTooManyRequests is returned when the API rate-limited a request and it
+// could not be retried. RetryAfter is the wait requested by the API.
+type ErrTooManyRequests struct {
+	OriginalError error
+	RetryAfter    time.Duration
+}
+
+// IsTooManyRequests returns whether err is ErrTooManyRequests and the wait the API asked for.
+func IsTooManyRequests(err error) (time.Duration, bool) {
+	tooMany, ok := err.(ErrTooManyRequests)
+	return tooMany.RetryAfter, ok
+}
+
+func (err ErrTooManyRequests) Error() string {
+	return err.OriginalError.Error()
+}
+
 // ErrAuthFailed ...
 type ErrAuthFailed struct {
 	OriginalError error
@@ -613,6 +613,20 @@ func (mr *MockClientMockRecorder) SendMessage(arg0, arg1, arg2 interface{}) *gom
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendMessage", reflect.TypeOf((*MockClient)(nil).SendMessage), arg0, arg1, arg2)
 }
 
+// SessionExpiry mocks base method.
+func (m *MockClient) SessionExpiry() time.Time {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SessionExpiry")
+	ret0, _ := ret[0].(time.Time)
+	return ret0
+}
+
+// SessionExpiry indicates an expected call of SessionExpiry.
+func (mr *MockClientMockRecorder) SessionExpiry() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SessionExpiry", reflect.TypeOf((*MockClient)(nil).SessionExpiry))
+}
+
 // UnlabelMessages mocks base method.
 func (m *MockClient) UnlabelMessages(arg0 context.Context, arg1 []string, arg2 string) error {
 	m.ctrl.T.Helper()
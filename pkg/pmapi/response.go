@@ -79,6 +79,12 @@ func (m *manager) catchAPIError(_ *resty.Client, res *resty.Response) error {
 		err = ErrUnprocessableEntity{err}
 	case http.StatusBadRequest:
 		err = ErrBadRequest{err}
+	case http.StatusTooManyRequests:
+		err = ErrTooManyRequests{OriginalError: err, RetryAfter: parseRetryAfter(res.Header().Get("Retry-After"))}
+	default:
+		if res.StatusCode() >= http.StatusInternalServerError {
+			err = ErrServerError{err}
+		}
 	}
 
 	return err
@@ -105,17 +111,11 @@ func logConnReuse(_ *resty.Client, res *resty.Response) error {
 func catchRetryAfter(_ *resty.Client, res *resty.Response) (time.Duration, error) {
 	if res.StatusCode() == http.StatusTooManyRequests {
 		if after := res.Header().Get("Retry-After"); after != "" {
-			seconds, err := strconv.Atoi(after)
-			if err != nil {
-				log.WithError(err).Warning("Cannot convert Retry-After to number")
-				seconds = 10
-			}
-
 			// To avoid spikes when all clients retry at the same time, we add some random wait.
-			seconds += rand.Intn(10) //nolint:gosec // It is OK to use weak random number generator here.
+			wait := parseRetryAfter(after) + time.Duration(rand.Intn(10))*time.Second //nolint:gosec // It is OK to use weak random number generator here.
 
-			log.Warningf("Retrying %s after %ds induced by http code %d", res.Request.URL, seconds, res.StatusCode())
-			return time.Duration(seconds) * time.Second, nil
+			log.Warningf("Retrying %s after %v induced by http code %d", res.Request.URL, wait, res.StatusCode())
+			return wait, nil
 		}
 	}
 
@@ -123,6 +123,20 @@ func catchRetryAfter(_ *resty.Client, res *resty.Response) (time.Duration, error
 	return 0, nil
 }
 
+// parseRetryAfter converts the seconds of a Retry-After header to a duration.
+// A missing or malformed value results in the default of 10 seconds.
+func parseRetryAfter(after string) time.Duration {
+	seconds, err := strconv.Atoi(after)
+	if err != nil {
+		if after != "" {
+			log.WithError(err).Warning("Cannot convert Retry-After to number")
+		}
+		seconds = 10
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
 func (m *manager) shouldRetry(res *resty.Response, err error) bool {
 	if isRetryDisabled(res.Request.Context()) {
 		return false
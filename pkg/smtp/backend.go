@@ -22,13 +22,16 @@ import (
 	"time"
 
 	goSMTPBackend "github.com/emersion/go-smtp"
+	"github.com/ljanyst/peroxide/pkg/config/settings"
 	"github.com/ljanyst/peroxide/pkg/listener"
 	"github.com/ljanyst/peroxide/pkg/users"
+	"github.com/ljanyst/peroxide/pkg/users/credentials"
 	"github.com/pkg/errors"
 )
 
 type smtpBackend struct {
 	eventListener listener.Listener
+	setting       *settings.Settings
 	users         *users.Users
 	bccSelf       bool
 	sendRecorder  *sendRecorder
@@ -37,11 +40,13 @@ type smtpBackend struct {
 // NewSMTPBackend returns struct implementing go-smtp/backend interface.
 func NewSMTPBackend(
 	eventListener listener.Listener,
+	setting *settings.Settings,
 	users *users.Users,
 	bccSelf bool,
 ) *smtpBackend { //nolint[golint]
 	return &smtpBackend{
 		eventListener: eventListener,
+		setting:       setting,
 		users:         users,
 		bccSelf:       bccSelf,
 		sendRecorder:  newSendRecorder(),
@@ -63,7 +68,7 @@ func (sb *smtpBackend) Login(_ *goSMTPBackend.ConnectionState, username, passwor
 		return nil, err
 	}
 
-	if err := user.CheckCredentials(slot, password); err != nil {
+	if err := user.CheckCredentials(slot, password, credentials.ScopeSMTP); err != nil {
 		log.WithError(err).Error("Could not check bridge password")
 		// Apple Mail sometimes generates a lot of requests very quickly. It's good practice
 		// to have a timeout after bad logins so that we can slow those requests down a little bit.
@@ -74,7 +79,21 @@ func (sb *smtpBackend) Login(_ *goSMTPBackend.ConnectionState, username, passwor
 	// AddressID is only for split mode--it has to be empty for combined mode.
 	addressID := ""
 
-	return newSMTPUser(sb.eventListener, sb, user, username, addressID, sb.bccSelf)
+	bccSelf := sb.bccSelfFor(user.GetPrimaryAddress())
+
+	return newSMTPUser(sb.eventListener, sb, user, username, addressID, bccSelf)
+}
+
+// bccSelfFor returns whether self-BCC is enabled for the address. A per-address
+// override in the settings takes precedence over the backend-wide value, the
+// same way as for IMAP.
+func (sb *smtpBackend) bccSelfFor(address string) bool {
+	if sb.setting != nil {
+		if value := sb.setting.Get(settings.BCCSelfAddressKey(users.NormalizeAddress(address))); value != "" {
+			return value == "true"
+		}
+	}
+	return sb.bccSelf
 }
 
 func (sb *smtpBackend) AnonymousLogin(_ *goSMTPBackend.ConnectionState) (goSMTPBackend.Session, error) {
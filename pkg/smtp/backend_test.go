@@ -0,0 +1,63 @@
+// Copyright (c) 2022 Proton Technologies AG
+//
+// This file is part of ProtonMail Bridge.
+//
+// ProtonMail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// ProtonMail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with ProtonMail Bridge.  If not, see <https://www.gnu.org/licenses/>.
+
+package smtp
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSettings(t *testing.T, lines ...string) *settings.Settings {
+	content := ""
+	for _, line := range lines {
+		content += line + "\n"
+	}
+
+	path := filepath.Join(t.TempDir(), "settings.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0o600))
+
+	return settings.New(path)
+}
+
+func TestBCCSelfPerAddressOverride(t *testing.T) {
+	setting := newTestSettings(t,
+		settings.BCCSelfAddressKey("override@pm.me")+": true",
+		settings.BCCSelfAddressKey("disabled@pm.me")+": false",
+		settings.BCCSelfAddressKey("user@bücher.example")+": true",
+	)
+
+	sb := NewSMTPBackend(listener.New(), setting, nil, false)
+	require.True(t, sb.bccSelfFor("override@pm.me"))
+	require.True(t, sb.bccSelfFor("Override@PM.me"))
+	require.True(t, sb.bccSelfFor("User@XN--BCHER-KVA.example"))
+	require.False(t, sb.bccSelfFor("default@pm.me"))
+
+	sb = NewSMTPBackend(listener.New(), setting, nil, true)
+	require.True(t, sb.bccSelfFor("default@pm.me"))
+	require.False(t, sb.bccSelfFor("disabled@pm.me"))
+}
+
+func TestBCCSelfWithoutSettings(t *testing.T) {
+	require.True(t, NewSMTPBackend(listener.New(), nil, nil, true).bccSelfFor("user@pm.me"))
+	require.False(t, NewSMTPBackend(listener.New(), nil, nil, false).bccSelfFor("user@pm.me"))
+}
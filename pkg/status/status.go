@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+// Package status aggregates the state of the users and the IMAP backend into
+// a single report suitable for a status endpoint.
+package status
+
+import (
+	"github.com/ljanyst/peroxide/pkg/imap"
+	"github.com/ljanyst/peroxide/pkg/users"
+)
+
+// UsersLister is implemented by *users.Users.
+type UsersLister interface {
+	ListUsers() []users.UserSummary
+}
+
+// BackendStatter is implemented by the IMAP backend.
+type BackendStatter interface {
+	Stats() imap.BackendStats
+}
+
+// Report is a JSON-serializable snapshot of the bridge state.
+type Report struct {
+	KnownUsers     int                 `json:"known_users"`
+	ConnectedUsers int                 `json:"connected_users"`
+	Users          []users.UserSummary `json:"users"`
+	IMAP           imap.BackendStats   `json:"imap"`
+}
+
+// NewReport collects the current state of both subsystems.
+func NewReport(usersLister UsersLister, backend BackendStatter) Report {
+	summaries := usersLister.ListUsers()
+
+	report := Report{
+		KnownUsers: len(summaries),
+		Users:      summaries,
+		IMAP:       backend.Stats(),
+	}
+
+	for _, summary := range summaries {
+		if summary.Connected {
+			report.ConnectedUsers++
+		}
+	}
+
+	return report
+}
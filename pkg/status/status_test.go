@@ -0,0 +1,63 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package status
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ljanyst/peroxide/pkg/imap"
+	"github.com/ljanyst/peroxide/pkg/users"
+	"github.com/stretchr/testify/require"
+)
+
+type testUsers []users.UserSummary
+
+func (u testUsers) ListUsers() []users.UserSummary { return u }
+
+type testBackend imap.BackendStats
+
+func (b testBackend) Stats() imap.BackendStats { return imap.BackendStats(b) }
+
+func TestReportJSON(t *testing.T) {
+	report := NewReport(
+		testUsers{
+			{ID: "user1", Username: "alice", Addresses: []string{"alice@pm.me"}, Connected: true},
+			{ID: "user2", Username: "bob", Addresses: []string{"bob@pm.me"}, Connected: false},
+		},
+		testBackend{Users: 1, CacheEntries: 2, LoginsSucceeded: 5, LoginsFailed: 3, CacheHits: 7, CacheMisses: 1},
+	)
+
+	b, err := json.Marshal(report)
+	require.NoError(t, err)
+
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &fields))
+
+	require.Equal(t, float64(2), fields["known_users"])
+	require.Equal(t, float64(1), fields["connected_users"])
+	require.Len(t, fields["users"], 2)
+	require.Equal(t, map[string]interface{}{
+		"users":            float64(1),
+		"cache_entries":    float64(2),
+		"logins_succeeded": float64(5),
+		"logins_failed":    float64(3),
+		"cache_hits":       float64(7),
+		"cache_misses":     float64(1),
+	}, fields["imap"])
+}
@@ -20,8 +20,12 @@ package store
 import (
 	"context"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ljanyst/peroxide/pkg/clock"
+	"github.com/ljanyst/peroxide/pkg/events"
 	"github.com/ljanyst/peroxide/pkg/listener"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/pkg/errors"
@@ -31,6 +35,16 @@ import (
 const (
 	pollInterval       = 30 * time.Second
 	pollIntervalSpread = 5 * time.Second
+
+	// Backoff between reconnection attempts after a transient error (e.g.
+	// connection dropped). It doubles with every failed attempt up to the cap
+	// so that the loop never polls less often than when it is connected.
+	reconnectInitialWait = 5 * time.Second
+	reconnectMaxWait     = pollInterval
+
+	// reconnectMaxAttempts is the number of consecutive failed attempts
+	// (roughly an hour with the backoff above) after which the loop gives up.
+	reconnectMaxAttempts = 120
 )
 
 type eventLoop struct {
@@ -38,14 +52,23 @@ type eventLoop struct {
 	currentEventID string
 	currentEvent   *pmapi.Event
 	pollCh         chan chan struct{}
+	wakeCh         chan struct{}
 	stopCh         chan struct{}
 	notifyStopCh   chan struct{}
-	isRunning      bool // The whole event loop is running.
+	isRunning      bool       // The whole event loop is running.
+	runningLock    sync.Mutex // Guards isRunning and the stop channels.
+
+	// Accessed atomically; non-zero skips polling, see pause.
+	paused int32
 
 	pollCounter int
 	errCounter  int
 
-	log *logrus.Entry
+	// maxReconnectAttempts is reconnectMaxAttempts; tests lower it.
+	maxReconnectAttempts int
+
+	clock clock.Clock
+	log   *logrus.Entry
 
 	store    *Store
 	user     BridgeUser
@@ -60,9 +83,13 @@ func newEventLoop(currentEvents *Events, store *Store, user BridgeUser, listener
 		currentEvents:  currentEvents,
 		currentEventID: currentEvents.getEventID(user.ID()),
 		pollCh:         make(chan chan struct{}),
+		wakeCh:         make(chan struct{}, 1),
 		isRunning:      false,
 
-		log: eventLog,
+		maxReconnectAttempts: reconnectMaxAttempts,
+
+		clock: clock.Real,
+		log:   eventLog,
 
 		store:    store,
 		user:     user,
@@ -97,40 +124,98 @@ func (loop *eventLoop) setFirstEventID() (err error) {
 // processed so we are sure updates are propagated to the database.
 func (loop *eventLoop) pollNow() {
 	// When event loop is not running, it would cause infinite wait.
+	loop.runningLock.Lock()
 	if !loop.isRunning {
+		loop.runningLock.Unlock()
 		return
 	}
+	stopCh := loop.stopCh
+	loop.runningLock.Unlock()
 
 	eventProcessedCh := make(chan struct{})
-	loop.pollCh <- eventProcessedCh
+	select {
+	case loop.pollCh <- eventProcessedCh:
+	case <-stopCh:
+		return
+	}
 	<-eventProcessedCh
 	close(eventProcessedCh)
 }
 
+// wake asks the loop to poll as soon as possible without waiting for the
+// events to be processed. It never blocks: a request made while another one
+// is pending is merged with it, and a request made while the loop is not
+// running is served once it starts.
+func (loop *eventLoop) wake() {
+	select {
+	case loop.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
 func (loop *eventLoop) stop() {
-	if loop.isRunning {
-		loop.isRunning = false
-		close(loop.stopCh)
+	loop.runningLock.Lock()
+	if !loop.isRunning {
+		loop.runningLock.Unlock()
+		return
+	}
+	loop.isRunning = false
+	close(loop.stopCh)
+	notifyStopCh := loop.notifyStopCh
+	loop.runningLock.Unlock()
 
-		select {
-		case <-loop.notifyStopCh:
-			loop.log.Warn("Event loop was stopped")
-		case <-time.After(1 * time.Second):
-			loop.log.Warn("Timed out waiting for event loop to stop")
-		}
+	select {
+	case <-notifyStopCh:
+		loop.log.Warn("Event loop was stopped")
+	case <-time.After(1 * time.Second):
+		loop.log.Warn("Timed out waiting for event loop to stop")
+	}
+}
+
+func (loop *eventLoop) running() bool {
+	loop.runningLock.Lock()
+	defer loop.runningLock.Unlock()
+
+	return loop.isRunning
+}
+
+// pause stops the loop from polling the API until resume is called.
+// No events are lost: the loop keeps the ID of the last processed event and
+// fetches everything that happened in the meantime once it is resumed.
+// While paused, pollNow returns without the events being processed.
+func (loop *eventLoop) pause() {
+	atomic.StoreInt32(&loop.paused, 1)
+}
+
+// resume undoes pause and polls right away to catch up.
+func (loop *eventLoop) resume() {
+	if atomic.SwapInt32(&loop.paused, 0) == 0 {
+		return
 	}
+
+	loop.wake()
+}
+
+func (loop *eventLoop) isPaused() bool {
+	return atomic.LoadInt32(&loop.paused) != 0
 }
 
 func (loop *eventLoop) start() {
+	loop.runningLock.Lock()
 	if loop.isRunning {
+		loop.runningLock.Unlock()
 		return
 	}
-	defer func() {
-		loop.isRunning = false
-	}()
 	loop.stopCh = make(chan struct{})
 	loop.notifyStopCh = make(chan struct{})
 	loop.isRunning = true
+	loop.runningLock.Unlock()
+
+	defer func() {
+		loop.runningLock.Lock()
+		loop.isRunning = false
+		loop.runningLock.Unlock()
+	}()
 
 	events := make(chan *pmapi.Event)
 	defer close(events)
@@ -140,7 +225,7 @@ func (loop *eventLoop) start() {
 		loop.log.WithField("lastEventID", loop.currentEventID).Warn("Subscription stopped")
 	}()
 
-	go loop.pollNow()
+	loop.wake()
 
 	loop.loop()
 }
@@ -150,18 +235,36 @@ func (loop *eventLoop) loop() {
 	t := time.NewTicker(pollInterval - pollIntervalSpread)
 	defer t.Stop()
 
+	// reconnectCh fires when the next reconnection attempt is due. It is nil
+	// (i.e. never fires) while the connection is fine.
+	var reconnectCh <-chan time.Time
+
 	for {
 		var eventProcessedCh chan struct{}
 		select {
 		case <-loop.stopCh:
 			close(loop.notifyStopCh)
 			return
+		case <-reconnectCh:
+			loop.log.WithField("attempt", loop.errCounter).Info("Reconnecting event loop")
 		case <-t.C:
+			// While reconnecting, the backoff decides when to poll next.
+			if reconnectCh != nil {
+				continue
+			}
 			// Randomise periodic calls within range pollInterval ± pollSpread to reduces potential load spikes on API.
 			//nolint[gosec] It is OK to use weaker random number generator here
 			time.Sleep(time.Duration(rand.Intn(2*int(pollIntervalSpread.Milliseconds()))) * time.Millisecond)
 		case eventProcessedCh = <-loop.pollCh:
 			// We don't want to wait here. Polling should happen instantly.
+		case <-loop.wakeCh:
+		}
+
+		if loop.isPaused() {
+			if eventProcessedCh != nil {
+				eventProcessedCh <- struct{}{}
+			}
+			continue
 		}
 
 		// Before we fetch the first event, check whether this is the first time we've
@@ -193,15 +296,45 @@ func (loop *eventLoop) loop() {
 					WithError(errLogout).
 					Error("Failed to logout user after loop finished with error")
 			}
+			loop.listener.Emit(events.EventLoopStoppedEvent, loop.user.ID())
 			return
 		}
 
+		// Transient errors are counted by processNextEvent; keep retrying
+		// with backoff until an event goes through again or too many
+		// attempts failed in a row.
+		if loop.errCounter > 0 {
+			if loop.errCounter >= loop.maxReconnectAttempts {
+				loop.log.WithField("errors", loop.errCounter).Error("Event loop could not reconnect, stopping event loop")
+				loop.listener.Emit(events.EventLoopStoppedEvent, loop.user.ID())
+				return
+			}
+			wait := reconnectWait(loop.errCounter)
+			loop.log.WithField("errors", loop.errCounter).WithField("wait", wait).Warn("Event loop disconnected, will retry")
+			reconnectCh = loop.clock.After(wait)
+			continue
+		}
+		reconnectCh = nil
+
 		if more {
-			go loop.pollNow()
+			loop.wake()
 		}
 	}
 }
 
+// reconnectWait returns how long to wait before the next reconnection attempt
+// after the given number of consecutive failures.
+func reconnectWait(failures int) time.Duration {
+	wait := reconnectInitialWait
+	for i := 1; i < failures && wait < reconnectMaxWait; i++ {
+		wait *= 2
+	}
+	if wait > reconnectMaxWait {
+		wait = reconnectMaxWait
+	}
+	return wait
+}
+
 // isBeforeFirstStart returns whether the initial event ID was already set or not.
 func (loop *eventLoop) isBeforeFirstStart() bool {
 	return loop.currentEventID == ""
@@ -217,7 +350,14 @@ func (loop *eventLoop) processNextEvent() (more bool, err error) { // nolint[fun
 
 	// We only want to consider invalid tokens as real errors because all other errors might fix themselves eventually
 	// (e.g. no internet, ulimit reached etc.)
+	// Ignored errors are counted in errCounter so the loop can back off before
+	// the next attempt; a successful poll resets it.
 	defer func() {
+		if err == nil {
+			loop.errCounter = 0
+			return
+		}
+
 		if errors.Cause(err) == pmapi.ErrNoConnection {
 			l.Warn("Internet unavailable")
 			err = nil
@@ -233,16 +373,15 @@ func (loop *eventLoop) processNextEvent() (more bool, err error) { // nolint[fun
 			err = nil
 		}
 
-		if err == nil {
-			loop.errCounter = 0
-		}
-
 		// All errors except ErrUnauthorized (which is not possible to recover from) are ignored.
 		if err != nil && !pmapi.IsFailedAuth(errors.Cause(err)) && errors.Cause(err) != pmapi.ErrUnauthorized {
 			l.WithError(err).WithField("errors", loop.errCounter).Error("Error skipped")
-			loop.errCounter++
 			err = nil
 		}
+
+		if err == nil {
+			loop.errCounter++
+		}
 	}()
 
 	l.Trace("Polling next event")
@@ -23,6 +23,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ljanyst/peroxide/pkg/clock"
+	"github.com/ljanyst/peroxide/pkg/events"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/require"
@@ -71,6 +73,134 @@ func TestEventLoopProcessMoreEvents(t *testing.T) {
 	}, time.Second, 10*time.Millisecond)
 }
 
+func TestEventLoopReconnect(t *testing.T) {
+	m, clear := initMocks(t)
+	defer clear()
+
+	reconnected := make(chan struct{})
+	gomock.InOrder(
+		m.client.EXPECT().GetEvent(gomock.Any(), "latestEventID").Return(nil, pmapi.ErrNoConnection),
+		m.client.EXPECT().GetEvent(gomock.Any(), "latestEventID").DoAndReturn(func(_ context.Context, _ string) (*pmapi.Event, error) {
+			defer close(reconnected)
+			return &pmapi.Event{EventID: "event2"}, nil
+		}),
+	)
+	m.newStoreNoEvents(t, true)
+
+	fakeClock := clock.NewFake(time.Now())
+	m.store.eventLoop.clock = fakeClock
+
+	// The first poll fails and the loop schedules a reconnection attempt.
+	m.store.eventLoop.pollNow()
+	require.Equal(t, 1, m.store.eventLoop.errCounter)
+	require.Eventually(t, func() bool {
+		return fakeClock.Waiters() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	fakeClock.Advance(reconnectInitialWait)
+
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "event loop did not reconnect")
+	}
+	require.Eventually(t, func() bool {
+		return m.store.eventLoop.currentEventID == "event2"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestEventLoopGivesUpReconnecting(t *testing.T) {
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.client.EXPECT().GetEvent(gomock.Any(), "latestEventID").Return(nil, pmapi.ErrNoConnection).Times(2)
+	m.newStoreNoEvents(t, true)
+
+	stopped := make(chan struct{})
+	m.events.EXPECT().Emit(events.EventLoopStoppedEvent, "userID").Do(func(string, string) {
+		close(stopped)
+	})
+
+	fakeClock := clock.NewFake(time.Now())
+	m.store.eventLoop.clock = fakeClock
+	m.store.eventLoop.maxReconnectAttempts = 2
+
+	m.store.eventLoop.pollNow()
+	require.Eventually(t, func() bool {
+		return fakeClock.Waiters() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	fakeClock.Advance(reconnectInitialWait)
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "event loop did not give up")
+	}
+	require.Eventually(t, func() bool {
+		return !m.store.eventLoop.IsRunning()
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestReconnectWait(t *testing.T) {
+	require.Equal(t, reconnectInitialWait, reconnectWait(1))
+	require.Equal(t, 2*reconnectInitialWait, reconnectWait(2))
+	require.Equal(t, 4*reconnectInitialWait, reconnectWait(3))
+	require.Equal(t, reconnectMaxWait, reconnectWait(100))
+	require.Equal(t, pollInterval, reconnectWait(100))
+}
+
+func TestEventLoopResumePollsRightAway(t *testing.T) {
+	m, clear := initMocks(t)
+	defer clear()
+
+	polled := make(chan struct{})
+	m.client.EXPECT().GetEvent(gomock.Any(), "latestEventID").DoAndReturn(func(_ context.Context, _ string) (*pmapi.Event, error) {
+		defer close(polled)
+		return &pmapi.Event{EventID: "event2"}, nil
+	})
+	m.newStoreNoEvents(t, true)
+
+	m.store.eventLoop.pause()
+	m.store.eventLoop.resume()
+
+	select {
+	case <-polled:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "resumed event loop did not poll")
+	}
+	require.Eventually(t, func() bool {
+		return m.store.eventLoop.currentEventID == "event2"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestEventLoopResumeStoppedDoesNotBlock(t *testing.T) {
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true)
+	loop := m.store.eventLoop
+	loop.stop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			loop.pause()
+			loop.resume()
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail(t, "resume blocked on a stopped event loop")
+	}
+
+	// The pending requests are merged and served when the loop starts again.
+	require.Len(t, loop.wakeCh, 1)
+}
+
 func TestEventLoopUpdateMessageFromLoop(t *testing.T) {
 	m, clear := initMocks(t)
 	defer clear()
@@ -52,7 +52,7 @@ func NewStoreFactory(
 }
 
 // New creates new store for given user.
-func (f *StoreFactory) New(user BridgeUser, connected bool) (*Store, error) {
+func (f *StoreFactory) New(user BridgeUser, connected bool) (UserStore, error) {
 	return New(
 		user,
 		f.listener,
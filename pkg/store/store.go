@@ -413,6 +413,21 @@ func (store *Store) CloseEventLoopAndCacher() {
 	store.msgCachePool.stop()
 }
 
+// PauseEventLoop stops the event loop (if it is present) from polling the API
+// until ResumeEventLoop is called. Events are not lost while paused.
+func (store *Store) PauseEventLoop() {
+	if store.eventLoop != nil {
+		store.eventLoop.pause()
+	}
+}
+
+// ResumeEventLoop resumes the event loop (if it is present) after PauseEventLoop.
+func (store *Store) ResumeEventLoop() {
+	if store.eventLoop != nil {
+		store.eventLoop.resume()
+	}
+}
+
 func (store *Store) close() error {
 	// Stop the event loop and cacher first before closing the DB.
 	store.CloseEventLoopAndCacher()
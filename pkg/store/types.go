@@ -20,6 +20,7 @@ package store
 import (
 	"context"
 
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 )
 
@@ -37,3 +38,20 @@ type BridgeUser interface {
 	CloseConnection(string)
 	Logout() error
 }
+
+// UserStore is the subset of Store used to manage the lifecycle of the store
+// of a single user. Store is the default implementation; other implementations
+// can be plugged in through the store factory of bridge users.
+type UserStore interface {
+	Close() error
+	CloseEventLoopAndCacher()
+	GetAddressID(address string) (string, error)
+	PauseEventLoop()
+	Remove() error
+	RemoveCache() error
+	Resync() error
+	ResumeEventLoop()
+	SetChangeNotifier(notifier ChangeNotifier)
+	StartWatcher()
+	UnlockCache(kr *crypto.KeyRing) error
+}
@@ -149,18 +149,53 @@ func (store *Store) triggerSync() {
 			store.lock.Unlock()
 		}()
 
-		store.log.WithField("isIncomplete", syncState.isIncomplete()).Info("Store sync started")
-
-		err := syncAllMail(store, store.client(), syncState)
-		if err != nil {
+		if err := store.runSync(syncState); err != nil {
 			log.WithError(err).Error("Store sync failed")
-			store.syncCooldown.increaseWaitTime()
-			return
 		}
+	}()
+}
+
+// ErrSyncRunning is returned by Resync while the store is already syncing.
+var ErrSyncRunning = errors.New("store sync is already running")
 
-		store.syncCooldown.reset()
-		syncState.setFinishTime()
+// Resync starts a sync of the store like triggerSync, e.g. when a mailbox got
+// out of sync, but waits for it to finish and returns its error. It is not
+// held back by the cooldown after failed syncs.
+func (store *Store) Resync() error {
+	store.lock.Lock()
+	if store.isSyncRunning {
+		store.lock.Unlock()
+		return ErrSyncRunning
+	}
+	store.isSyncRunning = true
+	store.lock.Unlock()
+
+	defer func() {
+		store.lock.Lock()
+		store.isSyncRunning = false
+		store.lock.Unlock()
 	}()
+
+	syncState := store.loadSyncState()
+	syncState.clearFinishTime()
+
+	return store.runSync(syncState)
+}
+
+// runSync syncs All Mail and records the outcome in the sync state and the
+// cooldown. The caller must have set isSyncRunning.
+func (store *Store) runSync(syncState *syncState) error {
+	store.log.WithField("isIncomplete", syncState.isIncomplete()).Info("Store sync started")
+
+	if err := syncAllMail(store, store.client(), syncState); err != nil {
+		store.syncCooldown.increaseWaitTime()
+		return err
+	}
+
+	store.syncCooldown.reset()
+	syncState.setFinishTime()
+
+	return nil
 }
 
 // isSyncFinished returns whether the database has finished a sync.
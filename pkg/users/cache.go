@@ -188,7 +188,7 @@ func (u *Users) EnableCache() error {
 }
 
 func (u *Users) DisableCache() error {
-	for _, user := range u.users {
+	for _, user := range u.snapshotUsers() {
 		if err := user.store.RemoveCache(); err != nil {
 			logrus.WithError(err).Error("Failed to remove user's message cache")
 		}
@@ -219,7 +219,7 @@ func (u *Users) MigrateCache(srcPath, dstPath string) error {
 		return err
 	}
 
-	for _, user := range u.users {
+	for _, user := range u.snapshotUsers() {
 		if err := user.closeStore(); err != nil {
 			logrus.WithError(err).Error("Failed to close user's store")
 		}
@@ -39,7 +39,70 @@ type Credentials struct {
 	Secret       Secret `json:"-"`
 	SealedSecret []byte
 	SealedKeys   map[string][]byte
-	Key          [32]byte `json:"-"`
+	SlotScopes   map[string]string `json:",omitempty"`
+	Key          [32]byte          `json:"-"`
+
+	// Disabled is stored rather than an enabled flag so that credentials
+	// saved before it existed are enabled, see IsEnabled.
+	Disabled bool `json:",omitempty"`
+
+	// Comment is a free-form note of the operator, e.g. what the account is used for.
+	Comment string `json:",omitempty"`
+}
+
+// Scopes restrict the protocols a key slot can be used with.
+const (
+	ScopeAll  = ""
+	ScopeIMAP = "imap"
+	ScopeSMTP = "smtp"
+)
+
+// ValidScope returns whether scope is one of the known scopes.
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeAll, ScopeIMAP, ScopeSMTP:
+		return true
+	}
+	return false
+}
+
+// SlotAllows returns whether the key slot may be used with protocol.
+// Slots without a scope may be used with any protocol.
+func (s *Credentials) SlotAllows(slot, protocol string) bool {
+	scope := s.SlotScopes[slot]
+	return scope == ScopeAll || scope == protocol
+}
+
+func (s *Credentials) setSlotScope(slot, scope string) {
+	if scope == ScopeAll {
+		delete(s.SlotScopes, slot)
+		return
+	}
+
+	if s.SlotScopes == nil {
+		s.SlotScopes = map[string]string{}
+	}
+	s.SlotScopes[slot] = scope
+}
+
+func (s *Credentials) removeSlot(slot string) {
+	delete(s.SealedKeys, slot)
+	delete(s.SlotScopes, slot)
+}
+
+// wipe removes all key slots and secrets, e.g. once the credentials are deleted.
+func (s *Credentials) wipe() {
+	for slot := range s.SealedKeys {
+		s.removeSlot(slot)
+	}
+
+	s.logout()
+
+	for i := range s.Key {
+		s.Key[i] = 0
+	}
+
+	s.SealedSecret = nil
 }
 
 func (s *Credentials) logout() {
@@ -52,6 +115,12 @@ func (s *Credentials) logout() {
 	s.Secret.MailboxPassword = []byte{}
 }
 
+// IsEnabled returns whether the user may log in; users are enabled unless
+// disabled by Store.SetEnabled.
+func (s *Credentials) IsEnabled() bool {
+	return !s.Disabled
+}
+
 func (s *Credentials) IsConnected() bool {
 	return s.Secret.APIToken != "" && len(s.Secret.MailboxPassword) != 0
 }
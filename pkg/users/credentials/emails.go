@@ -0,0 +1,104 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package credentials
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ljanyst/peroxide/pkg/mailaddr"
+)
+
+const (
+	maxLocalPartLength = 64
+	maxDomainLength    = 255
+)
+
+// normalizeEmails normalizes the addresses and removes duplicates while
+// keeping the original order, see canonicalEmails. It fails if any of the
+// normalized addresses, which are the ones stored, is malformed.
+func normalizeEmails(emails []string) ([]string, error) {
+	canonical := canonicalEmails(emails)
+
+	for _, email := range canonical {
+		if err := validateEmail(email); err != nil {
+			return nil, err
+		}
+	}
+
+	return canonical, nil
+}
+
+// canonicalEmails normalizes the addresses, see mailaddr.Normalize, and removes
+// duplicates while keeping the original order, so that the primary address
+// stays first.
+func canonicalEmails(emails []string) []string {
+	canonical := make([]string, 0, len(emails))
+	seen := make(map[string]struct{}, len(emails))
+
+	for _, email := range emails {
+		email = mailaddr.Normalize(email)
+
+		if _, ok := seen[email]; ok {
+			continue
+		}
+
+		seen[email] = struct{}{}
+		canonical = append(canonical, email)
+	}
+
+	return canonical
+}
+
+// validateEmail performs a simplified RFC 5321 check of a mailbox address.
+func validateEmail(email string) error {
+	invalid := func(reason string) error {
+		return fmt.Errorf("%w %q: %s", ErrInvalidEmail, email, reason)
+	}
+
+	if strings.ContainsAny(email, " \t\r\n<>()[],;:\\\"") {
+		return invalid("contains forbidden characters")
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 || strings.Count(email, "@") != 1 {
+		return invalid("must contain exactly one @")
+	}
+
+	local, domain := email[:at], email[at+1:]
+
+	if local == "" || len(local) > maxLocalPartLength {
+		return invalid("bad local part length")
+	}
+
+	if strings.HasPrefix(local, ".") || strings.HasSuffix(local, ".") || strings.Contains(local, "..") {
+		return invalid("misplaced dot in local part")
+	}
+
+	if domain == "" || len(domain) > maxDomainLength {
+		return invalid("bad domain length")
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return invalid("bad domain label")
+		}
+	}
+
+	return nil
+}
@@ -21,8 +21,12 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path"
 	"sort"
+	"strings"
 	"sync"
 
 	"github.com/sirupsen/logrus"
@@ -36,6 +40,13 @@ var (
 	ErrUnauthorized       = errors.New("Bridge credentials checking failed")
 	ErrAlreadyExists      = errors.New("Credential already exists")
 	ErrCantRemoveMainSlot = errors.New("Cannot remove the main key slot")
+	ErrInvalidPage        = errors.New("Invalid page offset or limit")
+	ErrInvalidKey         = errors.New("Invalid key size")
+	ErrInvalidEmail       = errors.New("Invalid email address")
+	ErrCorrupted          = errors.New("Credentials are corrupted")
+	ErrInvalidScope       = errors.New("Invalid key slot scope")
+	ErrScopeNotAllowed    = errors.New("Key slot is not allowed for this protocol")
+	ErrInsecureFileMode   = errors.New("Credentials file is readable by other users")
 	log                   = logrus.WithField("pkg", "credentials")
 )
 
@@ -44,13 +55,29 @@ type Store struct {
 	lock     sync.RWMutex
 	creds    map[string]*Credentials
 	filePath string
+	sealer   Sealer
 }
 
 // NewStore creates a new encrypted credentials store.
+// A credentials file which is accessible by other users is logged;
+// use CheckFilePermissions to refuse it instead.
 func NewStore(filePath string) (*Store, error) {
+	return NewStoreWithSealer(filePath, fileSealer{})
+}
+
+// NewStoreWithSealer is like NewStore but the credentials file is sealed and
+// unsealed by sealer. A file written with another Sealer cannot be loaded.
+func NewStoreWithSealer(filePath string, sealer Sealer) (*Store, error) {
 	s := &Store{
 		creds:    make(map[string]*Credentials),
 		filePath: filePath,
+		sealer:   sealer,
+	}
+
+	if err := CheckFilePermissions(filePath); errors.Is(err, ErrInsecureFileMode) {
+		log.WithError(err).Warn("Credentials file should only be accessible by its owner (mode 0600)")
+	} else if err != nil {
+		return nil, err
 	}
 
 	if err := s.loadCredentials(); err != nil {
@@ -60,6 +87,79 @@ func NewStore(filePath string) (*Store, error) {
 	return s, nil
 }
 
+// NewStoreWithMainKeys creates a new encrypted credentials store whose main
+// key slots are being migrated to a new main key. The main slot of every entry
+// is opened with the first of `mainKeys` which fits; entries opened with any
+// but the first, primary, key are re-sealed with the primary key. The re-sealed
+// slots are written out with the next change of the store.
+func NewStoreWithMainKeys(filePath string, mainKeys [][]byte) (*Store, error) {
+	s, err := NewStore(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.migrateMainKeys(mainKeys); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Store) migrateMainKeys(mainKeys [][]byte) error {
+	keys := make([][32]byte, len(mainKeys))
+	for i, mainKey := range mainKeys {
+		if len(mainKey) != len(keys[i]) {
+			return ErrInvalidKey
+		}
+		copy(keys[i][:], mainKey)
+	}
+
+	if len(keys) < 2 {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for userID, credentials := range s.creds {
+		sealedKey, ok := credentials.SealedKeys["main"]
+		if !ok {
+			continue
+		}
+
+		if _, err := Decrypt(sealedKey, keys[0]); err == nil {
+			continue
+		}
+
+		migrated := false
+		for _, oldKey := range keys[1:] {
+			key, err := Decrypt(sealedKey, oldKey)
+			if err != nil {
+				continue
+			}
+
+			if credentials.SealedKeys["main"], err = Encrypt(key, keys[0]); err != nil {
+				return err
+			}
+
+			migrated = true
+			break
+		}
+
+		if migrated {
+			log.WithField("user", userID).Info("Main key slot re-sealed with the primary main key")
+		} else {
+			log.WithField("user", userID).Warn("None of the main keys opens the main key slot")
+		}
+	}
+
+	return nil
+}
+
+// Add stores new credentials of the user and returns them together with the
+// key of their main key slot. Add never duplicates credentials: when the user
+// already has credentials it fails with ErrAlreadyExists and leaves them as
+// they are.
 func (s *Store) Add(userID, userName, uid, ref string, mailboxPassword []byte, emails []string) (*Credentials, []byte, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -70,10 +170,14 @@ func (s *Store) Add(userID, userName, uid, ref string, mailboxPassword []byte, e
 		"emails":   emails,
 	}).Trace("Adding new credentials")
 
+	if _, ok := s.creds[userID]; ok {
+		return nil, nil, ErrAlreadyExists
+	}
+
 	creds := &Credentials{
 		UserID: userID,
 		Name:   userName,
-		Emails: emails,
+		Emails: canonicalEmails(emails),
 		Secret: Secret{
 			APIToken:        uid + ":" + ref,
 			MailboxPassword: mailboxPassword,
@@ -81,11 +185,6 @@ func (s *Store) Add(userID, userName, uid, ref string, mailboxPassword []byte, e
 		SealedKeys: make(map[string][]byte),
 	}
 
-	_, ok := s.creds[userID]
-	if ok {
-		return nil, nil, ErrAlreadyExists
-	}
-
 	copy(creds.Key[:], GenerateKey(32))
 
 	var mainKey [32]byte
@@ -117,6 +216,11 @@ func (s *Store) UpdateEmails(userID string, emails []string) (*Credentials, erro
 		return nil, ErrNotFound
 	}
 
+	emails, err := normalizeEmails(emails)
+	if err != nil {
+		return nil, err
+	}
+
 	credentials.Emails = emails
 
 	return credentials, s.saveCredentials()
@@ -164,6 +268,33 @@ func (s *Store) UpdateToken(userID, uid, ref string) (*Credentials, error) {
 	return credentials, s.saveCredentials()
 }
 
+// UpdateRefreshToken replaces only the refresh token, keeping the stored UID.
+func (s *Store) UpdateRefreshToken(userID, ref string) (*Credentials, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	credentials, ok := s.creds[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if credentials.Locked() {
+		return nil, ErrLocked
+	}
+
+	uid, _, err := credentials.SplitAPIToken()
+	if err != nil {
+		return nil, err
+	}
+
+	credentials.Secret.APIToken = uid + ":" + ref
+	if err := credentials.Encrypt(); err != nil {
+		return nil, err
+	}
+
+	return credentials, s.saveCredentials()
+}
+
 func (s *Store) ListKeySlots(userID string) ([]string, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -204,17 +335,25 @@ func (s *Store) RemoveKeySlot(userID, slot string) error {
 		return ErrNotFound
 	}
 
-	delete(credentials.SealedKeys, slot)
+	scope := credentials.SlotScopes[slot]
+	credentials.removeSlot(slot)
 
 	if err := s.saveCredentials(); err != nil {
 		credentials.SealedKeys[slot] = key
+		credentials.setSlotScope(slot, scope)
 		return err
 	}
 
 	return nil
 }
 
-func (s *Store) AddKeySlot(userID, slot, mainKey string) (string, error) {
+// AddKeySlot creates the key slot `slot`. The slot can be restricted to a
+// single protocol by `scope`; ScopeAll grants full access.
+func (s *Store) AddKeySlot(userID, slot, mainKey, scope string) (string, error) {
+	if !ValidScope(scope) {
+		return "", ErrInvalidScope
+	}
+
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
@@ -233,21 +372,103 @@ func (s *Store) AddKeySlot(userID, slot, mainKey string) (string, error) {
 		return "", err
 	}
 
+	return s.addKeySlot(credentials, slot, scope)
+}
+
+// GetOrAddKeySlot creates the key slot `slot` unless it already exists. The
+// returned key is only set when the slot has been created; the key of an
+// existing slot is not stored anywhere and cannot be recovered.
+func (s *Store) GetOrAddKeySlot(userID, slot, mainKey string) (string, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	credentials, ok := s.creds[userID]
+	if !ok {
+		return "", false, ErrNotFound
+	}
+
+	if err := credentials.Unlock("main", mainKey); err != nil {
+		return "", false, err
+	}
+
+	if _, ok := credentials.SealedKeys[slot]; ok {
+		return "", false, nil
+	}
+
+	key, err := s.addKeySlot(credentials, slot, ScopeAll)
+	if err != nil {
+		return "", false, err
+	}
+
+	return key, true, nil
+}
+
+func (s *Store) addKeySlot(credentials *Credentials, slot, scope string) (string, error) {
 	var key [32]byte
 	copy(key[:], GenerateKey(32))
 	if err := credentials.SealKey(slot, key); err != nil {
 		return "", err
 	}
 
+	credentials.setSlotScope(slot, scope)
+
 	if err := s.saveCredentials(); err != nil {
 		delete(credentials.SealedKeys, slot)
+		delete(credentials.SlotScopes, slot)
 		return "", err
 	}
 
 	return base64.StdEncoding.EncodeToString(key[:]), nil
 }
 
-func (s *Store) Logout(userID string) (*Credentials, error) {
+// Rotate re-seals the main key slot of the user with `newKey`. Every user
+// has a main key of its own, so users are rotated one at a time. The slot must
+// be unsealable with `oldKey`; otherwise nothing is changed and an error is
+// returned.
+func (s *Store) Rotate(userID string, oldKey, newKey []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var oldKeyBytes, newKeyBytes [32]byte
+	if len(oldKey) != len(oldKeyBytes) || len(newKey) != len(newKeyBytes) {
+		return ErrInvalidKey
+	}
+	copy(oldKeyBytes[:], oldKey)
+	copy(newKeyBytes[:], newKey)
+
+	credentials, ok := s.creds[userID]
+	if !ok {
+		return ErrNotFound
+	}
+
+	oldSealedKey, ok := credentials.SealedKeys["main"]
+	if !ok {
+		return ErrNotFound
+	}
+
+	key, err := Decrypt(oldSealedKey, oldKeyBytes)
+	if err != nil {
+		return err
+	}
+
+	sealedKey, err := Encrypt(key, newKeyBytes)
+	if err != nil {
+		return err
+	}
+
+	credentials.SealedKeys["main"] = sealedKey
+
+	if err := s.saveCredentials(); err != nil {
+		credentials.SealedKeys["main"] = oldSealedKey
+		return err
+	}
+
+	return nil
+}
+
+// SetEnabled enables or disables logins of the user without touching the
+// rest of the credentials.
+func (s *Store) SetEnabled(userID string, enabled bool) (*Credentials, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
@@ -256,17 +477,72 @@ func (s *Store) Logout(userID string) (*Credentials, error) {
 		return nil, ErrNotFound
 	}
 
+	old := credentials.Disabled
+	credentials.Disabled = !enabled
+
+	if err := s.saveCredentials(); err != nil {
+		credentials.Disabled = old
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+// SetComment replaces the note kept with the credentials of the user; an
+// empty comment removes it.
+func (s *Store) SetComment(userID, comment string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	credentials, ok := s.creds[userID]
+	if !ok {
+		return ErrNotFound
+	}
+
+	old := credentials.Comment
+	credentials.Comment = comment
+
+	if err := s.saveCredentials(); err != nil {
+		credentials.Comment = old
+		return err
+	}
+
+	return nil
+}
+
+func (s *Store) Logout(userID string) (*Credentials, error) {
+	credentials, _, err := s.LogoutChanged(userID)
+	return credentials, err
+}
+
+// LogoutChanged is like Logout but also returns whether the user was connected
+// before, i.e. false when logging out was a no-op.
+func (s *Store) LogoutChanged(userID string) (*Credentials, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	credentials, ok := s.creds[userID]
+	if !ok {
+		return nil, false, ErrNotFound
+	}
+
 	if credentials.Locked() {
-		return nil, ErrLocked
+		return nil, false, ErrLocked
 	}
 
+	changed := credentials.IsConnected()
+
 	if err := credentials.Encrypt(); err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	credentials.logout()
 
-	return credentials, s.saveCredentials()
+	if err := s.saveCredentials(); err != nil {
+		return credentials, false, err
+	}
+
+	return credentials, changed, nil
 }
 
 // List returns a list of usernames that have credentials stored.
@@ -285,6 +561,83 @@ func (s *Store) List() ([]string, error) {
 	return userIDs, nil
 }
 
+// ListPage returns at most `limit` user IDs starting at `offset`. The IDs are
+// sorted the same way as in List so that consecutive pages are consistent.
+func (s *Store) ListPage(offset, limit int) ([]string, error) {
+	if offset < 0 || limit <= 0 {
+		return nil, ErrInvalidPage
+	}
+
+	userIDs, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	if offset >= len(userIDs) {
+		return []string{}, nil
+	}
+
+	// Compare against the remaining length so that huge limits cannot overflow.
+	end := len(userIDs)
+	if limit < end-offset {
+		end = offset + limit
+	}
+
+	return userIDs[offset:end], nil
+}
+
+// ListByEmailPrefix returns the sorted IDs of users having at least one email
+// starting with `prefix`, compared case-insensitively. The prefix may contain
+// `*` wildcards, e.g. `*@example.com` selects all users of a domain; any other
+// character, including `?`, `[` and `\`, matches only itself.
+func (s *Store) ListByEmailPrefix(prefix string) ([]string, error) {
+	pattern := emailPatternEscaper.Replace(strings.ToLower(prefix)) + "*"
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	userIDs := []string{}
+	for id, credentials := range s.creds {
+		for _, email := range credentials.Emails {
+			if ok, _ := path.Match(pattern, strings.ToLower(email)); ok {
+				userIDs = append(userIDs, id)
+				break
+			}
+		}
+	}
+	sort.Strings(userIDs)
+
+	return userIDs, nil
+}
+
+// emailPatternEscaper escapes the path.Match syntax other than `*`.
+var emailPatternEscaper = strings.NewReplacer(`\`, `\\`, `?`, `\?`, `[`, `\[`) //nolint:gochecknoglobals
+
+// FindEmailConflicts returns the addresses claimed by more than one user,
+// each mapped to the sorted IDs of those users. Addresses are compared
+// case-insensitively, as older versions stored them without normalizing.
+func (s *Store) FindEmailConflicts() map[string][]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	owners := map[string][]string{}
+	for id, credentials := range s.creds {
+		for _, email := range canonicalEmails(credentials.Emails) {
+			owners[email] = append(owners[email], id)
+		}
+	}
+
+	conflicts := map[string][]string{}
+	for email, userIDs := range owners {
+		if len(userIDs) > 1 {
+			sort.Strings(userIDs)
+			conflicts[email] = userIDs
+		}
+	}
+
+	return conflicts
+}
+
 func (s *Store) Get(userID string) (creds *Credentials, err error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
@@ -296,32 +649,101 @@ func (s *Store) Get(userID string) (creds *Credentials, err error) {
 	return creds, nil
 }
 
-// Delete removes credentials from the store.
+// GetEmails returns a copy of the emails of the user. It lets callers which
+// only need the addresses avoid handling the whole credentials.
+func (s *Store) GetEmails(userID string) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	creds, ok := s.creds[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return append([]string{}, creds.Emails...), nil
+}
+
+// GetAll returns the credentials of all users sorted by user ID. Unlike List
+// followed by Get for each user, all credentials are read under a single lock.
+func (s *Store) GetAll() ([]*Credentials, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	all := make([]*Credentials, 0, len(s.creds))
+	for _, creds := range s.creds {
+		all = append(all, creds)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].UserID < all[j].UserID })
+
+	return all, nil
+}
+
+// Delete removes credentials from the store together with all their key slots.
+// The keys and secrets of the removed credentials are wiped.
 func (s *Store) Delete(userID string) (err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	_, ok := s.creds[userID]
+	credentials, ok := s.creds[userID]
 	if !ok {
 		return ErrNotFound
 	}
 
 	delete(s.creds, userID)
-	return s.saveCredentials()
+
+	if err := s.saveCredentials(); err != nil {
+		s.creds[userID] = credentials
+		return err
+	}
+
+	// Callers may still hold the credentials; do not leave the keys behind.
+	credentials.wipe()
+
+	return nil
+}
+
+// CheckFilePermissions returns ErrInsecureFileMode if the credentials file
+// at filePath can be accessed by the group or others. A missing file is fine.
+func CheckFilePermissions(filePath string) error {
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if mode := info.Mode().Perm(); mode&0o077 != 0 {
+		return fmt.Errorf("%w: %s has mode %#o", ErrInsecureFileMode, filePath, mode)
+	}
+
+	return nil
 }
 
 func (s *Store) saveCredentials() error {
-	f, err := os.Create(s.filePath)
+	data, err := json.Marshal(s.creds)
+	if err != nil {
+		return err
+	}
+
+	if data, err = s.sealer.Seal(append(data, '\n')); err != nil {
+		return fmt.Errorf("%w: %v", ErrEncryptionFailed, err)
+	}
+
+	// The mode only applies to new files; see CheckFilePermissions.
+	f, err := os.OpenFile(s.filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	return json.NewEncoder(f).Encode(s.creds)
+	_, err = f.Write(data)
+	return err
 }
 
 func (s *Store) loadCredentials() error {
-	f, err := os.Open(s.filePath)
+	data, err := ioutil.ReadFile(s.filePath)
 	if os.IsNotExist(err) {
 		return nil
 	}
@@ -329,11 +751,10 @@ func (s *Store) loadCredentials() error {
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	if err := json.NewDecoder(f).Decode(&s.creds); err != nil {
-		return err
+	if data, err = s.sealer.Unseal(data); err != nil {
+		return fmt.Errorf("%w: %v", ErrDecryptionFailed, err)
 	}
 
-	return nil
+	return json.Unmarshal(data, &s.creds)
 }
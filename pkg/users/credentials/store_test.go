@@ -0,0 +1,704 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package credentials
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	r "github.com/stretchr/testify/require"
+)
+
+func newTestStore(t *testing.T) *Store {
+	s, err := NewStore(filepath.Join(t.TempDir(), "credentials.json"))
+	r.NoError(t, err)
+	return s
+}
+
+func TestStoreListPage(t *testing.T) {
+	s := newTestStore(t)
+
+	for _, userID := range []string{"user5", "user3", "user1", "user4", "user2"} {
+		_, _, err := s.Add(userID, userID, "uid", "ref", []byte("pass"), []string{userID + "@pm.me"})
+		r.NoError(t, err)
+	}
+
+	page, err := s.ListPage(0, 3)
+	r.NoError(t, err)
+	r.Equal(t, []string{"user1", "user2", "user3"}, page)
+
+	page, err = s.ListPage(3, 3)
+	r.NoError(t, err)
+	r.Equal(t, []string{"user4", "user5"}, page)
+
+	page, err = s.ListPage(1, math.MaxInt32)
+	r.NoError(t, err)
+	r.Equal(t, []string{"user2", "user3", "user4", "user5"}, page)
+
+	page, err = s.ListPage(1, int(^uint(0)>>1))
+	r.NoError(t, err)
+	r.Equal(t, []string{"user2", "user3", "user4", "user5"}, page)
+
+	page, err = s.ListPage(5, 3)
+	r.NoError(t, err)
+	r.Empty(t, page)
+
+	_, err = s.ListPage(-1, 3)
+	r.Equal(t, ErrInvalidPage, err)
+
+	_, err = s.ListPage(0, 0)
+	r.Equal(t, ErrInvalidPage, err)
+}
+
+func TestStoreFindEmailConflicts(t *testing.T) {
+	s := newTestStore(t)
+
+	for userID, emails := range map[string][]string{
+		"alice": {"alice@example.com", "shared@example.com"},
+		"bob":   {"bob@example.com"},
+		"carol": {"carol@example.com"},
+	} {
+		_, _, err := s.Add(userID, userID, "uid", "ref", []byte("pass"), emails)
+		r.NoError(t, err)
+	}
+
+	r.Empty(t, s.FindEmailConflicts())
+
+	// Emails stored before they were normalized.
+	s.creds["bob"].Emails = append(s.creds["bob"].Emails, "Shared@Example.com")
+	s.creds["carol"].Emails = append(s.creds["carol"].Emails, "shared@example.com", " SHARED@example.com ")
+
+	r.Equal(t, map[string][]string{
+		"shared@example.com": {"alice", "bob", "carol"},
+	}, s.FindEmailConflicts())
+}
+
+func TestStoreListByEmailPrefix(t *testing.T) {
+	s := newTestStore(t)
+
+	seed := map[string][]string{
+		"alice": {"alice@example.com"},
+		"bob":   {"bob@other.org", "Bob@Example.com"},
+		"carol": {"carol@other.org"},
+		"dave":  {`da[v]e?\x@other.org`},
+	}
+	for userID, emails := range seed {
+		_, _, err := s.Add(userID, userID, "uid", "ref", []byte("pass"), emails)
+		r.NoError(t, err)
+	}
+
+	userIDs, err := s.ListByEmailPrefix("*@EXAMPLE.com")
+	r.NoError(t, err)
+	r.Equal(t, []string{"alice", "bob"}, userIDs)
+
+	userIDs, err = s.ListByEmailPrefix("car")
+	r.NoError(t, err)
+	r.Equal(t, []string{"carol"}, userIDs)
+
+	userIDs, err = s.ListByEmailPrefix("")
+	r.NoError(t, err)
+	r.Equal(t, []string{"alice", "bob", "carol", "dave"}, userIDs)
+
+	// Pattern syntax other than `*` matches literally.
+	for _, prefix := range []string{"da[", `da[v]e?\`, "*?"} {
+		userIDs, err = s.ListByEmailPrefix(prefix)
+		r.NoError(t, err, prefix)
+		r.Equal(t, []string{"dave"}, userIDs, prefix)
+	}
+
+	for _, prefix := range []string{"[", "c?rol", `\`} {
+		userIDs, err = s.ListByEmailPrefix(prefix)
+		r.NoError(t, err, prefix)
+		r.Empty(t, userIDs, prefix)
+	}
+}
+
+func addTestCredentials(t *testing.T, s *Store, userID string, mainKey [32]byte) {
+	creds := &Credentials{
+		UserID: userID,
+		Name:   userID,
+		Emails: []string{userID + "@pm.me"},
+		Secret: Secret{
+			APIToken:        "uid:ref",
+			MailboxPassword: []byte("pass"),
+		},
+		SealedKeys: make(map[string][]byte),
+	}
+
+	copy(creds.Key[:], GenerateKey(32))
+	r.NoError(t, creds.SealKey("main", mainKey))
+	r.NoError(t, creds.Encrypt())
+
+	s.creds[userID] = creds
+}
+
+func TestStoreRotate(t *testing.T) {
+	s := newTestStore(t)
+
+	// Add gives every user a main key of its own.
+	_, key1, err := s.Add("user1", "user1", "uid", "ref", []byte("pass"), []string{"user1@pm.me"})
+	r.NoError(t, err)
+	_, key2, err := s.Add("user2", "user2", "uid", "ref", []byte("pass"), []string{"user2@pm.me"})
+	r.NoError(t, err)
+
+	var newKey1, newKey2 [32]byte
+	copy(newKey1[:], GenerateKey(32))
+	copy(newKey2[:], GenerateKey(32))
+
+	r.NoError(t, s.Rotate("user1", key1, newKey1[:]))
+	r.NoError(t, s.Rotate("user2", key2, newKey2[:]))
+
+	// Reload from disk to make sure the rotation was persisted.
+	s, err = NewStore(s.filePath)
+	r.NoError(t, err)
+
+	for userID, keys := range map[string][2][]byte{
+		"user1": {key1, newKey1[:]},
+		"user2": {key2, newKey2[:]},
+	} {
+		creds, err := s.Get(userID)
+		r.NoError(t, err)
+		r.Error(t, creds.Unlock("main", base64.StdEncoding.EncodeToString(keys[0])), userID)
+		r.NoError(t, creds.Unlock("main", base64.StdEncoding.EncodeToString(keys[1])), userID)
+		r.Equal(t, []byte("pass"), creds.Secret.MailboxPassword)
+	}
+}
+
+func TestStoreRotateRollback(t *testing.T) {
+	s := newTestStore(t)
+
+	var oldKey, otherKey, newKey [32]byte
+	copy(oldKey[:], GenerateKey(32))
+	copy(otherKey[:], GenerateKey(32))
+	copy(newKey[:], GenerateKey(32))
+
+	addTestCredentials(t, s, "user1", oldKey)
+
+	r.Equal(t, ErrDecryptionFailed, s.Rotate("user1", otherKey[:], newKey[:]))
+
+	creds, err := s.Get("user1")
+	r.NoError(t, err)
+	r.NoError(t, creds.Unlock("main", base64.StdEncoding.EncodeToString(oldKey[:])))
+
+	r.Equal(t, ErrInvalidKey, s.Rotate("user1", oldKey[:8], newKey[:]))
+	r.Equal(t, ErrNotFound, s.Rotate("unknown", oldKey[:], newKey[:]))
+}
+
+func TestNewStoreWithMainKeys(t *testing.T) {
+	s := newTestStore(t)
+
+	var oldKey, newKey, otherKey [32]byte
+	copy(oldKey[:], GenerateKey(32))
+	copy(newKey[:], GenerateKey(32))
+	copy(otherKey[:], GenerateKey(32))
+
+	addTestCredentials(t, s, "migrated", newKey)
+	addTestCredentials(t, s, "legacy", oldKey)
+	addTestCredentials(t, s, "unknown", otherKey)
+	r.NoError(t, s.saveCredentials())
+
+	s, err := NewStoreWithMainKeys(s.filePath, [][]byte{newKey[:], oldKey[:]})
+	r.NoError(t, err)
+
+	for _, userID := range []string{"migrated", "legacy"} {
+		creds, err := s.Get(userID)
+		r.NoError(t, err)
+		r.NoError(t, creds.Unlock("main", base64.StdEncoding.EncodeToString(newKey[:])), userID)
+		r.Equal(t, []byte("pass"), creds.Secret.MailboxPassword)
+	}
+
+	// Entries no key fits are left untouched.
+	creds, err := s.Get("unknown")
+	r.NoError(t, err)
+	r.NoError(t, creds.Unlock("main", base64.StdEncoding.EncodeToString(otherKey[:])))
+
+	// The re-sealed slot is persisted with the next write.
+	_, err = s.UpdateEmails("migrated", []string{"migrated@pm.me"})
+	r.NoError(t, err)
+
+	s, err = NewStore(s.filePath)
+	r.NoError(t, err)
+
+	creds, err = s.Get("legacy")
+	r.NoError(t, err)
+	r.Error(t, creds.Unlock("main", base64.StdEncoding.EncodeToString(oldKey[:])))
+	r.NoError(t, creds.Unlock("main", base64.StdEncoding.EncodeToString(newKey[:])))
+
+	_, err = NewStoreWithMainKeys(s.filePath, [][]byte{newKey[:8]})
+	r.Equal(t, ErrInvalidKey, err)
+}
+
+func TestStoreUpdateEmails(t *testing.T) {
+	s := newTestStore(t)
+
+	_, _, err := s.Add("user", "user", "uid", "ref", []byte("pass"), []string{"user@pm.me"})
+	r.NoError(t, err)
+
+	creds, err := s.UpdateEmails("user", []string{"User@PM.me", "alias@pm.me"})
+	r.NoError(t, err)
+	r.Equal(t, []string{"user@pm.me", "alias@pm.me"}, creds.Emails)
+
+	creds, err = s.UpdateEmails("user", []string{"alias@pm.me", "user@pm.me", "ALIAS@pm.me"})
+	r.NoError(t, err)
+	r.Equal(t, []string{"alias@pm.me", "user@pm.me"}, creds.Emails)
+
+	// Addresses are validated as they are stored, i.e. once normalized.
+	creds, err = s.UpdateEmails("user", []string{" Alias@PM.me\t", "user@pm.me "})
+	r.NoError(t, err)
+	r.Equal(t, []string{"alias@pm.me", "user@pm.me"}, creds.Emails)
+
+	for _, email := range []string{"", "user", "user@", "@pm.me", "us er@pm.me", "a@b@pm.me", "user@pm..me", ".user@pm.me"} {
+		_, err = s.UpdateEmails("user", []string{"user@pm.me", email})
+		r.True(t, errors.Is(err, ErrInvalidEmail), email)
+	}
+
+	// Rejected updates must not modify the stored addresses.
+	creds, err = s.Get("user")
+	r.NoError(t, err)
+	r.Equal(t, []string{"alias@pm.me", "user@pm.me"}, creds.Emails)
+}
+
+func TestStoreAddDeduplicatesEmails(t *testing.T) {
+	s := newTestStore(t)
+
+	creds, _, err := s.Add("user", "user", "uid", "ref", []byte("pass"), []string{"Foo@x.com", "bar@x.com", "foo@x.com"})
+	r.NoError(t, err)
+	r.Equal(t, []string{"foo@x.com", "bar@x.com"}, creds.Emails)
+
+	creds, err = s.UpdateEmails("user", []string{"Foo@x.com", "foo@x.com"})
+	r.NoError(t, err)
+	r.Equal(t, []string{"foo@x.com"}, creds.Emails)
+
+	// Punycode and Unicode spellings of a domain are the same address.
+	creds, err = s.UpdateEmails("user", []string{"foo@xn--bcher-kva.example", "Foo@bücher.example"})
+	r.NoError(t, err)
+	r.Equal(t, []string{"foo@bücher.example"}, creds.Emails)
+}
+
+func TestStoreAddExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	s, err := NewStore(path)
+	r.NoError(t, err)
+
+	_, mainKey, err := s.Add("user", "user", "uid", "ref", []byte("pass"), []string{"user@pm.me", "alias@pm.me"})
+	r.NoError(t, err)
+	_, err = s.AddKeySlot("user", "phone", base64.StdEncoding.EncodeToString(mainKey), ScopeAll)
+	r.NoError(t, err)
+
+	creds, newKey, err := s.Add("user", "renamed", "uid2", "ref2", []byte("pass2"), []string{"Other@pm.me", "alias@pm.me"})
+	r.ErrorIs(t, err, ErrAlreadyExists)
+	r.Nil(t, creds)
+	r.Nil(t, newKey)
+
+	// Neither the loaded nor the saved credentials are changed.
+	for _, store := range []*Store{s, mustNewStore(t, path)} {
+		userIDs, err := store.List()
+		r.NoError(t, err)
+		r.Equal(t, []string{"user"}, userIDs)
+
+		creds, err := store.Get("user")
+		r.NoError(t, err)
+		r.Equal(t, "user", creds.Name)
+		r.Equal(t, []string{"user@pm.me", "alias@pm.me"}, creds.Emails)
+
+		slots, err := store.ListKeySlots("user")
+		r.NoError(t, err)
+		r.Equal(t, []string{"main", "phone"}, slots)
+
+		r.NoError(t, creds.Unlock("main", base64.StdEncoding.EncodeToString(mainKey)))
+		r.Equal(t, "uid:ref", creds.Secret.APIToken)
+		r.Equal(t, []byte("pass"), creds.Secret.MailboxPassword)
+	}
+}
+
+func mustNewStore(t *testing.T, path string) *Store {
+	s, err := NewStore(path)
+	r.NoError(t, err)
+
+	return s
+}
+
+func TestStoreUpdateRefreshToken(t *testing.T) {
+	s := newTestStore(t)
+
+	_, _, err := s.Add("user", "user", "uid", "ref", []byte("pass"), []string{"user@pm.me"})
+	r.NoError(t, err)
+
+	creds, err := s.UpdateRefreshToken("user", "newref")
+	r.NoError(t, err)
+
+	uid, ref, err := creds.SplitAPIToken()
+	r.NoError(t, err)
+	r.Equal(t, "uid", uid)
+	r.Equal(t, "newref", ref)
+
+	_, err = s.UpdateRefreshToken("nouser", "newref")
+	r.Equal(t, ErrNotFound, err)
+}
+
+func TestStoreVerify(t *testing.T) {
+	s := newTestStore(t)
+
+	var mainKey [32]byte
+	copy(mainKey[:], GenerateKey(32))
+
+	addTestCredentials(t, s, "good", mainKey)
+	addTestCredentials(t, s, "corrupt", mainKey)
+	addTestCredentials(t, s, "undecryptable", mainKey)
+	r.NoError(t, s.saveCredentials())
+
+	// Reload so that all entries are locked as they are at startup.
+	s, err := NewStore(s.filePath)
+	r.NoError(t, err)
+	r.Empty(t, s.Verify())
+
+	s.creds["corrupt"].SealedKeys["main"] = s.creds["corrupt"].SealedKeys["main"][:10]
+
+	errs := s.Verify()
+	r.Len(t, errs, 1)
+	r.True(t, errors.Is(errs[0], ErrCorrupted))
+	r.Contains(t, errs[0].Error(), "corrupt")
+
+	// Unlocked entries are decrypted too.
+	r.NoError(t, s.creds["undecryptable"].Unlock("main", base64.StdEncoding.EncodeToString(mainKey[:])))
+	s.creds["undecryptable"].SealedSecret[30] ^= 0xff
+
+	r.Len(t, s.Verify(), 2)
+}
+
+func TestStoreGetOrAddKeySlot(t *testing.T) {
+	s := newTestStore(t)
+
+	_, mainKey, err := s.Add("user", "user", "uid", "ref", []byte("pass"), []string{"user@pm.me"})
+	r.NoError(t, err)
+	mainKeyString := base64.StdEncoding.EncodeToString(mainKey)
+
+	key, created, err := s.GetOrAddKeySlot("user", "phone", mainKeyString)
+	r.NoError(t, err)
+	r.True(t, created)
+	r.NotEmpty(t, key)
+
+	key, created, err = s.GetOrAddKeySlot("user", "phone", mainKeyString)
+	r.NoError(t, err)
+	r.False(t, created)
+	r.Empty(t, key)
+
+	slots, err := s.ListKeySlots("user")
+	r.NoError(t, err)
+	r.Equal(t, []string{"main", "phone"}, slots)
+
+	_, _, err = s.GetOrAddKeySlot("user", "laptop", base64.StdEncoding.EncodeToString(GenerateKey(32)))
+	r.Error(t, err)
+}
+
+func TestStoreAddKeySlotScope(t *testing.T) {
+	s := newTestStore(t)
+
+	_, mainKey, err := s.Add("user", "user", "uid", "ref", []byte("pass"), []string{"user@pm.me"})
+	r.NoError(t, err)
+	mainKeyString := base64.StdEncoding.EncodeToString(mainKey)
+
+	_, err = s.AddKeySlot("user", "phone", mainKeyString, "pop3")
+	r.Equal(t, ErrInvalidScope, err)
+
+	_, err = s.AddKeySlot("user", "phone", mainKeyString, ScopeIMAP)
+	r.NoError(t, err)
+
+	reloaded, err := NewStore(s.filePath)
+	r.NoError(t, err)
+	creds, err := reloaded.Get("user")
+	r.NoError(t, err)
+	r.True(t, creds.SlotAllows("phone", ScopeIMAP))
+	r.False(t, creds.SlotAllows("phone", ScopeSMTP))
+	r.True(t, creds.SlotAllows("main", ScopeSMTP))
+
+	r.NoError(t, s.RemoveKeySlot("user", "phone"))
+	creds, err = s.Get("user")
+	r.NoError(t, err)
+	r.Empty(t, creds.SlotScopes)
+}
+
+func TestStoreGetAll(t *testing.T) {
+	s := newTestStore(t)
+
+	for _, userID := range []string{"user3", "user1", "user2"} {
+		_, _, err := s.Add(userID, userID, "uid", "ref", []byte("pass"), []string{userID + "@pm.me"})
+		r.NoError(t, err)
+	}
+
+	all, err := s.GetAll()
+	r.NoError(t, err)
+
+	userIDs := []string{}
+	for _, creds := range all {
+		userIDs = append(userIDs, creds.UserID)
+	}
+	r.Equal(t, []string{"user1", "user2", "user3"}, userIDs)
+	r.Equal(t, []string{"user2@pm.me"}, all[1].Emails)
+}
+
+func TestStoreGetEmails(t *testing.T) {
+	s := newTestStore(t)
+
+	_, _, err := s.Add("user", "user", "uid", "ref", []byte("pass"), []string{"user@pm.me", "alias@pm.me"})
+	r.NoError(t, err)
+
+	emails, err := s.GetEmails("user")
+	r.NoError(t, err)
+	r.Equal(t, []string{"user@pm.me", "alias@pm.me"}, emails)
+
+	// The returned slice does not alias the stored one.
+	emails[0] = "changed@pm.me"
+	creds, err := s.Get("user")
+	r.NoError(t, err)
+	r.Equal(t, "user@pm.me", creds.Emails[0])
+
+	_, err = s.GetEmails("unknown")
+	r.Equal(t, ErrNotFound, err)
+}
+
+func TestStoreLogoutChanged(t *testing.T) {
+	s := newTestStore(t)
+
+	_, _, err := s.Add("user", "user", "uid", "ref", []byte("pass"), []string{"user@pm.me"})
+	r.NoError(t, err)
+
+	creds, changed, err := s.LogoutChanged("user")
+	r.NoError(t, err)
+	r.True(t, changed)
+	r.False(t, creds.IsConnected())
+
+	// Logging out again changes nothing.
+	creds, changed, err = s.LogoutChanged("user")
+	r.NoError(t, err)
+	r.False(t, changed)
+	r.False(t, creds.IsConnected())
+
+	_, _, err = s.LogoutChanged("unknown")
+	r.Equal(t, ErrNotFound, err)
+}
+
+func TestCheckFilePermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	r.NoError(t, CheckFilePermissions(path), "missing file")
+
+	r.NoError(t, ioutil.WriteFile(path, []byte("{}"), 0o600))
+	r.NoError(t, os.Chmod(path, 0o600))
+	r.NoError(t, CheckFilePermissions(path))
+
+	r.NoError(t, os.Chmod(path, 0o644))
+	r.ErrorIs(t, CheckFilePermissions(path), ErrInsecureFileMode)
+}
+
+func TestNewStoreWarnsOnInsecureFileMode(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	r.NoError(t, ioutil.WriteFile(path, []byte("{}"), 0o600))
+	r.NoError(t, os.Chmod(path, 0o644))
+
+	_, err := NewStore(path)
+	r.NoError(t, err)
+	r.NotNil(t, hook.LastEntry())
+	r.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+
+	hook.Reset()
+	r.NoError(t, os.Chmod(path, 0o600))
+
+	_, err = NewStore(path)
+	r.NoError(t, err)
+	r.Nil(t, hook.LastEntry())
+}
+
+func TestStoreCreatesPrivateFile(t *testing.T) {
+	s := newTestStore(t)
+
+	_, _, err := s.Add("user", "user", "uid", "ref", []byte("pass"), []string{"user@pm.me"})
+	r.NoError(t, err)
+
+	r.NoError(t, CheckFilePermissions(s.filePath))
+}
+
+func TestStoreDeleteRemovesKeySlots(t *testing.T) {
+	s := newTestStore(t)
+
+	_, mainKey, err := s.Add("user", "user", "uid", "ref", []byte("pass"), []string{"user@pm.me"})
+	r.NoError(t, err)
+	mainKeyString := base64.StdEncoding.EncodeToString(mainKey)
+
+	_, err = s.AddKeySlot("user", "phone", mainKeyString, ScopeIMAP)
+	r.NoError(t, err)
+	_, err = s.AddKeySlot("user", "laptop", mainKeyString, ScopeAll)
+	r.NoError(t, err)
+
+	creds, err := s.Get("user")
+	r.NoError(t, err)
+
+	r.NoError(t, s.Delete("user"))
+
+	_, err = s.ListKeySlots("user")
+	r.Equal(t, ErrNotFound, err)
+
+	// Credentials obtained before the deletion no longer hold any keys.
+	r.Empty(t, creds.SealedKeys)
+	r.Empty(t, creds.SlotScopes)
+	r.Empty(t, creds.SealedSecret)
+	r.True(t, creds.Locked())
+	r.False(t, creds.IsConnected())
+
+	data, err := ioutil.ReadFile(s.filePath)
+	r.NoError(t, err)
+	r.NotContains(t, string(data), "phone")
+	r.NotContains(t, string(data), "laptop")
+
+	reloaded, err := NewStore(s.filePath)
+	r.NoError(t, err)
+	_, err = reloaded.ListKeySlots("user")
+	r.Equal(t, ErrNotFound, err)
+}
+
+func TestStoreSetEnabled(t *testing.T) {
+	s := newTestStore(t)
+
+	creds, _, err := s.Add("user", "user", "uid", "ref", []byte("pass"), []string{"user@pm.me"})
+	r.NoError(t, err)
+	r.True(t, creds.IsEnabled())
+
+	// Enabled users do not store the flag, like those saved before it existed.
+	data, err := ioutil.ReadFile(s.filePath)
+	r.NoError(t, err)
+	r.NotContains(t, string(data), "Disabled")
+
+	creds, err = s.SetEnabled("user", false)
+	r.NoError(t, err)
+	r.False(t, creds.IsEnabled())
+
+	reloaded, err := NewStore(s.filePath)
+	r.NoError(t, err)
+	creds, err = reloaded.Get("user")
+	r.NoError(t, err)
+	r.False(t, creds.IsEnabled())
+
+	creds, err = reloaded.SetEnabled("user", true)
+	r.NoError(t, err)
+	r.True(t, creds.IsEnabled())
+
+	_, err = reloaded.SetEnabled("unknown", true)
+	r.Equal(t, ErrNotFound, err)
+}
+
+func TestStoreSetEnabledRollsBackOnSaveError(t *testing.T) {
+	s := newTestStore(t)
+
+	_, _, err := s.Add("user", "user", "uid", "ref", []byte("pass"), []string{"user@pm.me"})
+	r.NoError(t, err)
+
+	// Saving fails because the directory of the file does not exist.
+	s.filePath = filepath.Join(t.TempDir(), "missing", "credentials.json")
+
+	_, err = s.SetEnabled("user", false)
+	r.Error(t, err)
+
+	creds, err := s.Get("user")
+	r.NoError(t, err)
+	r.True(t, creds.IsEnabled())
+}
+
+func TestStoreSetComment(t *testing.T) {
+	s := newTestStore(t)
+
+	_, _, err := s.Add("user", "user", "uid", "ref", []byte("pass"), []string{"user@pm.me"})
+	r.NoError(t, err)
+
+	r.NoError(t, s.SetComment("user", "shipping dept shared inbox"))
+
+	reloaded, err := NewStore(s.filePath)
+	r.NoError(t, err)
+	creds, err := reloaded.Get("user")
+	r.NoError(t, err)
+	r.Equal(t, "shipping dept shared inbox", creds.Comment)
+
+	// Removing the comment leaves no trace in the file.
+	r.NoError(t, reloaded.SetComment("user", ""))
+	data, err := ioutil.ReadFile(s.filePath)
+	r.NoError(t, err)
+	r.NotContains(t, string(data), "Comment")
+
+	r.Equal(t, ErrNotFound, reloaded.SetComment("unknown", "note"))
+}
+
+// xorSealer stands in for a keyring or KMS backed Sealer.
+type xorSealer struct {
+	sealed, unsealed int
+}
+
+func (s *xorSealer) Seal(data []byte) ([]byte, error) {
+	s.sealed++
+	return xor(data), nil
+}
+
+func (s *xorSealer) Unseal(data []byte) ([]byte, error) {
+	s.unsealed++
+	return xor(data), nil
+}
+
+func xor(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = b ^ 0x5a
+	}
+	return out
+}
+
+func TestStoreWithSealer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	sealer := &xorSealer{}
+
+	s, err := NewStoreWithSealer(path, sealer)
+	r.NoError(t, err)
+
+	creds, mainKey, err := s.Add("user", "name", "uid", "ref", []byte("pass"), []string{"user@pm.me"})
+	r.NoError(t, err)
+	r.Equal(t, 1, sealer.sealed)
+
+	data, err := ioutil.ReadFile(path)
+	r.NoError(t, err)
+	r.NotContains(t, string(data), "user@pm.me")
+
+	s, err = NewStoreWithSealer(path, sealer)
+	r.NoError(t, err)
+	r.Equal(t, 1, sealer.unsealed)
+
+	loaded, err := s.Get("user")
+	r.NoError(t, err)
+	r.Equal(t, creds.Emails, loaded.Emails)
+	r.NoError(t, loaded.Unlock("main", base64.StdEncoding.EncodeToString(mainKey)))
+	r.Equal(t, "uid:ref", loaded.Secret.APIToken)
+
+	// The default sealer cannot read the sealed file.
+	_, err = NewStore(path)
+	r.Error(t, err)
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package credentials
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	nonceSize     = 24
+	sealedKeySize = nonceSize + 32 + secretbox.Overhead
+)
+
+// Verify checks every stored entry and returns one error per broken entry.
+// Sealed data of locked entries can only be checked structurally; unlocked
+// entries are decrypted as well.
+func (s *Store) Verify() []error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	userIDs := make([]string, 0, len(s.creds))
+	for userID := range s.creds {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+
+	var errs []error
+	for _, userID := range userIDs {
+		if err := verifyCredentials(userID, s.creds[userID]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", userID, err))
+		}
+	}
+
+	return errs
+}
+
+func verifyCredentials(userID string, creds *Credentials) error {
+	if creds == nil {
+		return fmt.Errorf("%w: empty entry", ErrCorrupted)
+	}
+
+	if creds.UserID != userID {
+		return fmt.Errorf("%w: entry belongs to %q", ErrCorrupted, creds.UserID)
+	}
+
+	if _, ok := creds.SealedKeys["main"]; !ok {
+		return fmt.Errorf("%w: main key slot is missing", ErrCorrupted)
+	}
+
+	for slot, sealedKey := range creds.SealedKeys {
+		if len(sealedKey) != sealedKeySize {
+			return fmt.Errorf("%w: key slot %q has a bad size", ErrCorrupted, slot)
+		}
+	}
+
+	if len(creds.SealedSecret) < nonceSize+secretbox.Overhead {
+		return fmt.Errorf("%w: sealed secret is truncated", ErrCorrupted)
+	}
+
+	if creds.Locked() {
+		return nil
+	}
+
+	decrypted, err := Decrypt(creds.SealedSecret, creds.Key)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+
+	var secret Secret
+	if err := json.Unmarshal(decrypted, &secret); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package users
+
+import (
+	"github.com/ljanyst/peroxide/pkg/users/credentials"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrBadSlotPassword is the reason of a login rejected because of a wrong key slot password.
+	ErrBadSlotPassword = errors.New("wrong key slot password")
+
+	// ErrUserLocked is the reason of a login rejected because the account cannot
+	// be used until it is logged in again from the app.
+	ErrUserLocked = errors.New("account is locked")
+
+	// ErrBackendUnavailable is the reason of a login which failed because the API could not be reached.
+	ErrBackendUnavailable = errors.New("backend is unavailable")
+)
+
+// LoginError is a failed login together with its reason, one of
+// ErrBadSlotPassword, ErrUserLocked, ErrUserDisabled or ErrBackendUnavailable.
+// errors.Is matches both the reason and the underlying error.
+type LoginError struct {
+	Reason error
+	Err    error
+}
+
+func (e *LoginError) Error() string        { return e.Reason.Error() + ": " + e.Err.Error() }
+func (e *LoginError) Unwrap() error        { return e.Err }
+func (e *LoginError) Is(target error) bool { return target == e.Reason }
+
+// ClassifyLoginError wraps err in a LoginError with the matching reason.
+// Errors without a known reason are returned unchanged.
+func ClassifyLoginError(err error) error {
+	var reason error
+
+	switch cause := errors.Cause(err); {
+	case cause == nil:
+		return nil
+	case cause == credentials.ErrUnauthorized, cause == credentials.ErrDecryptionFailed,
+		cause == credentials.ErrScopeNotAllowed:
+		reason = ErrBadSlotPassword
+	case cause == ErrLoggedOutUser, cause == credentials.ErrLocked:
+		reason = ErrUserLocked
+	case cause == ErrUserDisabled:
+		reason = ErrUserDisabled
+	case isTransientError(err):
+		reason = ErrBackendUnavailable
+	default:
+		return err
+	}
+
+	return &LoginError{Reason: reason, Err: err}
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package users
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/users/credentials"
+	"github.com/pkg/errors"
+	r "github.com/stretchr/testify/require"
+)
+
+func TestClassifyLoginError(t *testing.T) {
+	for err, reason := range map[error]error{
+		credentials.ErrUnauthorized:                              ErrBadSlotPassword,
+		credentials.ErrDecryptionFailed:                          ErrBadSlotPassword,
+		errors.Wrap(credentials.ErrUnauthorized, "bring online"): ErrBadSlotPassword,
+		ErrLoggedOutUser:                                         ErrUserLocked,
+		credentials.ErrLocked:                                    ErrUserLocked,
+		ErrUserDisabled:                                          ErrUserDisabled,
+		pmapi.ErrNoConnection:                                    ErrBackendUnavailable,
+		context.DeadlineExceeded:                                 ErrBackendUnavailable,
+		pmapi.ErrServerError{OriginalError: errors.New("502")}:   ErrBackendUnavailable,
+	} {
+		classified := ClassifyLoginError(err)
+
+		var loginErr *LoginError
+		r.True(t, errors.As(classified, &loginErr), err)
+		r.Equal(t, reason, loginErr.Reason, err)
+		r.True(t, errors.Is(classified, reason), err)
+		r.True(t, errors.Is(classified, errors.Cause(err)), "underlying error must stay reachable: %v", err)
+	}
+}
+
+func TestClassifyLoginErrorUnknown(t *testing.T) {
+	err := errors.New("something else")
+
+	r.Equal(t, err, ClassifyLoginError(err))
+	r.Nil(t, ClassifyLoginError(nil))
+}
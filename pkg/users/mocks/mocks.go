@@ -52,18 +52,18 @@ func (mr *MockCredentialsStorerMockRecorder) Add(arg0, arg1, arg2, arg3, arg4, a
 }
 
 // AddKeySlot mocks base method.
-func (m *MockCredentialsStorer) AddKeySlot(arg0, arg1, arg2 string) (string, error) {
+func (m *MockCredentialsStorer) AddKeySlot(arg0, arg1, arg2, arg3 string) (string, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AddKeySlot", arg0, arg1, arg2)
+	ret := m.ctrl.Call(m, "AddKeySlot", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // AddKeySlot indicates an expected call of AddKeySlot.
-func (mr *MockCredentialsStorerMockRecorder) AddKeySlot(arg0, arg1, arg2 interface{}) *gomock.Call {
+func (mr *MockCredentialsStorerMockRecorder) AddKeySlot(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddKeySlot", reflect.TypeOf((*MockCredentialsStorer)(nil).AddKeySlot), arg0, arg1, arg2)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddKeySlot", reflect.TypeOf((*MockCredentialsStorer)(nil).AddKeySlot), arg0, arg1, arg2, arg3)
 }
 
 // Delete mocks base method.
@@ -95,6 +95,52 @@ func (mr *MockCredentialsStorerMockRecorder) Get(arg0 interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockCredentialsStorer)(nil).Get), arg0)
 }
 
+// GetAll mocks base method.
+func (m *MockCredentialsStorer) GetAll() ([]*credentials.Credentials, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll")
+	ret0, _ := ret[0].([]*credentials.Credentials)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockCredentialsStorerMockRecorder) GetAll() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockCredentialsStorer)(nil).GetAll))
+}
+
+// GetEmails mocks base method.
+func (m *MockCredentialsStorer) GetEmails(arg0 string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetEmails", arg0)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetEmails indicates an expected call of GetEmails.
+func (mr *MockCredentialsStorerMockRecorder) GetEmails(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetEmails", reflect.TypeOf((*MockCredentialsStorer)(nil).GetEmails), arg0)
+}
+
+// GetOrAddKeySlot mocks base method.
+func (m *MockCredentialsStorer) GetOrAddKeySlot(arg0, arg1, arg2 string) (string, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOrAddKeySlot", arg0, arg1, arg2)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetOrAddKeySlot indicates an expected call of GetOrAddKeySlot.
+func (mr *MockCredentialsStorerMockRecorder) GetOrAddKeySlot(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrAddKeySlot", reflect.TypeOf((*MockCredentialsStorer)(nil).GetOrAddKeySlot), arg0, arg1, arg2)
+}
+
 // List mocks base method.
 func (m *MockCredentialsStorer) List() ([]string, error) {
 	m.ctrl.T.Helper()
@@ -110,6 +156,21 @@ func (mr *MockCredentialsStorerMockRecorder) List() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockCredentialsStorer)(nil).List))
 }
 
+// ListByEmailPrefix mocks base method.
+func (m *MockCredentialsStorer) ListByEmailPrefix(arg0 string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListByEmailPrefix", arg0)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListByEmailPrefix indicates an expected call of ListByEmailPrefix.
+func (mr *MockCredentialsStorerMockRecorder) ListByEmailPrefix(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListByEmailPrefix", reflect.TypeOf((*MockCredentialsStorer)(nil).ListByEmailPrefix), arg0)
+}
+
 // ListKeySlots mocks base method.
 func (m *MockCredentialsStorer) ListKeySlots(arg0 string) ([]string, error) {
 	m.ctrl.T.Helper()
@@ -125,6 +186,21 @@ func (mr *MockCredentialsStorerMockRecorder) ListKeySlots(arg0 interface{}) *gom
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListKeySlots", reflect.TypeOf((*MockCredentialsStorer)(nil).ListKeySlots), arg0)
 }
 
+// ListPage mocks base method.
+func (m *MockCredentialsStorer) ListPage(arg0, arg1 int) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListPage", arg0, arg1)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListPage indicates an expected call of ListPage.
+func (mr *MockCredentialsStorerMockRecorder) ListPage(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListPage", reflect.TypeOf((*MockCredentialsStorer)(nil).ListPage), arg0, arg1)
+}
+
 // Logout mocks base method.
 func (m *MockCredentialsStorer) Logout(arg0 string) (*credentials.Credentials, error) {
 	m.ctrl.T.Helper()
@@ -140,6 +216,22 @@ func (mr *MockCredentialsStorerMockRecorder) Logout(arg0 interface{}) *gomock.Ca
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Logout", reflect.TypeOf((*MockCredentialsStorer)(nil).Logout), arg0)
 }
 
+// LogoutChanged mocks base method.
+func (m *MockCredentialsStorer) LogoutChanged(arg0 string) (*credentials.Credentials, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LogoutChanged", arg0)
+	ret0, _ := ret[0].(*credentials.Credentials)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// LogoutChanged indicates an expected call of LogoutChanged.
+func (mr *MockCredentialsStorerMockRecorder) LogoutChanged(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LogoutChanged", reflect.TypeOf((*MockCredentialsStorer)(nil).LogoutChanged), arg0)
+}
+
 // RemoveKeySlot mocks base method.
 func (m *MockCredentialsStorer) RemoveKeySlot(arg0, arg1 string) error {
 	m.ctrl.T.Helper()
@@ -154,6 +246,49 @@ func (mr *MockCredentialsStorerMockRecorder) RemoveKeySlot(arg0, arg1 interface{
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveKeySlot", reflect.TypeOf((*MockCredentialsStorer)(nil).RemoveKeySlot), arg0, arg1)
 }
 
+// Rotate mocks base method.
+func (m *MockCredentialsStorer) Rotate(arg0 string, arg1, arg2 []byte) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Rotate", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Rotate indicates an expected call of Rotate.
+func (mr *MockCredentialsStorerMockRecorder) Rotate(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Rotate", reflect.TypeOf((*MockCredentialsStorer)(nil).Rotate), arg0, arg1, arg2)
+}
+
+// SetComment mocks base method.
+func (m *MockCredentialsStorer) SetComment(arg0, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetComment", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetComment indicates an expected call of SetComment.
+func (mr *MockCredentialsStorerMockRecorder) SetComment(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetComment", reflect.TypeOf((*MockCredentialsStorer)(nil).SetComment), arg0, arg1)
+}
+
+// SetEnabled mocks base method.
+func (m *MockCredentialsStorer) SetEnabled(arg0 string, arg1 bool) (*credentials.Credentials, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetEnabled", arg0, arg1)
+	ret0, _ := ret[0].(*credentials.Credentials)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SetEnabled indicates an expected call of SetEnabled.
+func (mr *MockCredentialsStorerMockRecorder) SetEnabled(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetEnabled", reflect.TypeOf((*MockCredentialsStorer)(nil).SetEnabled), arg0, arg1)
+}
+
 // UpdateEmails mocks base method.
 func (m *MockCredentialsStorer) UpdateEmails(arg0 string, arg1 []string) (*credentials.Credentials, error) {
 	m.ctrl.T.Helper()
@@ -184,6 +319,21 @@ func (mr *MockCredentialsStorerMockRecorder) UpdatePassword(arg0, arg1 interface
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdatePassword", reflect.TypeOf((*MockCredentialsStorer)(nil).UpdatePassword), arg0, arg1)
 }
 
+// UpdateRefreshToken mocks base method.
+func (m *MockCredentialsStorer) UpdateRefreshToken(arg0, arg1 string) (*credentials.Credentials, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateRefreshToken", arg0, arg1)
+	ret0, _ := ret[0].(*credentials.Credentials)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateRefreshToken indicates an expected call of UpdateRefreshToken.
+func (mr *MockCredentialsStorerMockRecorder) UpdateRefreshToken(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateRefreshToken", reflect.TypeOf((*MockCredentialsStorer)(nil).UpdateRefreshToken), arg0, arg1)
+}
+
 // UpdateToken mocks base method.
 func (m *MockCredentialsStorer) UpdateToken(arg0, arg1, arg2 string) (*credentials.Credentials, error) {
 	m.ctrl.T.Helper()
@@ -199,6 +349,20 @@ func (mr *MockCredentialsStorerMockRecorder) UpdateToken(arg0, arg1, arg2 interf
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateToken", reflect.TypeOf((*MockCredentialsStorer)(nil).UpdateToken), arg0, arg1, arg2)
 }
 
+// Verify mocks base method.
+func (m *MockCredentialsStorer) Verify() []error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Verify")
+	ret0, _ := ret[0].([]error)
+	return ret0
+}
+
+// Verify indicates an expected call of Verify.
+func (mr *MockCredentialsStorerMockRecorder) Verify() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Verify", reflect.TypeOf((*MockCredentialsStorer)(nil).Verify))
+}
+
 // MockStoreMaker is a mock of StoreMaker interface.
 type MockStoreMaker struct {
 	ctrl     *gomock.Controller
@@ -223,10 +387,10 @@ func (m *MockStoreMaker) EXPECT() *MockStoreMakerMockRecorder {
 }
 
 // New mocks base method.
-func (m *MockStoreMaker) New(arg0 store.BridgeUser, arg1 bool) (*store.Store, error) {
+func (m *MockStoreMaker) New(arg0 store.BridgeUser, arg1 bool) (store.UserStore, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "New", arg0, arg1)
-	ret0, _ := ret[0].(*store.Store)
+	ret0, _ := ret[0].(store.UserStore)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
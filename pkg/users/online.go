@@ -0,0 +1,94 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package users
+
+import (
+	"sync"
+
+	"github.com/ljanyst/peroxide/pkg/semaphore"
+	"github.com/pkg/errors"
+)
+
+// defaultBringOnlineWorkers limits how many users BringAllOnline connects at
+// once unless changed by SetBringOnlineWorkers.
+const defaultBringOnlineWorkers = 4
+
+// ErrInvalidWorkers is returned when the number of workers is not positive.
+var ErrInvalidWorkers = errors.New("number of workers must be at least 1")
+
+type bringOnliner interface {
+	ID() string
+	IsConnected() bool
+	BringOnline(slot, password string) error
+}
+
+// BringAllOnline brings every connected user online in parallel so that their
+// stores are loaded before the first IMAP login. Logged out users are skipped.
+// It returns one error per user which could not be brought online.
+func (u *Users) BringAllOnline(slot, password string) []error {
+	users := u.GetUsers()
+
+	onliners := make([]bringOnliner, 0, len(users))
+	for _, user := range users {
+		onliners = append(onliners, user)
+	}
+
+	return bringAllOnline(onliners, slot, password, u.bringOnlineWorkers)
+}
+
+// SetBringOnlineWorkers sets how many users BringAllOnline connects at once.
+// Keeping it low avoids hitting the API rate limits with many users.
+func (u *Users) SetBringOnlineWorkers(workers int) error {
+	if workers < 1 {
+		return errors.Wrapf(ErrInvalidWorkers, "got %d", workers)
+	}
+
+	u.bringOnlineWorkers = workers
+
+	return nil
+}
+
+func bringAllOnline(users []bringOnliner, slot, password string, workers int) []error {
+	var (
+		errs     []error
+		errsLock sync.Mutex
+	)
+
+	sem := semaphore.New(workers)
+
+	for _, user := range users {
+		if !user.IsConnected() {
+			continue
+		}
+
+		user := user
+
+		sem.Go(func() {
+			if err := user.BringOnline(slot, password); err != nil {
+				errsLock.Lock()
+				defer errsLock.Unlock()
+
+				errs = append(errs, errors.Wrapf(err, "could not bring user %s online", user.ID()))
+			}
+		})
+	}
+
+	sem.Wait()
+
+	return errs
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package users
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	r "github.com/stretchr/testify/require"
+)
+
+type testOnliner struct {
+	id        string
+	connected bool
+	err       error
+	calls     int32
+}
+
+func (u *testOnliner) ID() string        { return u.id }
+func (u *testOnliner) IsConnected() bool { return u.connected }
+
+func (u *testOnliner) BringOnline(slot, password string) error {
+	atomic.AddInt32(&u.calls, 1)
+	return u.err
+}
+
+func TestBringAllOnline(t *testing.T) {
+	errFirst := errors.New("first failed")
+	errSecond := errors.New("second failed")
+
+	first := &testOnliner{id: "first", connected: true, err: errFirst}
+	second := &testOnliner{id: "second", connected: true, err: errSecond}
+	loggedOut := &testOnliner{id: "loggedOut"}
+
+	errs := bringAllOnline([]bringOnliner{first, second, loggedOut}, "main", "pass", 1)
+
+	r.Equal(t, int32(1), first.calls)
+	r.Equal(t, int32(1), second.calls)
+	r.Equal(t, int32(0), loggedOut.calls)
+
+	var causes []error
+	for _, err := range errs {
+		switch {
+		case errors.Is(err, errFirst):
+			causes = append(causes, errFirst)
+		case errors.Is(err, errSecond):
+			causes = append(causes, errSecond)
+		}
+	}
+	r.Len(t, errs, 2)
+	r.ElementsMatch(t, []error{errFirst, errSecond}, causes)
+}
+
+func TestBringAllOnlineNoErrors(t *testing.T) {
+	first := &testOnliner{id: "first", connected: true}
+	second := &testOnliner{id: "second", connected: true}
+
+	r.Empty(t, bringAllOnline([]bringOnliner{first, second}, "main", "pass", 2))
+	r.Equal(t, int32(1), first.calls)
+	r.Equal(t, int32(1), second.calls)
+}
+
+// concurrencyOnliner records how many users are brought online at once. Each
+// call waits until `wait` calls run in parallel or a short timeout passes.
+type concurrencyOnliner struct {
+	running, maxRunning *int32
+	wait                int32
+}
+
+func (u *concurrencyOnliner) ID() string        { return "user" }
+func (u *concurrencyOnliner) IsConnected() bool { return true }
+
+func (u *concurrencyOnliner) BringOnline(slot, password string) error {
+	running := atomic.AddInt32(u.running, 1)
+	defer atomic.AddInt32(u.running, -1)
+
+	for {
+		max := atomic.LoadInt32(u.maxRunning)
+		if running <= max || atomic.CompareAndSwapInt32(u.maxRunning, max, running) {
+			break
+		}
+	}
+
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for atomic.LoadInt32(u.running) < u.wait && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	return nil
+}
+
+func bringAllOnlineMaxConcurrency(t *testing.T, workers int) int32 {
+	var running, maxRunning int32
+
+	onliners := make([]bringOnliner, 3)
+	for i := range onliners {
+		onliners[i] = &concurrencyOnliner{running: &running, maxRunning: &maxRunning, wait: 3}
+	}
+
+	users := &Users{}
+	r.NoError(t, users.SetBringOnlineWorkers(workers))
+	bringAllOnline(onliners, "main", "pass", users.bringOnlineWorkers)
+
+	return maxRunning
+}
+
+func TestBringAllOnlineWorkers(t *testing.T) {
+	r.Equal(t, int32(1), bringAllOnlineMaxConcurrency(t, 1))
+	r.Equal(t, int32(3), bringAllOnlineMaxConcurrency(t, 3))
+}
+
+func TestSetBringOnlineWorkersRejectsInvalid(t *testing.T) {
+	users := &Users{bringOnlineWorkers: defaultBringOnlineWorkers}
+
+	r.ErrorIs(t, users.SetBringOnlineWorkers(0), ErrInvalidWorkers)
+	r.ErrorIs(t, users.SetBringOnlineWorkers(-1), ErrInvalidWorkers)
+	r.Equal(t, defaultBringOnlineWorkers, users.bringOnlineWorkers)
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package users
+
+import "github.com/pkg/errors"
+
+// resync is a ResyncStore call in flight; later calls for the same user wait
+// for it and share its result.
+type resync struct {
+	done chan struct{}
+	err  error
+}
+
+// ResyncStore forces a full sync of the store of the user from the API, e.g.
+// when a mailbox got out of sync, without logging the user out. The user must
+// be online. Concurrent calls for the same user share a single sync.
+func (u *Users) ResyncStore(userID string) error {
+	user, ok := u.findUser(userID)
+	if !ok {
+		return errors.New("user " + userID + " not found")
+	}
+
+	u.resyncsLock.Lock()
+	if inFlight, ok := u.resyncs[userID]; ok {
+		u.resyncsLock.Unlock()
+		<-inFlight.done
+		return inFlight.err
+	}
+
+	current := &resync{done: make(chan struct{})}
+	if u.resyncs == nil {
+		u.resyncs = map[string]*resync{}
+	}
+	u.resyncs[userID] = current
+	u.resyncsLock.Unlock()
+
+	current.err = user.resyncStore()
+
+	u.resyncsLock.Lock()
+	delete(u.resyncs, userID)
+	u.resyncsLock.Unlock()
+
+	close(current.done)
+
+	return current.err
+}
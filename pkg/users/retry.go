@@ -0,0 +1,112 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package users
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/clock"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultLoginRetryAttempts = 3
+	defaultLoginRetryBackoff  = 500 * time.Millisecond
+
+	// maxRateLimitWait bounds how long a rate-limited call waits before its retry.
+	maxRateLimitWait = 30 * time.Second
+)
+
+// retryPolicy describes how many times and how fast to retry transient failures.
+type retryPolicy struct {
+	attempts int
+	backoff  time.Duration
+}
+
+func defaultLoginRetryPolicy() retryPolicy {
+	return retryPolicy{
+		attempts: defaultLoginRetryAttempts,
+		backoff:  defaultLoginRetryBackoff,
+	}
+}
+
+// do calls fn until it succeeds, fails with a non-transient error or runs out
+// of attempts. The wait between attempts doubles after each failure.
+func (policy retryPolicy) do(ctx context.Context, clk clock.Clock, fn func() error) error {
+	backoff := policy.backoff
+
+	for attempt := 1; ; attempt++ {
+		err := retryOnRateLimit(ctx, clk, fn)
+		if err == nil || attempt >= policy.attempts || !isTransientError(err) {
+			return err
+		}
+
+		log.WithError(err).WithField("attempt", attempt).Debug("Transient API error, retrying")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clk.After(backoff):
+		}
+
+		backoff *= 2
+	}
+}
+
+// retryOnRateLimit calls fn and, when the API rate-limited it, calls it once
+// more after the wait requested by the API, bounded by maxRateLimitWait.
+func retryOnRateLimit(ctx context.Context, clk clock.Clock, fn func() error) error {
+	err := fn()
+
+	wait, ok := pmapi.IsTooManyRequests(errors.Cause(err))
+	if !ok {
+		return err
+	}
+
+	if wait > maxRateLimitWait {
+		wait = maxRateLimitWait
+	}
+
+	log.WithError(err).WithField("wait", wait).Debug("Rate-limited by API, retrying")
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-clk.After(wait):
+	}
+
+	return fn()
+}
+
+// isTransientError returns whether err is worth retrying: lost connection,
+// timeouts and server-side (5xx) failures.
+func isTransientError(err error) bool {
+	if errors.Is(err, pmapi.ErrNoConnection) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	if pmapi.IsServerError(errors.Cause(err)) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
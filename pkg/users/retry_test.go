@@ -0,0 +1,85 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package users
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/clock"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	r "github.com/stretchr/testify/require"
+)
+
+func TestRetryBackoffWithFakeClock(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	policy := retryPolicy{attempts: 3, backoff: time.Minute}
+
+	calls := 0
+	errCh := make(chan error)
+
+	go func() {
+		errCh <- policy.do(context.Background(), clk, func() error {
+			calls++
+			if calls < 3 {
+				return pmapi.ErrNoConnection
+			}
+			return nil
+		})
+	}()
+
+	// The first retry waits one backoff, the second one twice as long.
+	waitForFakeWaiter(t, clk)
+	clk.Advance(time.Minute)
+
+	waitForFakeWaiter(t, clk)
+	clk.Advance(time.Minute)
+	r.Equal(t, 1, clk.Waiters())
+	clk.Advance(time.Minute)
+
+	r.NoError(t, <-errCh)
+	r.Equal(t, 3, calls)
+}
+
+func waitForFakeWaiter(t *testing.T, clk *clock.Fake) {
+	r.Eventually(t, func() bool { return clk.Waiters() == 1 }, time.Second, time.Millisecond)
+}
+
+func TestRetryOnRateLimitRetriesOnce(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	errTooMany := pmapi.ErrTooManyRequests{OriginalError: errors.New("too many requests"), RetryAfter: time.Hour}
+
+	calls := 0
+	errCh := make(chan error)
+
+	go func() {
+		errCh <- retryOnRateLimit(context.Background(), clk, func() error {
+			calls++
+			return errTooMany
+		})
+	}()
+
+	// The requested hour is capped.
+	waitForFakeWaiter(t, clk)
+	clk.Advance(maxRateLimitWait)
+
+	r.Equal(t, errTooMany, <-errCh)
+	r.Equal(t, 2, calls)
+}
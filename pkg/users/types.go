@@ -24,19 +24,30 @@ import (
 
 type CredentialsStorer interface {
 	List() (userIDs []string, err error)
+	ListPage(offset, limit int) (userIDs []string, err error)
+	ListByEmailPrefix(prefix string) (userIDs []string, err error)
 	Add(userID, userName, uid, ref string, mailboxPassword []byte, emails []string) (*credentials.Credentials, []byte, error)
 	Get(userID string) (*credentials.Credentials, error)
+	GetAll() ([]*credentials.Credentials, error)
+	GetEmails(userID string) ([]string, error)
 	UpdateEmails(userID string, emails []string) (*credentials.Credentials, error)
 	UpdatePassword(userID string, password []byte) (*credentials.Credentials, error)
 	UpdateToken(userID, uid, ref string) (*credentials.Credentials, error)
+	UpdateRefreshToken(userID, ref string) (*credentials.Credentials, error)
 	ListKeySlots(userID string) ([]string, error)
 	RemoveKeySlot(userID, slot string) error
-	AddKeySlot(userID, slot, mainKey string) (string, error)
+	AddKeySlot(userID, slot, mainKey, scope string) (string, error)
+	GetOrAddKeySlot(userID, slot, mainKey string) (string, bool, error)
+	Rotate(userID string, oldKey, newKey []byte) error
 	Logout(userID string) (*credentials.Credentials, error)
+	LogoutChanged(userID string) (*credentials.Credentials, bool, error)
+	SetComment(userID, comment string) error
+	SetEnabled(userID string, enabled bool) (*credentials.Credentials, error)
 	Delete(userID string) error
+	Verify() []error
 }
 
 type StoreMaker interface {
-	New(user store.BridgeUser, connected bool) (*store.Store, error)
+	New(user store.BridgeUser, connected bool) (store.UserStore, error)
 	Remove(userID string) error
 }
@@ -19,6 +19,7 @@ package users
 
 import (
 	"context"
+	"fmt"
 	"runtime"
 	"strings"
 	"sync"
@@ -36,6 +37,13 @@ import (
 // ErrLoggedOutUser is sent to IMAP and SMTP if user exists, password is OK but user is logged out from the app.
 var ErrLoggedOutUser = errors.New("account is logged out, use the app to login again")
 
+// ErrUserOffline is returned for operations which need the store of a user
+// which is not online.
+var ErrUserOffline = errors.New("user is not online")
+
+// sessionExpiryWarning is how close to its expiry the API session is reported by LoginWarning.
+const sessionExpiryWarning = 5 * time.Minute
+
 // User is a struct on top of API client and credentials store.
 type User struct {
 	log           *logrus.Entry
@@ -45,7 +53,10 @@ type User struct {
 	credStorer    CredentialsStorer
 
 	storeFactory StoreMaker
-	store        *store.Store
+	store        store.UserStore
+
+	// eventLoopPaused is applied to every store of the user, see setEventLoopPaused.
+	eventLoopPaused bool
 
 	userID string
 	creds  *credentials.Credentials
@@ -97,6 +108,11 @@ func (u *User) connect(client pmapi.Client) error {
 
 	u.client.AddAuthRefreshHandler(u.handleAuthRefresh)
 
+	return u.openStore()
+}
+
+// openStore unlocks the keys of the API client and loads the store.
+func (u *User) openStore() error {
 	// Connected users have unlocked keys.
 	if err := u.unlockIfNecessary(); err != nil {
 		return err
@@ -108,8 +124,8 @@ func (u *User) connect(client pmapi.Client) error {
 	}
 
 	// If the client is already unlocked, we can unlock the store cache as well.
-	if client.IsUnlocked() {
-		kr, err := client.GetUserKeyRing()
+	if u.client.IsUnlocked() {
+		kr, err := u.client.GetUserKeyRing()
 		if err != nil {
 			return err
 		}
@@ -126,6 +142,39 @@ func (u *User) connect(client pmapi.Client) error {
 	return nil
 }
 
+func (u *User) setCredentials(creds *credentials.Credentials) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.creds = creds
+}
+
+func (u *User) setStoreMaker(storeFactory StoreMaker) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.storeFactory = storeFactory
+}
+
+// setEventLoopPaused pauses or resumes the event loop of the user's store,
+// including any store created later when the user comes online.
+func (u *User) setEventLoopPaused(paused bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.eventLoopPaused = paused
+
+	if u.store == nil {
+		return
+	}
+
+	if paused {
+		u.store.PauseEventLoop()
+	} else {
+		u.store.ResumeEventLoop()
+	}
+}
+
 func (u *User) loadStore() error {
 	// Logged-out user keeps store running to access offline data.
 	// Therefore it is necessary to close it before re-init.
@@ -143,6 +192,12 @@ func (u *User) loadStore() error {
 
 	u.store = store
 
+	// The loop of a new store is already running, so it may poll once before
+	// it is paused.
+	if u.eventLoopPaused {
+		u.store.PauseEventLoop()
+	}
+
 	return nil
 }
 
@@ -252,6 +307,58 @@ func (u *User) IsConnected() bool {
 	return u.creds.IsConnected()
 }
 
+// resyncStore forces a full sync of the store of the online user.
+func (u *User) resyncStore() error {
+	u.lock.RLock()
+	userStore := u.store
+	u.lock.RUnlock()
+
+	if userStore == nil {
+		return ErrUserOffline
+	}
+
+	return userStore.Resync()
+}
+
+// Comment returns the operator's note about the user, see Users.SetUserComment.
+func (u *User) Comment() string {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	return u.creds.Comment
+}
+
+// IsEnabled returns whether the user may log in, see Users.SetUserEnabled.
+func (u *User) IsEnabled() bool {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	return u.creds.IsEnabled()
+}
+
+// LoginWarning returns a caveat of a login at now which does not prevent it,
+// e.g. that the API session is about to expire, or "" if there is none.
+// Sessions without a known expiry, or already expired, are not reported.
+func (u *User) LoginWarning(now time.Time) string {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	if u.client == nil || !u.creds.IsConnected() {
+		return ""
+	}
+
+	expiry := u.client.SessionExpiry()
+	if expiry.IsZero() || !expiry.After(now) {
+		return ""
+	}
+
+	if left := expiry.Sub(now); left < sessionExpiryWarning {
+		return fmt.Sprintf("API session expires in %v", left.Round(time.Second))
+	}
+
+	return ""
+}
+
 func (u *User) GetClient() pmapi.Client {
 	if err := u.unlockIfNecessary(); err != nil {
 		u.log.WithError(err).Error("Failed to unlock user")
@@ -298,10 +405,15 @@ func (u *User) unlockIfNecessary() error {
 // GetPrimaryAddress returns the user's original address (which is
 // not necessarily the same as the primary address, because a primary address
 // might be an alias and be in position one).
+// It returns an empty string if the user has no address yet.
 func (u *User) GetPrimaryAddress() string {
 	u.lock.RLock()
 	defer u.lock.RUnlock()
 
+	if len(u.creds.Emails) == 0 {
+		return ""
+	}
+
 	return u.creds.Emails[0]
 }
 
@@ -344,7 +456,10 @@ func (u *User) GetAddressID(address string) (id string, err error) {
 	return "", errors.New("address not found")
 }
 
-func (u *User) CheckCredentials(slot, password string) error {
+// CheckCredentials verifies the password of the key slot and that the slot
+// may be used with `protocol`, one of the credentials scopes. Disabled users
+// are rejected with ErrUserDisabled once the password is verified.
+func (u *User) CheckCredentials(slot, password, protocol string) error {
 	u.lock.Lock()
 	defer u.lock.Unlock()
 
@@ -360,11 +475,21 @@ func (u *User) CheckCredentials(slot, password string) error {
 		return ErrLoggedOutUser
 	}
 
-	if verified {
-		return nil
+	if !verified {
+		if err := u.creds.Unlock(slot, password); err != nil {
+			return err
+		}
 	}
 
-	return u.creds.Unlock(slot, password)
+	if !u.creds.SlotAllows(slot, protocol) {
+		return credentials.ErrScopeNotAllowed
+	}
+
+	if !u.creds.IsEnabled() {
+		return ErrUserDisabled
+	}
+
+	return nil
 }
 
 func (u *User) UnlockCredentials(slot, password string) error {
@@ -375,13 +500,23 @@ func (u *User) UnlockCredentials(slot, password string) error {
 }
 
 func (u *User) BringOnline(slot, password string) error {
+	return u.BringOnlineCtx(context.Background(), slot, password)
+}
+
+// BringOnlineCtx is like BringOnline but gives up with the context error as
+// soon as ctx is done, e.g. when the client disconnects mid-login.
+func (u *User) BringOnlineCtx(ctx context.Context, slot, password string) error {
 	u.lock.Lock()
 	defer u.lock.Unlock()
 
-	if u.client != nil {
+	if u.isOnline() {
 		return nil
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	if u.creds.Locked() {
 		if err := u.creds.Unlock(slot, password); err != nil {
 			return err
@@ -392,14 +527,24 @@ func (u *User) BringOnline(slot, password string) error {
 		return u.connect(u.clientManager.NewClient("", "", "", time.Time{}))
 	}
 
+	// BringOffline keeps the API client; creating another one would leak it
+	// together with its auth refresh handler.
+	if u.client != nil {
+		u.log.Info("Reconnecting user")
+		return u.openStore()
+	}
+
 	uid, ref, err := u.creds.SplitAPIToken()
 	if err != nil {
 		return errors.Wrap(err, "could not get user's refresh token")
 	}
 
-	ctx := pmapi.ContextWithoutRetry(context.Background())
-	client, auth, err := u.clientManager.NewClientWithRefresh(ctx, uid, ref)
+	client, auth, err := u.clientManager.NewClientWithRefresh(pmapi.ContextWithoutRetry(ctx), uid, ref)
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
 		connectErr := u.connect(u.clientManager.NewClient(uid, "", ref, time.Time{}))
 
 		switch errors.Cause(err) {
@@ -423,6 +568,38 @@ func (u *User) BringOnline(slot, password string) error {
 	return u.connect(client)
 }
 
+// IsOnline returns whether the user has been brought online, i.e. has an API client and a store.
+func (u *User) IsOnline() bool {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	return u.isOnline()
+}
+
+func (u *User) isOnline() bool {
+	return u.client != nil && u.store != nil
+}
+
+// BringOffline undoes BringOnline without logging the user out: the store is
+// closed but credentials are kept so that the next BringOnline reconnects the
+// user. The API client is kept because the stopping event loop may still use it;
+// the next BringOnline reuses it.
+func (u *User) BringOffline() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if !u.isOnline() {
+		return nil
+	}
+
+	u.log.Info("Bringing user offline")
+
+	err := u.closeStore()
+	u.store = nil
+
+	return err
+}
+
 // UpdateUser updates user details from API and saves to the credentials.
 func (u *User) UpdateUser(ctx context.Context) error {
 	u.lock.Lock()
@@ -502,14 +679,21 @@ func (u *User) RemoveKeySlot(slot string) error {
 	u.lock.Lock()
 	defer u.lock.Unlock()
 
-	return u.credStorer.RemoveKeySlot(u.userID, slot)
+	return u.credStorer.RemoveKeySlot(u.userID, NormalizeSlot(slot))
+}
+
+func (u *User) AddKeySlot(slot, mainKey, scope string) (string, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.credStorer.AddKeySlot(u.userID, NormalizeSlot(slot), mainKey, scope)
 }
 
-func (u *User) AddKeySlot(slot, mainKey string) (string, error) {
+func (u *User) GetOrAddKeySlot(slot, mainKey string) (string, bool, error) {
 	u.lock.Lock()
 	defer u.lock.Unlock()
 
-	return u.credStorer.AddKeySlot(u.userID, slot, mainKey)
+	return u.credStorer.GetOrAddKeySlot(u.userID, NormalizeSlot(slot), mainKey)
 }
 
 func (u *User) closeEventLoopAndCacher() {
@@ -536,6 +720,9 @@ func (u *User) CloseConnection(address string) {
 	u.listener.Emit(events.CloseConnectionEvent, address)
 }
 
+// GetStore returns the store of the user. It is nil while the user is
+// offline and when the store is not the default store implementation.
 func (u *User) GetStore() *store.Store {
-	return u.store
+	s, _ := u.store.(*store.Store)
+	return s
 }
@@ -24,6 +24,7 @@ import (
 	gomock "github.com/golang/mock/gomock"
 	"github.com/ljanyst/peroxide/pkg/events"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/users/credentials"
 	"github.com/pkg/errors"
 	r "github.com/stretchr/testify/require"
 )
@@ -111,10 +112,43 @@ func TestCheckBridgeLoginLoggedOut(t *testing.T) {
 	r.Error(t, err)
 	defer cleanUpUserData(user)
 
-	err = user.CheckCredentials("main", "asdf")
+	err = user.CheckCredentials("main", "asdf", credentials.ScopeIMAP)
 	r.Equal(t, ErrLoggedOutUser, err)
 }
 
+func TestCheckBridgeLoginSlotIsCaseSensitive(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	user := testNewUser(t, m)
+	defer cleanUpUserData(user)
+
+	creds := *testCredentials
+	creds.SealedKeys = map[string][]byte{}
+	r.NoError(t, creds.SealKey("PhoneSlot", testMainKeyBytes))
+	user.creds = &creds
+
+	r.NoError(t, user.CheckCredentials("PhoneSlot", testMainKeyString, credentials.ScopeIMAP))
+	r.EqualError(t, user.CheckCredentials("phoneslot", testMainKeyString, credentials.ScopeIMAP), "Bridge credentials checking failed")
+}
+
+func TestCheckBridgeLoginSlotScope(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	user := testNewUser(t, m)
+	defer cleanUpUserData(user)
+
+	creds := *testCredentials
+	creds.SealedKeys = map[string][]byte{}
+	r.NoError(t, creds.SealKey("PhoneSlot", testMainKeyBytes))
+	creds.SlotScopes = map[string]string{"PhoneSlot": credentials.ScopeIMAP}
+	user.creds = &creds
+
+	r.NoError(t, user.CheckCredentials("PhoneSlot", testMainKeyString, credentials.ScopeIMAP))
+	r.Equal(t, credentials.ErrScopeNotAllowed, user.CheckCredentials("PhoneSlot", testMainKeyString, credentials.ScopeSMTP))
+}
+
 func TestCheckBridgeLoginBadPassword(t *testing.T) {
 	m := initMocks(t)
 	defer m.ctrl.Finish()
@@ -18,8 +18,15 @@
 package users
 
 import (
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	gomock "github.com/golang/mock/gomock"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/store"
+	"github.com/ljanyst/peroxide/pkg/testutil"
 	r "github.com/stretchr/testify/require"
 )
 
@@ -49,3 +56,158 @@ func TestClearStoreWithoutStore(t *testing.T) {
 	r.NotNil(t, user.store)
 	r.Nil(t, user.clearStore())
 }
+
+func TestBringOffline(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	user := testNewUser(t, m)
+	defer cleanUpUserData(user)
+
+	r.True(t, user.IsOnline())
+	r.NoError(t, user.BringOffline())
+	r.False(t, user.IsOnline())
+	r.Nil(t, user.GetStore())
+	r.True(t, user.IsConnected(), "credentials must be kept")
+
+	// Bringing an offline user offline again is a no-op.
+	r.NoError(t, user.BringOffline())
+}
+
+func TestBringOnlineReusesClient(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	// The client is created and its refresh handler added only once.
+	users, storeMaker := newMemoryStoreUsers(t, m)
+	m.pmapiClient.EXPECT().GetUserKeyRing().Return(testutil.MakeKeyRing(t), nil)
+	m.pmapiClient.EXPECT().GetUser(gomock.Any()).Return(testPMAPIUser, nil)
+
+	user := users.GetUsers()[0]
+	r.NoError(t, user.BringOnline("main", "foobar"))
+	r.NoError(t, user.BringOffline())
+	r.NoError(t, user.BringOnline("main", "foobar"))
+
+	r.True(t, user.IsOnline())
+	r.Equal(t, m.pmapiClient, user.GetClient())
+	r.Len(t, storeMaker.stores, 2)
+	r.True(t, storeMaker.stores[0].closed)
+}
+
+// memoryStore is a trivial alternative store implementation.
+type memoryStore struct {
+	closed, watching, cacheUnlocked bool
+
+	// Resync blocks until resyncRelease is closed, if set.
+	resyncs       int32
+	resyncRelease chan struct{}
+}
+
+func (s *memoryStore) Close() error                                    { s.closed = true; return nil }
+func (s *memoryStore) CloseEventLoopAndCacher()                        {}
+func (s *memoryStore) GetAddressID(address string) (string, error)     { return "", nil }
+func (s *memoryStore) PauseEventLoop()                                 {}
+func (s *memoryStore) Remove() error                                   { return nil }
+func (s *memoryStore) RemoveCache() error                              { return nil }
+func (s *memoryStore) ResumeEventLoop()                                {}
+func (s *memoryStore) SetChangeNotifier(notifier store.ChangeNotifier) {}
+func (s *memoryStore) StartWatcher()                                   { s.watching = true }
+func (s *memoryStore) UnlockCache(kr *crypto.KeyRing) error            { s.cacheUnlocked = true; return nil }
+
+func (s *memoryStore) Resync() error {
+	atomic.AddInt32(&s.resyncs, 1)
+	if s.resyncRelease != nil {
+		<-s.resyncRelease
+	}
+	return nil
+}
+
+type memoryStoreMaker struct {
+	stores []*memoryStore
+}
+
+func (f *memoryStoreMaker) New(user store.BridgeUser, connected bool) (store.UserStore, error) {
+	s := &memoryStore{}
+	f.stores = append(f.stores, s)
+	return s, nil
+}
+
+func (f *memoryStoreMaker) Remove(userID string) error { return nil }
+
+// newMemoryStoreUsers returns users with the test user backed by a memoryStore.
+func newMemoryStoreUsers(t *testing.T, m mocks) (*Users, *memoryStoreMaker) {
+	authRefresh := &pmapi.AuthRefresh{UID: "uid", AccessToken: "acc", RefreshToken: "ref"}
+
+	m.credentialsStore.EXPECT().List().Return([]string{testCredentials.UserID}, nil)
+	m.credentialsStore.EXPECT().Get(testCredentials.UserID).Return(testCredentials, nil)
+	m.clientManager.EXPECT().NewClientWithRefresh(gomock.Any(), "uid", "acc").Return(m.pmapiClient, authRefresh, nil)
+	m.credentialsStore.EXPECT().UpdateToken(testCredentials.UserID, "uid", "ref").Return(testCredentials, nil)
+	m.pmapiClient.EXPECT().AddAuthRefreshHandler(gomock.Any())
+	m.pmapiClient.EXPECT().IsUnlocked().Return(true).AnyTimes()
+	m.pmapiClient.EXPECT().GetUserKeyRing().Return(testutil.MakeKeyRing(t), nil)
+	m.pmapiClient.EXPECT().GetUser(gomock.Any()).Return(testPMAPIUser, nil)
+
+	storeMaker := &memoryStoreMaker{}
+
+	return New(m.eventListener, m.clientManager, m.credentialsStore, storeMaker), storeMaker
+}
+
+func TestAlternativeStoreImplementation(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	users, storeMaker := newMemoryStoreUsers(t, m)
+
+	user := users.GetUsers()[0]
+	r.NoError(t, user.BringOnline("main", "foobar"))
+
+	r.Len(t, storeMaker.stores, 1)
+	r.True(t, storeMaker.stores[0].cacheUnlocked)
+	r.True(t, storeMaker.stores[0].watching)
+
+	// IMAP and SMTP need the default implementation.
+	r.Nil(t, user.GetStore())
+
+	r.NoError(t, user.closeStore())
+	r.True(t, storeMaker.stores[0].closed)
+}
+
+func TestResyncStore(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	users, storeMaker := newMemoryStoreUsers(t, m)
+
+	r.ErrorIs(t, users.ResyncStore(testCredentials.UserID), ErrUserOffline)
+	r.Error(t, users.ResyncStore("unknown"))
+
+	r.NoError(t, users.GetUsers()[0].BringOnline("main", "foobar"))
+	userStore := storeMaker.stores[0]
+	userStore.resyncRelease = make(chan struct{})
+
+	// Calls made while the first resync runs wait for it instead of syncing again.
+	const calls = 5
+
+	errs := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		go func() { errs <- users.ResyncStore(testCredentials.UserID) }()
+	}
+
+	r.Eventually(t, func() bool { return atomic.LoadInt32(&userStore.resyncs) == 1 }, time.Second, time.Millisecond)
+	r.Eventually(t, func() bool {
+		users.resyncsLock.Lock()
+		defer users.resyncsLock.Unlock()
+		return users.resyncs[testCredentials.UserID] != nil
+	}, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	close(userStore.resyncRelease)
+	for i := 0; i < calls; i++ {
+		r.NoError(t, <-errs)
+	}
+	r.Equal(t, int32(1), atomic.LoadInt32(&userStore.resyncs))
+
+	// A later call syncs again.
+	r.NoError(t, users.ResyncStore(testCredentials.UserID))
+	r.Equal(t, int32(2), atomic.LoadInt32(&userStore.resyncs))
+}
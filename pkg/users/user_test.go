@@ -18,8 +18,12 @@
 package users
 
 import (
+	"context"
 	"testing"
+	"time"
 
+	"github.com/golang/mock/gomock"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
 	r "github.com/stretchr/testify/require"
 )
 
@@ -41,3 +45,51 @@ func testNewUser(t *testing.T, m mocks) *User {
 func cleanUpUserData(u *User) {
 	_ = u.clearStore()
 }
+
+func TestLoginWarning(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	user := testNewUser(t, m)
+	defer cleanUpUserData(user)
+
+	now := time.Now()
+
+	m.pmapiClient.EXPECT().SessionExpiry().Return(now.Add(time.Minute))
+	r.Equal(t, "API session expires in 1m0s", user.LoginWarning(now))
+
+	m.pmapiClient.EXPECT().SessionExpiry().Return(now.Add(time.Hour))
+	r.Empty(t, user.LoginWarning(now))
+
+	// Unknown and already passed expiries are not reported.
+	m.pmapiClient.EXPECT().SessionExpiry().Return(time.Time{})
+	r.Empty(t, user.LoginWarning(now))
+
+	m.pmapiClient.EXPECT().SessionExpiry().Return(now.Add(-time.Minute))
+	r.Empty(t, user.LoginWarning(now))
+}
+
+func TestBringOnlineCtxCanceled(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	m.credentialsStore.EXPECT().Get("user").Return(testCredentials, nil)
+	user, err := newUser("user", m.eventListener, m.credentialsStore, m.storeMaker, m.clientManager)
+	r.NoError(t, err)
+
+	// The refresh blocks until the login is abandoned.
+	m.clientManager.EXPECT().NewClientWithRefresh(gomock.Any(), "uid", "acc").DoAndReturn(
+		func(ctx context.Context, uid, ref string) (pmapi.Client, *pmapi.AuthRefresh, error) {
+			<-ctx.Done()
+			return nil, nil, ctx.Err()
+		},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	r.ErrorIs(t, user.BringOnlineCtx(ctx, "main", "foobar"), context.Canceled)
+	r.Less(t, int64(time.Since(start)), int64(time.Second))
+	r.False(t, user.IsOnline())
+}
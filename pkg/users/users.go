@@ -21,12 +21,17 @@ package users
 import (
 	"context"
 	"encoding/base64"
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
+	"github.com/ljanyst/peroxide/pkg/clock"
 	"github.com/ljanyst/peroxide/pkg/listener"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/users/credentials"
 	"github.com/pkg/errors"
 	logrus "github.com/sirupsen/logrus"
 )
@@ -41,6 +46,30 @@ var (
 	// ErrUserAlreadyConnected is returned when authentication was OK but
 	// there is already active account for this user.
 	ErrUserAlreadyConnected = errors.New("user is already connected")
+
+	// ErrCredentialsExist is returned when a new user is added but the
+	// credentials store already has credentials of the user which are not
+	// loaded, so no main key can be handed out for them.
+	ErrCredentialsExist = errors.New("credentials of the user already exist")
+
+	// ErrEmptyPassword is returned when a client tries to log in without a password.
+	ErrEmptyPassword = errors.New("password is empty")
+
+	// ErrCredentialsUnavailable is returned while the credentials store
+	// could not be read, see HealthCheck.
+	ErrCredentialsUnavailable = errors.New("credentials unavailable")
+
+	// ErrUserDisabled is returned to IMAP and SMTP when the password is OK
+	// but the user has been disabled, see SetUserEnabled.
+	ErrUserDisabled = errors.New("user is disabled")
+)
+
+const (
+	// credentialsListAttempts is how many times the credentials store is listed at startup.
+	credentialsListAttempts = 3
+
+	// credentialsListBackoff is the wait before the first retry, doubled after each failure.
+	credentialsListBackoff = 100 * time.Millisecond
 )
 
 // Users is a struct handling users.
@@ -49,14 +78,33 @@ type Users struct {
 	clientManager pmapi.Manager
 	credStorer    CredentialsStorer
 	storeFactory  StoreMaker
+	loginRetry    retryPolicy
+	clock         clock.Clock
+
+	// bringOnlineWorkers limits how many users BringAllOnline connects at once.
+	bringOnlineWorkers int
 
 	// users is a list of accounts that have been added to the app.
 	// They are stored sorted in the credentials store in the order
 	// that they were added to the app chronologically.
 	// People are used to that and so we preserve that ordering here.
+	// Logged out users are kept as well; see User.IsConnected.
+	// The slice is guarded by lock: it is only touched while holding lock
+	// (see the *Locked helpers) or copied by snapshotUsers for unlocked use.
 	users []*User
 
+	// credentialsErr is set when the users could not be loaded from the
+	// credentials store; the users are in a degraded state until it is cleared.
+	credentialsErr error
+
+	// eventLoopsPaused is set between PauseEventLoops and ResumeEventLoops.
+	eventLoopsPaused bool
+
 	lock sync.RWMutex
+
+	// resyncs are the ResyncStore calls in flight by user ID.
+	resyncs     map[string]*resync
+	resyncsLock sync.Mutex
 }
 
 func New(
@@ -72,22 +120,134 @@ func New(
 		clientManager: clientManager,
 		credStorer:    credStorer,
 		storeFactory:  storeFactory,
+		loginRetry:    defaultLoginRetryPolicy(),
+		clock:         clock.Real,
 		lock:          sync.RWMutex{},
+
+		bringOnlineWorkers: defaultBringOnlineWorkers,
 	}
 
 	if u.credStorer == nil {
 		log.Error("No credentials store is available")
-	} else if err := u.loadUsersFromCredentialsStore(); err != nil {
+		u.credentialsErr = ErrCredentialsUnavailable
+	} else if err := u.loadUsersWithRetry(); err != nil {
 		log.WithError(err).Error("Could not load all users from credentials store")
+		u.credentialsErr = fmt.Errorf("%w: %v", ErrCredentialsUnavailable, err)
 	}
 
 	return u
 }
 
+// loadUsersWithRetry loads the users, retrying when the credentials store
+// cannot be listed, e.g. due to a transient file system error.
+func (u *Users) loadUsersWithRetry() (err error) {
+	backoff := credentialsListBackoff
+
+	for attempt := 1; ; attempt++ {
+		if err = u.loadUsersFromCredentialsStore(); err == nil || attempt >= credentialsListAttempts {
+			return err
+		}
+
+		log.WithError(err).WithField("attempt", attempt).Warn("Could not list credentials, retrying")
+
+		<-u.clock.After(backoff)
+		backoff *= 2
+	}
+}
+
+// HealthCheck returns an error wrapping ErrCredentialsUnavailable when the
+// users could not be loaded from the credentials store.
+func (u *Users) HealthCheck() error {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	return u.credentialsErr
+}
+
+// checkCredentials tries to load the users again when they could not be
+// loaded before. It returns the error reported by HealthCheck.
+func (u *Users) checkCredentials() error {
+	if err := u.HealthCheck(); err == nil {
+		return nil
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.credentialsErr == nil || u.credStorer == nil {
+		return u.credentialsErr
+	}
+
+	if err := u.loadUsersFromCredentialsStoreLocked(); err != nil {
+		return fmt.Errorf("%w: %v", ErrCredentialsUnavailable, err)
+	}
+
+	u.credentialsErr = nil
+
+	log.Info("Credentials store is available again")
+
+	return nil
+}
+
+// SetLoginRetry configures how transient API failures during FinishLogin are retried.
+// Each call is tried at most `attempts` times, waiting `backoff` before the first
+// retry and doubling the wait after every further failure.
+func (u *Users) SetLoginRetry(attempts int, backoff time.Duration) {
+	u.loginRetry = retryPolicy{attempts: attempts, backoff: backoff}
+}
+
+// SetStoreMaker replaces the factory of user stores, e.g. to use another
+// store backend. It applies to all stores created after the call, including
+// the stores of already added users when they come online.
+func (u *Users) SetStoreMaker(storeFactory StoreMaker) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.storeFactory = storeFactory
+
+	for _, user := range u.users {
+		user.setStoreMaker(storeFactory)
+	}
+}
+
+// PauseEventLoops stops the event loops of all users from polling the API,
+// e.g. during maintenance, until ResumeEventLoops is called. It also applies
+// to users added or brought online while paused. Events are not dropped:
+// resumed loops continue from the last processed event. A sync which is
+// already running is not interrupted.
+func (u *Users) PauseEventLoops() {
+	u.setEventLoopsPaused(true)
+}
+
+// ResumeEventLoops undoes PauseEventLoops; the loops catch up right away.
+func (u *Users) ResumeEventLoops() {
+	u.setEventLoopsPaused(false)
+}
+
+func (u *Users) setEventLoopsPaused(paused bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.eventLoopsPaused = paused
+
+	for _, user := range u.users {
+		user.setEventLoopPaused(paused)
+	}
+}
+
+// SetClock replaces the clock used for time-dependent behaviour such as retry backoff.
+func (u *Users) SetClock(clk clock.Clock) {
+	u.clock = clk
+}
+
 func (u *Users) loadUsersFromCredentialsStore() error {
 	u.lock.Lock()
 	defer u.lock.Unlock()
 
+	return u.loadUsersFromCredentialsStoreLocked()
+}
+
+func (u *Users) loadUsersFromCredentialsStoreLocked() error {
 	userIDs, err := u.credStorer.List()
 	if err != nil {
 		return err
@@ -101,14 +261,16 @@ func (u *Users) loadUsersFromCredentialsStore() error {
 			continue
 		}
 
-		u.users = append(u.users, user)
+		user.eventLoopPaused = u.eventLoopsPaused
+
+		u.addUserLocked(user)
 	}
 
 	return err
 }
 
 func (u *Users) closeAllConnections() {
-	for _, user := range u.users {
+	for _, user := range u.snapshotUsers() {
 		user.CloseAllConnections()
 	}
 }
@@ -124,12 +286,16 @@ func (u *Users) Login(username string, password []byte) (authClient pmapi.Client
 // FinishLogin finishes the login procedure and adds the user into the credentials store.
 // The main key is only required if we're updating an existing user and only returned if we're creating a new one
 func (u *Users) FinishLogin(client pmapi.Client, auth *pmapi.Auth, password []byte, mainKey string) (*User, string, error) { //nolint[funlen]
-	apiUser, passphrase, err := getAPIUser(context.Background(), client, password)
+	if err := u.checkCredentials(); err != nil {
+		return nil, "", err
+	}
+
+	apiUser, passphrase, err := u.getAPIUser(context.Background(), client, password)
 	if err != nil {
 		return nil, "", err
 	}
 
-	if user, ok := u.hasUser(apiUser.ID); ok {
+	if user, ok := u.findUser(apiUser.ID); ok {
 		if err := user.UnlockCredentials("main", mainKey); err != nil {
 			return nil, "", err
 		}
@@ -157,6 +323,15 @@ func (u *Users) FinishLogin(client pmapi.Client, auth *pmapi.Auth, password []by
 	}
 
 	key, err := u.addNewUser(client, apiUser, auth, passphrase)
+	if err == ErrUserAlreadyConnected {
+		// A concurrent login added the user after it was looked up above.
+		if err := client.AuthDelete(context.Background()); err != nil {
+			logrus.WithError(err).Warn("Failed to delete new auth session")
+		}
+
+		user, _ := u.findUser(apiUser.ID)
+		return user, "", ErrUserAlreadyConnected
+	}
 	if err != nil {
 		return nil, "", errors.Wrap(err, "failed to add new user")
 	}
@@ -171,12 +346,23 @@ func (u *Users) FinishLogin(client pmapi.Client, auth *pmapi.Auth, password []by
 	return user, mainKey, nil
 }
 
-// addNewUser adds a new user.
+// addNewUser adds a new user. It fails with ErrUserAlreadyConnected when the
+// user was added meanwhile, e.g. by a concurrent FinishLogin, and with
+// ErrCredentialsExist when the store has credentials of a user not loaded.
 func (u *Users) addNewUser(client pmapi.Client, apiUser *pmapi.User, auth *pmapi.Auth, passphrase []byte) ([]byte, error) {
+	emails := client.Addresses().ActiveEmails()
+
 	u.lock.Lock()
 	defer u.lock.Unlock()
 
-	_, mainKey, err := u.credStorer.Add(apiUser.ID, apiUser.Name, auth.UID, auth.RefreshToken, passphrase, client.Addresses().ActiveEmails())
+	if _, ok := u.hasUser(apiUser.ID); ok {
+		return nil, ErrUserAlreadyConnected
+	}
+
+	_, mainKey, err := u.credStorer.Add(apiUser.ID, apiUser.Name, auth.UID, auth.RefreshToken, passphrase, emails)
+	if errors.Is(err, credentials.ErrAlreadyExists) {
+		return nil, ErrCredentialsExist
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to add user credentials to credentials store")
 	}
@@ -186,56 +372,221 @@ func (u *Users) addNewUser(client pmapi.Client, apiUser *pmapi.User, auth *pmapi
 		return nil, errors.Wrap(err, "failed to create new user")
 	}
 
-	u.users = append(u.users, user)
+	user.eventLoopPaused = u.eventLoopsPaused
+
+	u.addUserLocked(user)
 
 	return mainKey, nil
 }
 
-func getAPIUser(ctx context.Context, client pmapi.Client, password []byte) (*pmapi.User, []byte, error) {
-	salt, err := client.AuthSalt(ctx)
+func (u *Users) getAPIUser(ctx context.Context, client pmapi.Client, password []byte) (*pmapi.User, []byte, error) {
+	passphrase, err := u.unlockWithPassword(ctx, client, password)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to get salt")
+		return nil, nil, err
+	}
+
+	var user *pmapi.User
+
+	if err := u.loginRetry.do(ctx, u.clock, func() (err error) {
+		user, err = client.CurrentUser(ctx)
+		return err
+	}); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to load user data")
+	}
+
+	return user, passphrase, nil
+}
+
+// unlockWithPassword hashes the mailbox password and unlocks the user's keys
+// with it. The hashed passphrase is returned so it can be stored.
+func (u *Users) unlockWithPassword(ctx context.Context, client pmapi.Client, password []byte) ([]byte, error) {
+	var salt string
+
+	if err := u.loginRetry.do(ctx, u.clock, func() (err error) {
+		salt, err = client.AuthSalt(ctx)
+		return err
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to get salt")
 	}
 
 	passphrase, err := pmapi.HashMailboxPassword(password, salt)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to hash password")
+		return nil, errors.Wrap(err, "failed to hash password")
 	}
 
 	// We unlock the user's PGP key here to detect if the user's mailbox password is wrong.
-	if err := client.Unlock(ctx, passphrase); err != nil {
-		return nil, nil, ErrWrongMailboxPassword
+	if err := u.loginRetry.do(ctx, u.clock, func() error {
+		return client.Unlock(ctx, passphrase)
+	}); err != nil {
+		return nil, ErrWrongMailboxPassword
+	}
+
+	return passphrase, nil
+}
+
+// UpdateMailboxPassword stores a new mailbox password of the user after it
+// has been changed upstream, without logging the user in again. The password
+// is checked by unlocking the user's keys first. Open connections of the user
+// are closed so that the sessions pick up the new password.
+func (u *Users) UpdateMailboxPassword(userID string, newPassword []byte) error {
+	user, ok := u.findUser(userID)
+	if !ok {
+		return errors.New("user " + userID + " not found")
+	}
+
+	if !user.IsConnected() {
+		return ErrLoggedOutUser
 	}
 
-	user, err := client.CurrentUser(ctx)
+	passphrase, err := u.unlockWithPassword(context.Background(), user.GetClient(), newPassword)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to load user data")
+		return err
 	}
 
-	return user, passphrase, nil
+	creds, err := u.credStorer.UpdatePassword(userID, passphrase)
+	if err != nil {
+		return errors.Wrap(err, "failed to update password of user in credentials store")
+	}
+
+	user.setCredentials(creds)
+	user.CloseAllConnections()
+
+	return nil
+}
+
+// SetUserEnabled enables or disables logins of the user while keeping the
+// credentials. Open connections of a disabled user are closed.
+func (u *Users) SetUserEnabled(userID string, enabled bool) error {
+	user, ok := u.findUser(userID)
+	if !ok {
+		return errors.New("user " + userID + " not found")
+	}
+
+	creds, err := u.credStorer.SetEnabled(userID, enabled)
+	if err != nil {
+		return errors.Wrap(err, "failed to update user in credentials store")
+	}
+
+	user.setCredentials(creds)
+
+	if !enabled {
+		user.CloseAllConnections()
+	}
+
+	return nil
+}
+
+// SetUserComment replaces the operator's note kept with the credentials of
+// the user, see ListUsers.
+func (u *Users) SetUserComment(userID, comment string) error {
+	user, ok := u.findUser(userID)
+	if !ok {
+		return errors.New("user " + userID + " not found")
+	}
+
+	if err := u.credStorer.SetComment(userID, comment); err != nil {
+		return errors.Wrap(err, "failed to update user in credentials store")
+	}
+
+	creds, err := u.credStorer.Get(userID)
+	if err != nil {
+		return errors.Wrap(err, "failed to load user credentials")
+	}
+
+	user.setCredentials(creds)
+
+	return nil
 }
 
 // GetUsers returns all added users into keychain (even logged out users).
+// The returned slice is a copy and is not changed by adding or removing users.
 func (u *Users) GetUsers() []*User {
+	return u.snapshotUsers()
+}
+
+// ForEachUser calls fn for every added user (even logged out users) and stops
+// at the first error, which is returned. The users are snapshotted first so
+// fn is free to call back into Users.
+func (u *Users) ForEachUser(fn func(*User) error) error {
+	for _, user := range u.snapshotUsers() {
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UserSummary is a snapshot of the state of a single user.
+type UserSummary struct {
+	ID        string   `json:"id"`
+	Username  string   `json:"username"`
+	Addresses []string `json:"addresses"`
+	Connected bool     `json:"connected"`
+	Comment   string   `json:"comment,omitempty"`
+}
+
+// ListUsers returns a summary of every added user (even logged out users).
+func (u *Users) ListUsers() []UserSummary {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	summaries := make([]UserSummary, 0, len(u.users))
+	for _, user := range u.users {
+		summaries = append(summaries, UserSummary{
+			ID:        user.ID(),
+			Username:  user.Username(),
+			Addresses: user.GetAddresses(),
+			Connected: user.IsConnected(),
+			Comment:   user.Comment(),
+		})
+	}
+
+	return summaries
+}
+
+// CountConnected returns the number of connected users.
+func (u *Users) CountConnected() int {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	count := 0
+	for _, user := range u.users {
+		if user.IsConnected() {
+			count++
+		}
+	}
+
+	return count
+}
+
+// CountTotal returns the number of added users (even logged out users).
+func (u *Users) CountTotal() int {
 	u.lock.RLock()
 	defer u.lock.RUnlock()
 
-	return u.users
+	return len(u.users)
 }
 
 // GetUser returns a user by `query` which is compared to users' ID, username or any attached e-mail address.
 func (u *Users) GetUser(query string) (*User, error) {
 	u.crashBandicoot(query)
 
+	if err := u.checkCredentials(); err != nil {
+		return nil, err
+	}
+
 	u.lock.RLock()
 	defer u.lock.RUnlock()
 
+	queryAddress := NormalizeAddress(query)
+
 	for _, user := range u.users {
 		if strings.EqualFold(user.ID(), query) || strings.EqualFold(user.Username(), query) {
 			return user, nil
 		}
 		for _, address := range user.GetAddresses() {
-			if strings.EqualFold(address, query) {
+			if NormalizeAddress(address) == queryAddress {
 				return user, nil
 			}
 		}
@@ -244,11 +595,57 @@ func (u *Users) GetUser(query string) (*User, error) {
 	return nil, errors.New("user " + query + " not found")
 }
 
+// GetUserByAddress returns the user owning `address`, which may be any of the
+// user's addresses. Unlike GetUser, user IDs and usernames are not matched.
+func (u *Users) GetUserByAddress(address string) (*User, error) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	address = NormalizeAddress(address)
+
+	for _, user := range u.users {
+		for _, userAddress := range user.GetAddresses() {
+			if NormalizeAddress(userAddress) == address {
+				return user, nil
+			}
+		}
+	}
+
+	return nil, errors.New("user with address " + address + " not found")
+}
+
+// KnownAddresses returns the normalized addresses of all added users (even
+// logged out users), deduplicated and sorted. The addresses are taken from the
+// credentials, so no API calls are made.
+func (u *Users) KnownAddresses() []string {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	seen := map[string]struct{}{}
+	addresses := []string{}
+
+	for _, user := range u.users {
+		for _, address := range user.GetAddresses() {
+			address = NormalizeAddress(address)
+			if _, ok := seen[address]; ok {
+				continue
+			}
+
+			seen[address] = struct{}{}
+			addresses = append(addresses, address)
+		}
+	}
+
+	sort.Strings(addresses)
+
+	return addresses
+}
+
 // ClearData closes all connections (to release db files and so on) and clears all data.
 func (u *Users) ClearData() error {
 	var result error
 
-	for _, user := range u.users {
+	for _, user := range u.snapshotUsers() {
 		if err := user.Logout(); err != nil {
 			result = multierror.Append(result, err)
 		}
@@ -269,7 +666,7 @@ func (u *Users) DeleteUser(userID string, clearStore bool) error {
 
 	log := log.WithField("user", userID)
 
-	for idx, user := range u.users {
+	for _, user := range u.users {
 		if user.ID() == userID {
 			if err := user.Logout(); err != nil {
 				log.WithError(err).Error("Cannot logout user")
@@ -292,7 +689,7 @@ func (u *Users) DeleteUser(userID string, clearStore bool) error {
 				log.WithError(err).Error("Cannot remove user")
 				return err
 			}
-			u.users = append(u.users[:idx], u.users[idx+1:]...)
+			u.removeUserLocked(user)
 			return nil
 		}
 	}
@@ -300,6 +697,61 @@ func (u *Users) DeleteUser(userID string, clearStore bool) error {
 	return errors.New("user " + userID + " not found")
 }
 
+// RemoveUser tears down everything kept about the user: it logs the user out,
+// removes the store database and deletes the credentials. Parts which are
+// already gone are skipped, so it can finish an interrupted removal. A close
+// connection event is emitted for each of the user's addresses. All errors are
+// collected and returned together.
+func (u *Users) RemoveUser(userID string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	var result error
+
+	user, ok := u.hasUser(userID)
+	if ok {
+		// Logout emits the close connection events only for connected users.
+		wasConnected := user.IsConnected()
+
+		if err := user.Logout(); err != nil {
+			result = multierror.Append(result, err)
+		}
+
+		if err := user.closeStore(); err != nil {
+			result = multierror.Append(result, err)
+		}
+
+		if !wasConnected {
+			user.CloseAllConnections()
+		}
+
+		u.removeUserLocked(user)
+	}
+
+	if err := u.storeFactory.Remove(userID); err != nil {
+		result = multierror.Append(result, errors.Wrap(err, "failed to remove store"))
+	}
+
+	if err := u.credStorer.Delete(userID); err != nil && !errors.Is(err, credentials.ErrNotFound) {
+		result = multierror.Append(result, errors.Wrap(err, "failed to delete credentials"))
+	}
+
+	return result
+}
+
+// Logout logs out the user with ID `userID` from the API and the credentials store.
+// A close connection event is emitted for each of the user's addresses so that
+// all IMAP and SMTP sessions (including cached IMAP users) get dropped.
+func (u *Users) Logout(userID string) error {
+	user, ok := u.findUser(userID)
+
+	if !ok {
+		return errors.New("user " + userID + " not found")
+	}
+
+	return user.Logout()
+}
+
 // ClearUsers deletes all users.
 func (u *Users) ClearUsers() error {
 	var result error
@@ -313,7 +765,16 @@ func (u *Users) ClearUsers() error {
 	return result
 }
 
+// findUser is hasUser for callers which do not hold the lock.
+func (u *Users) findUser(id string) (*User, bool) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	return u.hasUser(id)
+}
+
 // hasUser returns whether the struct currently has a user with ID `id`.
+// The caller must hold the lock.
 func (u *Users) hasUser(id string) (user *User, ok bool) {
 	for _, u := range u.users {
 		if u.ID() == id {
@@ -325,6 +786,37 @@ func (u *Users) hasUser(id string) (user *User, ok bool) {
 	return
 }
 
+// snapshotUsers returns a copy of the users which is safe to use without
+// holding the lock, e.g. to call back into Users for each user.
+func (u *Users) snapshotUsers() []*User {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	users := make([]*User, len(u.users))
+	copy(users, u.users)
+
+	return users
+}
+
+// addUserLocked appends user. The caller must hold the write lock.
+func (u *Users) addUserLocked(user *User) {
+	u.users = append(u.users, user)
+}
+
+// removeUserLocked removes user, keeping the order of the others. The caller
+// must hold the write lock. A fresh slice is built so that snapshots and
+// slices handed out earlier are never modified.
+func (u *Users) removeUserLocked(user *User) {
+	users := make([]*User, 0, len(u.users))
+	for _, other := range u.users {
+		if other != user {
+			users = append(users, other)
+		}
+	}
+
+	u.users = users
+}
+
 // "Easter egg" for testing purposes.
 func (u *Users) crashBandicoot(username string) {
 	if username == "crash@bandicoot" {
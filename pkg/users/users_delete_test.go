@@ -23,6 +23,8 @@ import (
 
 	gomock "github.com/golang/mock/gomock"
 	"github.com/ljanyst/peroxide/pkg/events"
+	"github.com/ljanyst/peroxide/pkg/users/credentials"
+	usersmocks "github.com/ljanyst/peroxide/pkg/users/mocks"
 	r "github.com/stretchr/testify/require"
 )
 
@@ -67,3 +69,72 @@ func TestDeleteUserWithFailingLogout(t *testing.T) {
 	r.NoError(t, err)
 	r.Equal(t, 1, len(users.users))
 }
+
+func TestRemoveUser(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	users := testNewUsersWithUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	storeMaker := usersmocks.NewMockStoreMaker(m.ctrl)
+	users.SetStoreMaker(storeMaker)
+
+	gomock.InOrder(
+		m.pmapiClient.EXPECT().AuthDelete(gomock.Any()).Return(nil),
+		m.credentialsStore.EXPECT().Logout("user").Return(testCredentialsDisconnected, nil),
+		storeMaker.EXPECT().Remove("user").Return(nil),
+		m.credentialsStore.EXPECT().Delete("user").Return(nil),
+	)
+	m.eventListener.EXPECT().Emit(events.CloseConnectionEvent, "user@pm.me")
+
+	r.NoError(t, users.RemoveUser("user"))
+	r.Equal(t, 1, len(users.users))
+}
+
+func TestRemoveUserAggregatesErrors(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	users := testNewUsersWithUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	storeMaker := usersmocks.NewMockStoreMaker(m.ctrl)
+	users.SetStoreMaker(storeMaker)
+
+	errRemove := errors.New("remove failed")
+	errDelete := errors.New("delete failed")
+
+	gomock.InOrder(
+		m.pmapiClient.EXPECT().AuthDelete(gomock.Any()).Return(nil),
+		m.credentialsStore.EXPECT().Logout("user").Return(testCredentialsDisconnected, nil),
+		storeMaker.EXPECT().Remove("user").Return(errRemove),
+		m.credentialsStore.EXPECT().Delete("user").Return(errDelete),
+	)
+	m.eventListener.EXPECT().Emit(events.CloseConnectionEvent, "user@pm.me")
+
+	err := users.RemoveUser("user")
+	r.True(t, errors.Is(err, errRemove))
+	r.True(t, errors.Is(err, errDelete))
+
+	// The user is gone even though the cleanup was not complete.
+	r.Equal(t, 1, len(users.users))
+}
+
+func TestRemoveUserPartialState(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	users := testNewUsersWithUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	// The user was removed from memory already, only the credentials are left behind.
+	gomock.InOrder(
+		m.credentialsStore.EXPECT().Delete("removed").Return(nil),
+		m.credentialsStore.EXPECT().Delete("removed").Return(credentials.ErrNotFound),
+	)
+
+	r.NoError(t, users.RemoveUser("removed"))
+	r.NoError(t, users.RemoveUser("removed"))
+	r.Equal(t, 2, len(users.users))
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package users
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	r "github.com/stretchr/testify/require"
+)
+
+func TestUsersPauseEventLoops(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	var polls int32
+	countPoll := func(_ interface{}, _ string) (*pmapi.Event, error) {
+		atomic.AddInt32(&polls, 1)
+		return testPMAPIEvent, nil
+	}
+
+	m.credentialsStore.EXPECT().List().Return([]string{testCredentials.UserID}, nil)
+	mockLoadingConnectedUser(t, m, testCredentials)
+	m.pmapiClient.EXPECT().GetEvent(gomock.Any(), gomock.Any()).DoAndReturn(countPoll).AnyTimes()
+	m.pmapiClient.EXPECT().ListMessages(gomock.Any(), gomock.Any()).Return([]*pmapi.Message{}, 0, nil).AnyTimes()
+
+	users := testNewUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	store := users.users[0].GetStore()
+	r.NotNil(t, store)
+	store.TestPollNow()
+
+	users.PauseEventLoops()
+	paused := atomic.LoadInt32(&polls)
+
+	store.TestPollNow()
+	waitForEvents()
+	r.Equal(t, paused, atomic.LoadInt32(&polls), "paused event loop must not call the API")
+
+	users.ResumeEventLoops()
+	r.Eventually(t, func() bool {
+		return atomic.LoadInt32(&polls) > paused
+	}, time.Second, 10*time.Millisecond)
+}
@@ -18,8 +18,10 @@
 package users
 
 import (
+	"errors"
 	"testing"
 
+	"github.com/ljanyst/peroxide/pkg/users/credentials"
 	r "github.com/stretchr/testify/require"
 )
 
@@ -56,6 +58,190 @@ func TestGetUserByEmail(t *testing.T) {
 	checkUsersGetUser(t, m, "alsouser@pm.me", 1, "")
 }
 
+func TestGetUserByAddress(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	users := testNewUsersWithUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	// Both addresses of the combined-mode user resolve to the same user.
+	primary, err := users.GetUserByAddress("users@pm.me")
+	r.NoError(t, err)
+	r.Equal(t, users.users[1], primary)
+
+	secondary, err := users.GetUserByAddress("AnotherUser@PM.me")
+	r.NoError(t, err)
+	r.Equal(t, primary, secondary)
+
+	// IDs and usernames are not addresses.
+	_, err = users.GetUserByAddress("usersname")
+	r.EqualError(t, err, "user with address usersname not found")
+}
+
+func TestKnownAddresses(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	users := testNewUsersWithUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	// A user with no store, known only from its credentials.
+	extra := &User{userID: "extra", creds: &credentials.Credentials{
+		Emails: []string{"User@PM.me", "zed@pm.me", "zed@xn--bcher-kva.example", "Zed@bücher.example"},
+	}}
+
+	users.lock.Lock()
+	users.addUserLocked(extra)
+	users.lock.Unlock()
+
+	defer func() {
+		users.lock.Lock()
+		users.removeUserLocked(extra)
+		users.lock.Unlock()
+	}()
+
+	r.Equal(t, []string{"alsouser@pm.me", "anotheruser@pm.me", "user@pm.me", "users@pm.me", "zed@bücher.example", "zed@pm.me"}, users.KnownAddresses())
+}
+
+func TestGetUserIDNAddress(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	users := testNewUsersWithUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	idn := &User{userID: "idn", creds: &credentials.Credentials{
+		Name:   "idn",
+		Emails: []string{"user@bücher.example"},
+	}}
+
+	users.lock.Lock()
+	users.addUserLocked(idn)
+	users.lock.Unlock()
+
+	defer func() {
+		users.lock.Lock()
+		users.removeUserLocked(idn)
+		users.lock.Unlock()
+	}()
+
+	// The Unicode and the punycode form of the domain are the same address.
+	for _, address := range []string{"user@bücher.example", "User@BÜCHER.example", "user@xn--bcher-kva.example"} {
+		user, err := users.GetUser(address)
+		r.NoError(t, err, address)
+		r.Equal(t, idn, user, address)
+
+		user, err = users.GetUserByAddress(address)
+		r.NoError(t, err, address)
+		r.Equal(t, idn, user, address)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	users := testNewUsersWithUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	summaries := users.ListUsers()
+	r.Equal(t, 2, len(summaries))
+	r.Equal(t, UserSummary{
+		ID:        "users",
+		Username:  "usersname",
+		Addresses: []string{"users@pm.me", "anotheruser@pm.me", "alsouser@pm.me"},
+		Connected: true,
+	}, summaries[1])
+}
+
+func TestListUsersComment(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	users := testNewUsersWithUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	commented := *testCredentialsSplit
+	commented.Comment = "shipping dept shared inbox"
+
+	m.credentialsStore.EXPECT().SetComment("users", commented.Comment).Return(nil)
+	m.credentialsStore.EXPECT().Get("users").Return(&commented, nil)
+
+	r.NoError(t, users.SetUserComment("users", commented.Comment))
+	r.Equal(t, commented.Comment, users.ListUsers()[1].Comment)
+	r.Empty(t, users.ListUsers()[0].Comment)
+
+	r.Error(t, users.SetUserComment("unknown", "note"))
+}
+
+func TestListUsersDisconnected(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	m.credentialsStore.EXPECT().List().Return([]string{testCredentialsDisconnected.UserID}, nil)
+	mockLoadingDisconnectedUser(m, testCredentialsDisconnected)
+
+	users := testNewUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	summaries := users.ListUsers()
+	r.Equal(t, 1, len(summaries))
+	r.Equal(t, testCredentialsDisconnected.UserID, summaries[0].ID)
+	r.False(t, summaries[0].Connected)
+	r.False(t, users.GetUsers()[0].IsConnected())
+}
+
+func TestCountUsers(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	m.credentialsStore.EXPECT().List().Return([]string{testCredentialsDisconnected.UserID, testCredentials.UserID}, nil)
+	mockLoadingDisconnectedUser(m, testCredentialsDisconnected)
+	mockLoadingConnectedUser(t, m, testCredentials)
+	mockEventLoopNoAction(m)
+
+	users := testNewUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	r.Equal(t, 1, users.CountConnected())
+	r.Equal(t, 2, users.CountTotal())
+}
+
+func TestForEachUser(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	users := testNewUsersWithUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	var ids []string
+	r.NoError(t, users.ForEachUser(func(user *User) error {
+		// Calling back into Users must not deadlock.
+		r.Equal(t, 2, users.CountTotal())
+		ids = append(ids, user.ID())
+		return nil
+	}))
+	r.Equal(t, []string{"user", "users"}, ids)
+}
+
+func TestForEachUserStopsOnError(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	users := testNewUsersWithUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	errStop := errors.New("stop")
+	count := 0
+	err := users.ForEachUser(func(*User) error {
+		count++
+		return errStop
+	})
+	r.ErrorIs(t, err, errStop)
+	r.Equal(t, 1, count)
+}
+
 func checkUsersGetUser(t *testing.T, m mocks, query string, index int, expectedError string) {
 	users := testNewUsersWithUsers(t, m)
 	defer cleanUpUsersData(users)
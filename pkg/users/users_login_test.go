@@ -18,10 +18,15 @@
 package users
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	gomock "github.com/golang/mock/gomock"
+	"github.com/ljanyst/peroxide/pkg/clock"
+	"github.com/ljanyst/peroxide/pkg/events"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/users/credentials"
 	"github.com/pkg/errors"
 	r "github.com/stretchr/testify/require"
 )
@@ -53,6 +58,109 @@ func TestUsersFinishLoginNewUser(t *testing.T) {
 	checkUsersFinishLogin(t, m, testAuthRefresh, testCredentials.Secret.MailboxPassword, testCredentials.UserID, nil, true)
 }
 
+func TestUsersFinishLoginCredentialsExist(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	// The credentials are in the store but the user is not loaded.
+	m.credentialsStore.EXPECT().List().Return([]string{}, nil)
+
+	gomock.InOrder(
+		m.pmapiClient.EXPECT().AuthSalt(gomock.Any()).Return("", nil),
+		m.pmapiClient.EXPECT().Unlock(gomock.Any(), testCredentials.Secret.MailboxPassword).Return(nil),
+		m.pmapiClient.EXPECT().CurrentUser(gomock.Any()).Return(testPMAPIUser, nil),
+		m.pmapiClient.EXPECT().Addresses().Return([]*pmapi.Address{testPMAPIAddress}),
+		m.credentialsStore.EXPECT().Add("user", "username", testAuthRefresh.UID, testAuthRefresh.RefreshToken, testCredentials.Secret.MailboxPassword, []string{testPMAPIAddress.Email}).Return(nil, nil, credentials.ErrAlreadyExists),
+	)
+
+	users := testNewUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	user, key, err := users.FinishLogin(m.pmapiClient, testAuthRefresh, testCredentials.Secret.MailboxPassword, testMainKeyString)
+	r.True(t, errors.Is(err, ErrCredentialsExist), err)
+	r.Nil(t, user)
+	r.Empty(t, key)
+	r.Equal(t, 0, users.CountTotal())
+}
+
+func TestUsersFinishLoginRetriesTransientError(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	// Init users with no user from keychain.
+	m.credentialsStore.EXPECT().List().Return([]string{}, nil)
+
+	// The first salt request hits a network blip, the retry succeeds.
+	m.pmapiClient.EXPECT().AuthSalt(gomock.Any()).Return("", pmapi.ErrNoConnection)
+	mockAddingConnectedUser(t, m)
+	mockEventLoopNoAction(m)
+
+	checkUsersFinishLogin(t, m, testAuthRefresh, testCredentials.Secret.MailboxPassword, testCredentials.UserID, nil, true)
+}
+
+func TestUsersFinishLoginDoesNotRetryAuthError(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	// Init users with no user from keychain.
+	m.credentialsStore.EXPECT().List().Return([]string{}, nil)
+
+	m.pmapiClient.EXPECT().AuthSalt(gomock.Any()).Return("", pmapi.ErrUnauthorized).Times(1)
+
+	users := testNewUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	users.SetLoginRetry(defaultLoginRetryAttempts, time.Millisecond)
+
+	user, _, err := users.FinishLogin(m.pmapiClient, testAuthRefresh, testCredentials.Secret.MailboxPassword, testMainKeyString)
+	r.True(t, errors.Is(err, pmapi.ErrUnauthorized))
+	r.Nil(t, user)
+	r.Equal(t, 0, len(users.users))
+}
+
+func TestUsersFinishLoginWaitsOnRateLimit(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	// Init users with no user from keychain.
+	m.credentialsStore.EXPECT().List().Return([]string{}, nil)
+
+	// The first salt request is rate-limited, the retry after the requested wait succeeds.
+	m.pmapiClient.EXPECT().AuthSalt(gomock.Any()).Return("", pmapi.ErrTooManyRequests{
+		OriginalError: errors.New("too many requests"),
+		RetryAfter:    5 * time.Second,
+	})
+	mockAddingConnectedUser(t, m)
+	mockEventLoopNoAction(m)
+
+	users := testNewUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	clk := clock.NewFake(time.Now())
+	users.SetClock(clk)
+
+	type result struct {
+		user *User
+		err  error
+	}
+	resCh := make(chan result)
+
+	go func() {
+		user, _, err := users.FinishLogin(m.pmapiClient, testAuthRefresh, testCredentials.Secret.MailboxPassword, testMainKeyString)
+		resCh <- result{user, err}
+	}()
+
+	waitForFakeWaiter(t, clk)
+	clk.Advance(4 * time.Second)
+	r.Equal(t, 1, clk.Waiters(), "must wait for the whole Retry-After")
+	clk.Advance(time.Second)
+
+	res := <-resCh
+	r.NoError(t, res.err)
+	r.NoError(t, res.user.connect(m.pmapiClient))
+	r.Equal(t, testCredentials.UserID, res.user.ID())
+}
+
 func TestUsersFinishLoginExistingDisconnectedUser(t *testing.T) {
 	m := initMocks(t)
 	defer m.ctrl.Finish()
@@ -111,6 +219,8 @@ func checkUsersFinishLogin(t *testing.T, m mocks, auth *pmapi.Auth, mailboxPassw
 	users := testNewUsers(t, m)
 	defer cleanUpUsersData(users)
 
+	users.SetLoginRetry(defaultLoginRetryAttempts, time.Millisecond)
+
 	user, key, err := users.FinishLogin(m.pmapiClient, auth, mailboxPassword, testMainKeyString)
 	if user != nil {
 		user.connect(m.pmapiClient)
@@ -132,3 +242,191 @@ func checkUsersFinishLogin(t *testing.T, m mocks, auth *pmapi.Auth, mailboxPassw
 		r.Equal(t, 0, len(users.users))
 	}
 }
+
+func TestUsersUpdateMailboxPassword(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	m.credentialsStore.EXPECT().List().Return([]string{testCredentials.UserID}, nil)
+	mockLoadingConnectedUser(t, m, testCredentials)
+	mockEventLoopNoAction(m)
+
+	users := testNewUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	newPassword := []byte("newpass")
+	gomock.InOrder(
+		m.pmapiClient.EXPECT().AuthSalt(gomock.Any()).Return("", nil),
+		m.pmapiClient.EXPECT().Unlock(gomock.Any(), newPassword).Return(nil),
+		m.credentialsStore.EXPECT().UpdatePassword(testCredentials.UserID, newPassword).Return(testCredentials, nil),
+		m.eventListener.EXPECT().Emit(events.CloseConnectionEvent, "user@pm.me"),
+	)
+
+	r.NoError(t, users.UpdateMailboxPassword(testCredentials.UserID, newPassword))
+}
+
+func TestUsersUpdateMailboxPasswordWrongPassword(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	m.credentialsStore.EXPECT().List().Return([]string{testCredentials.UserID}, nil)
+	mockLoadingConnectedUser(t, m, testCredentials)
+	mockEventLoopNoAction(m)
+
+	users := testNewUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	gomock.InOrder(
+		m.pmapiClient.EXPECT().AuthSalt(gomock.Any()).Return("", nil),
+		m.pmapiClient.EXPECT().Unlock(gomock.Any(), []byte("wrong")).Return(errors.New("no keys could be unlocked")),
+	)
+
+	r.Equal(t, ErrWrongMailboxPassword, users.UpdateMailboxPassword(testCredentials.UserID, []byte("wrong")))
+}
+
+func TestUsersConcurrentLoginsAndReads(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	users := testNewUsersWithUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	// Logins of the already connected user.
+	m.pmapiClient.EXPECT().AuthSalt(gomock.Any()).Return("", nil).AnyTimes()
+	m.pmapiClient.EXPECT().Unlock(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	m.pmapiClient.EXPECT().CurrentUser(gomock.Any()).Return(testPMAPIUser, nil).AnyTimes()
+	m.pmapiClient.EXPECT().AuthDelete(gomock.Any()).Return(nil).AnyTimes()
+
+	extra := &User{userID: "extra", creds: testCredentialsDisconnected}
+
+	const rounds = 50
+
+	// Failures are reported back to the test goroutine, as require must not
+	// be used from other goroutines.
+	errs := make(chan error, 4*rounds)
+
+	var wg sync.WaitGroup
+	run := func(fn func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				if err := fn(); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	run(func() error {
+		if _, _, err := users.FinishLogin(m.pmapiClient, testAuthRefresh, testCredentials.Secret.MailboxPassword, testMainKeyString); err != ErrUserAlreadyConnected {
+			return errors.Errorf("unexpected login result: %v", err)
+		}
+		return nil
+	})
+	run(func() error {
+		users.lock.Lock()
+		users.addUserLocked(extra)
+		users.lock.Unlock()
+
+		users.lock.Lock()
+		users.removeUserLocked(extra)
+		users.lock.Unlock()
+
+		return nil
+	})
+	run(func() error {
+		for _, user := range users.GetUsers() {
+			_ = user.ID()
+		}
+		_ = users.ListUsers()
+		_ = users.CountTotal()
+		_ = users.CountConnected()
+
+		return nil
+	})
+	run(func() error {
+		if _, err := users.GetUser(testCredentials.UserID); err != nil {
+			return err
+		}
+		_, err := users.GetUserByAddress("user@pm.me")
+		return err
+	})
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		r.NoError(t, err)
+	}
+
+	r.Equal(t, 2, users.CountTotal())
+}
+
+func TestUsersConcurrentFirstLogins(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	// Init users with no user from keychain.
+	m.credentialsStore.EXPECT().List().Return([]string{}, nil)
+
+	users := testNewUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	m.pmapiClient.EXPECT().AuthSalt(gomock.Any()).Return("", nil).Times(2)
+	m.pmapiClient.EXPECT().Unlock(gomock.Any(), testCredentials.Secret.MailboxPassword).Return(nil).Times(2)
+	m.pmapiClient.EXPECT().CurrentUser(gomock.Any()).Return(testPMAPIUser, nil).Times(2)
+
+	// Both logins look the user up and find nothing before either of them
+	// adds it: the addresses are read right before adding.
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+
+	m.pmapiClient.EXPECT().Addresses().DoAndReturn(func() pmapi.AddressList {
+		arrived.Done()
+		arrived.Wait()
+		return pmapi.AddressList{testPMAPIAddress}
+	}).Times(2)
+
+	// Only one of them adds the user, the other one drops its session.
+	m.credentialsStore.EXPECT().Add("user", "username", testAuthRefresh.UID, testAuthRefresh.RefreshToken, testCredentials.Secret.MailboxPassword, []string{testPMAPIAddress.Email}).Return(testCredentials, testMainKeyBytes[:], nil)
+	m.credentialsStore.EXPECT().Get("user").Return(testCredentials, nil)
+	m.pmapiClient.EXPECT().AuthDelete(gomock.Any()).Return(nil)
+
+	type result struct {
+		user *User
+		key  string
+		err  error
+	}
+
+	results := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			user, key, err := users.FinishLogin(m.pmapiClient, testAuthRefresh, testCredentials.Secret.MailboxPassword, testMainKeyString)
+			results <- result{user, key, err}
+		}()
+	}
+
+	receive := func() result {
+		select {
+		case res := <-results:
+			return res
+		case <-time.After(5 * time.Second):
+			r.FailNow(t, "login did not finish")
+			return result{}
+		}
+	}
+
+	first, second := receive(), receive()
+	if first.err != nil {
+		first, second = second, first
+	}
+
+	r.NoError(t, first.err)
+	r.NotEmpty(t, first.key)
+	r.Equal(t, ErrUserAlreadyConnected, second.err)
+	r.Empty(t, second.key)
+	r.Same(t, first.user, second.user)
+
+	r.Equal(t, 1, users.CountTotal())
+}
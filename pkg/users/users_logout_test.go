@@ -0,0 +1,75 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package users
+
+import (
+	"testing"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/ljanyst/peroxide/pkg/events"
+	r "github.com/stretchr/testify/require"
+)
+
+func TestUsersLogout(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	users := testNewUsersWithUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	gomock.InOrder(
+		m.pmapiClient.EXPECT().AuthDelete(gomock.Any()).Return(nil),
+		m.credentialsStore.EXPECT().Logout("users").Return(testCredentialsSplitDisconnected, nil),
+	)
+
+	// The user with several addresses gets all of them disconnected. The
+	// address mode is kept by the store and does not matter here.
+	for _, address := range testCredentialsSplit.Emails {
+		m.eventListener.EXPECT().Emit(events.CloseConnectionEvent, address)
+	}
+
+	r.NoError(t, users.Logout("users"))
+	r.Equal(t, 2, len(users.users))
+}
+
+func TestUsersLogoutSingleAddress(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	users := testNewUsersWithUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	gomock.InOrder(
+		m.pmapiClient.EXPECT().AuthDelete(gomock.Any()).Return(nil),
+		m.credentialsStore.EXPECT().Logout("user").Return(testCredentialsDisconnected, nil),
+		m.eventListener.EXPECT().Emit(events.CloseConnectionEvent, "user@pm.me"),
+	)
+
+	r.NoError(t, users.Logout("user"))
+	r.Equal(t, 2, len(users.users))
+}
+
+func TestUsersLogoutNoUser(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	users := testNewUsersWithUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	r.EqualError(t, users.Logout("nouser"), "user nouser not found")
+}
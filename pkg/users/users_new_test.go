@@ -25,7 +25,9 @@ import (
 	gomock "github.com/golang/mock/gomock"
 	"github.com/ljanyst/peroxide/pkg/events"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/store"
 	"github.com/ljanyst/peroxide/pkg/users/credentials"
+	usersmocks "github.com/ljanyst/peroxide/pkg/users/mocks"
 	r "github.com/stretchr/testify/require"
 )
 
@@ -33,10 +35,46 @@ func TestNewUsersNoKeychain(t *testing.T) {
 	m := initMocks(t)
 	defer m.ctrl.Finish()
 
-	m.credentialsStore.EXPECT().List().Return([]string{}, errors.New("no keychain"))
+	m.credentialsStore.EXPECT().List().Return([]string{}, errors.New("no keychain")).Times(credentialsListAttempts)
 	checkUsersNew(t, m, []*credentials.Credentials{})
 }
 
+func TestNewUsersRetriesCredentialsList(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	m.credentialsStore.EXPECT().List().Return(nil, errors.New("resource busy")).Times(2)
+	m.credentialsStore.EXPECT().List().Return([]string{}, nil)
+
+	users := New(m.eventListener, m.clientManager, m.credentialsStore, m.storeMaker)
+	defer cleanUpUsersData(users)
+
+	r.NoError(t, users.HealthCheck())
+}
+
+func TestNewUsersDegradedCredentials(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	m.credentialsStore.EXPECT().List().Return(nil, errors.New("resource busy")).Times(credentialsListAttempts + 1)
+
+	users := New(m.eventListener, m.clientManager, m.credentialsStore, m.storeMaker)
+	defer cleanUpUsersData(users)
+
+	r.ErrorIs(t, users.HealthCheck(), ErrCredentialsUnavailable)
+
+	_, err := users.GetUser("user")
+	r.ErrorIs(t, err, ErrCredentialsUnavailable)
+
+	// Once the store is readable again, the users are loaded on the next lookup.
+	m.credentialsStore.EXPECT().List().Return([]string{}, nil)
+
+	_, err = users.GetUser("user")
+	r.Error(t, err)
+	r.NotErrorIs(t, err, ErrCredentialsUnavailable)
+	r.NoError(t, users.HealthCheck())
+}
+
 func TestNewUsersWithoutUsersInCredentialsStore(t *testing.T) {
 	m := initMocks(t)
 	defer m.ctrl.Finish()
@@ -97,6 +135,28 @@ func TestNewUsersWithConnectedUserWithBadToken(t *testing.T) {
 	checkUsersNew(t, m, []*credentials.Credentials{testCredentialsDisconnected})
 }
 
+func TestUsersSetStoreMaker(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	m.credentialsStore.EXPECT().List().Return([]string{testCredentials.UserID}, nil)
+	mockLoadingConnectedUser(t, m, testCredentials)
+	mockEventLoopNoAction(m)
+
+	users := New(m.eventListener, m.clientManager, m.credentialsStore, m.storeMaker)
+	defer cleanUpUsersData(users)
+
+	// The injected factory delegates to the default one which creates a real store.
+	storeMaker := usersmocks.NewMockStoreMaker(m.ctrl)
+	storeMaker.EXPECT().New(gomock.Any(), true).DoAndReturn(func(user store.BridgeUser, connected bool) (store.UserStore, error) {
+		return m.storeMaker.New(user, connected)
+	})
+	users.SetStoreMaker(storeMaker)
+
+	r.NoError(t, users.users[0].BringOnline("main", "foobar"))
+	waitForEvents()
+}
+
 func checkUsersNew(t *testing.T, m mocks, expectedCredentials []*credentials.Credentials) {
 	users := testNewUsers(t, m)
 	defer cleanUpUsersData(users)
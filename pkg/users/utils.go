@@ -19,10 +19,14 @@ package users
 
 import (
 	"strings"
+
+	"github.com/ljanyst/peroxide/pkg/mailaddr"
 )
 
-// Extract the login and key slot from the login information
+// Extract the login and key slot from the login information.
+// Surrounding whitespace is ignored and the slot is normalized with NormalizeSlot.
 func DecodeLogin(login string) (string, string) {
+	login = strings.TrimSpace(login)
 	if login == "" {
 		return "", "main"
 	}
@@ -40,7 +44,7 @@ func DecodeLogin(login string) (string, string) {
 	userName := splitUser[0]
 	slot := "main"
 	if len(splitUser) == 2 {
-		slot = splitUser[1]
+		slot = NormalizeSlot(splitUser[1])
 	}
 
 	if len(splitLogin) == 2 {
@@ -49,3 +53,16 @@ func DecodeLogin(login string) (string, string) {
 
 	return userName, slot
 }
+
+// NormalizeSlot returns the canonical form of a key slot name: trimmed of
+// surrounding whitespace. Unlike addresses, slot names are case-sensitive and
+// keep their casing. Slots are always stored and looked up in this form.
+func NormalizeSlot(slot string) string {
+	return strings.TrimSpace(slot)
+}
+
+// NormalizeAddress returns the canonical form of an address in which addresses
+// are compared and keyed, see mailaddr.Normalize.
+func NormalizeAddress(address string) string {
+	return mailaddr.Normalize(address)
+}
@@ -37,4 +37,7 @@ func TestLoginDecoder(t *testing.T) {
 	test("foo", "foo", "main")
 	test("foo@bar", "foo@bar", "main")
 	test("foo..test@bar", "foo@bar", "test")
+	test(" foo..test@bar\t", "foo@bar", "test")
+	test("foo..Test @bar", "foo@bar", "Test")
+	test("Foo..PhoneSlot@Bar", "Foo@Bar", "PhoneSlot")
 }